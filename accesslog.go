@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statusClientClosedRequest is logged for requests whose client disconnected
+// before a response was written, following nginx's convention.
+const statusClientClosedRequest = 499
+
+// statusRecorder captures the status code and size of a response while still
+// supporting streaming through http.Flusher.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush forwards to the underlying writer so SSE keeps working.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack forwards to the underlying writer so WebSocket upgrades work.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// headerWritten reports whether the response status has already been sent
+// through a statusRecorder anywhere in the writer chain. A gzipResponseWriter
+// holds the status back until it knows whether to compress, so one that has
+// been given a status or body counts as written too.
+func headerWritten(w http.ResponseWriter) bool {
+	for {
+		switch w := w.(type) {
+		case *statusRecorder:
+			if w.status != 0 {
+				return true
+			}
+		case *gzipResponseWriter:
+			if w.status != 0 || len(w.buf) > 0 {
+				return true
+			}
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// accessLogMiddleware emits one structured log entry per request with its
+// method, path, status, body size and latency. Requests slower than
+// slowThreshold are logged at warning level.
+func accessLogMiddleware(logger *logrus.Logger, slowThreshold time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		switch {
+		case status == 0 && clientGone(r):
+			status = statusClientClosedRequest
+		case status == 0:
+			status = http.StatusOK
+		}
+		duration := time.Since(start)
+		entry := logger.WithFields(logrus.Fields{
+			"request_id":    w.Header().Get(requestIDHeader),
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			"status":        status,
+			"request_bytes": body.n,
+			"bytes":         rec.bytes,
+			"duration_ms":   duration.Milliseconds(),
+			"remote_ip":     clientIP(r),
+		})
+		if slowThreshold > 0 && duration > slowThreshold {
+			entry.Warn("slow request")
+			return
+		}
+		entry.Info("request completed")
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SystemPromptPayload is the body of the admin system prompt endpoints.
+type SystemPromptPayload struct {
+	Prompt string `json:"prompt"`
+}
+
+// adminMiddleware requires "Authorization: Bearer <ADMIN_TOKEN>". The admin
+// token is deliberately independent of user JWTs.
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			s.requestLogger(r).Warn("rejected admin request with missing or invalid token")
+			s.errorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid admin token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// currentSystemPrompt returns the system prompt in effect.
+func (s *Server) currentSystemPrompt() string {
+	s.promptMu.RLock()
+	defer s.promptMu.RUnlock()
+	return s.systemPrompt
+}
+
+// setSystemPrompt replaces the system prompt and, when configured, persists
+// it so the override survives a restart.
+func (s *Server) setSystemPrompt(prompt string) error {
+	s.promptMu.Lock()
+	defer s.promptMu.Unlock()
+
+	if path := s.cfg.SystemPromptOverrideFile; path != "" {
+		// Write to a temporary file first so a crash never leaves a truncated prompt.
+		tmp, err := os.CreateTemp(filepath.Dir(path), ".system-prompt-*")
+		if err != nil {
+			return fmt.Errorf("create temporary prompt file: %w", err)
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.WriteString(prompt); err != nil {
+			tmp.Close()
+			return fmt.Errorf("write prompt file: %w", err)
+		}
+		if err := tmp.Close(); err != nil {
+			return fmt.Errorf("write prompt file: %w", err)
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return fmt.Errorf("replace prompt file: %w", err)
+		}
+	}
+
+	s.systemPrompt = prompt
+	return nil
+}
+
+// getSystemPromptHandler returns the system prompt in effect.
+func (s *Server) getSystemPromptHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, SystemPromptPayload{Prompt: s.currentSystemPrompt()})
+}
+
+// putSystemPromptHandler replaces the system prompt at runtime.
+func (s *Server) putSystemPromptHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+
+	if !s.hasJSONBody(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	var payload SystemPromptPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, "Invalid request payload")
+		return
+	}
+
+	prompt := strings.TrimSpace(payload.Prompt)
+	if prompt == "" {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The prompt field is required")
+		return
+	}
+
+	if err := checkPromptTemplate(prompt); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Invalid prompt template: %v", err))
+		return
+	}
+
+	if err := s.setSystemPrompt(prompt); err != nil {
+		log.WithError(err).Error("failed to persist system prompt")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Failed to save system prompt")
+		return
+	}
+
+	log.WithField("prompt_chars", len(prompt)).Info("system prompt updated via admin API")
+	s.writeJSON(w, http.StatusOK, SystemPromptPayload{Prompt: prompt})
+}
@@ -2,25 +2,110 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-func initHandler(w http.ResponseWriter, r *http.Request) {
+// tokenTTL is the lifetime of an issued auth token.
+const tokenTTL = time.Hour * 24 * 30
+
+// legacyToken reports whether a token without a jti may still be accepted.
+// Tokens issued before revocation support carry neither jti nor iat and stay
+// valid until they expire; a token with an iat is only accepted without a jti
+// if it was issued before JTI_REQUIRED_SINCE.
+func (s *Server) legacyToken(claims jwt.MapClaims) bool {
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return false
+	}
+	return iat == nil || iat.Before(s.cfg.JTIRequiredSince)
+}
+
+func (s *Server) initHandler(w http.ResponseWriter, r *http.Request) {
 	// Создаем JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"app": "tshawytscha-ai",
-		"exp": time.Now().Add(time.Hour * 24 * 30).Unix(),
+	// Every client gets its own subject so it can be rate limited individually.
+	if err := s.issueToken(w, jwt.MapClaims{"app": "tshawytscha-ai", "sub": uuid.NewString()}); err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Failed to create token")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// refreshHandler exchanges a valid, unexpired auth token for a new one with the
+// same claims and a fresh expiry.
+func (s *Server) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.issueToken(w, claims); err != nil {
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Failed to create token")
+		return
+	}
+	// The old token must not stay usable next to its replacement; a legacy
+	// token without a jti cannot be revoked and lives on until it expires.
+	s.revoke(claims)
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// logoutHandler revokes the caller's token and clears the auth cookie.
+func (s *Server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	s.revoke(claims)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "auth_token",
+		Value:    "",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+		MaxAge:   -1,
 	})
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-	if err != nil {
-		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+// revoke adds the token's jti to the revocation list until it expires. Legacy
+// tokens have no jti and cannot be revoked: logging out or refreshing one only
+// replaces the cookie, and the old token stays valid until its exp.
+func (s *Server) revoke(claims jwt.MapClaims) {
+	jti, _ := claims["jti"].(string)
+	exp, err := claims.GetExpirationTime()
+	if jti == "" || err != nil || exp == nil {
 		return
 	}
+	s.revocations.Revoke(jti, exp.Time)
+}
+
+// issueToken signs the claims with a fresh expiry and token ID and sets the
+// result as the auth cookie.
+func (s *Server) issueToken(w http.ResponseWriter, claims jwt.MapClaims) error {
+	newClaims := jwt.MapClaims{}
+	for k, v := range claims {
+		newClaims[k] = v
+	}
+	now := time.Now()
+	newClaims["iat"] = now.Unix()
+	newClaims["exp"] = now.Add(tokenTTL).Unix()
+	// jti identifies this token so it can be revoked on logout.
+	newClaims["jti"] = uuid.NewString()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, newClaims)
+	tokenString, err := token.SignedString(s.cfg.JWTSecret)
+	if err != nil {
+		return err
+	}
 
 	// Устанавливаем в куки
 	http.SetCookie(w, &http.Cookie{
@@ -30,28 +115,73 @@ func initHandler(w http.ResponseWriter, r *http.Request) {
 		Secure:   true,
 		SameSite: http.SameSiteStrictMode,
 		Path:     "/",
+		Expires:  now.Add(tokenTTL),
 	})
+	return nil
+}
 
-	w.WriteHeader(http.StatusOK)
+// parseToken verifies the signature and expiry of a token.
+func (s *Server) parseToken(value string) (*jwt.Token, error) {
+	return jwt.Parse(value, func(token *jwt.Token) (interface{}, error) {
+		// Only accept HMAC-signed tokens to rule out alg=none and key confusion.
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.cfg.JWTSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
 }
 
-func authMiddleware(next http.Handler) http.Handler {
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("auth_token")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		// Browsers never send cookies with preflight requests.
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		token, err := jwt.Parse(cookie.Value, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
+		claims, ok := s.authenticate(w, r)
+		if !ok {
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), claimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// authenticate validates the auth cookie and returns its claims. A jti is
+// required so that every accepted token can be logged out, except on legacy
+// tokens (see legacyToken), which stay valid until they expire. On
+// failure it writes a 401 response and returns false.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (jwt.MapClaims, bool) {
+	cookie, err := r.Cookie("auth_token")
+	if err != nil {
+		s.errorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Unauthorized")
+		return nil, false
+	}
+
+	token, err := s.parseToken(cookie.Value)
+	if err != nil || !token.Valid {
+		s.errorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid token")
+		return nil, false
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		s.errorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Invalid token")
+		return nil, false
+	}
+
+	jti, _ := claims["jti"].(string)
+	if (jti == "" && !s.legacyToken(claims)) || (jti != "" && s.revocations.Revoked(jti)) {
+		s.errorResponse(w, http.StatusUnauthorized, ErrCodeUnauthorized, "Token revoked")
+		return nil, false
+	}
+	return claims, true
+}
+
+// claimsFromContext returns the JWT claims stored by authMiddleware.
+func claimsFromContext(r *http.Request) (jwt.MapClaims, bool) {
+	claims, ok := r.Context().Value(claimsKey).(jwt.MapClaims)
+	return claims, ok
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// newAuthServer returns a server with authentication enabled.
+func newAuthServer(t *testing.T) *Server {
+	t.Helper()
+	return newTestServer(t, answering("hi"), map[string]string{
+		"AUTH_ENABLED": "true",
+		"JWT_SECRET":   testJWTSecret,
+	})
+}
+
+// signToken signs claims with testJWTSecret using method.
+func signToken(t *testing.T, method jwt.SigningMethod, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString([]byte(testJWTSecret))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+// validClaims returns the claims of a freshly issued token.
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": uuid.NewString(),
+		"jti": uuid.NewString(),
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+// withToken returns a request carrying token as the auth cookie.
+func withToken(method, path, token string) *http.Request {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.AddCookie(&http.Cookie{Name: "auth_token", Value: token})
+	}
+	return r
+}
+
+// issuedToken returns the auth cookie set on rec.
+func issuedToken(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "auth_token" && c.Value != "" {
+			return c.Value
+		}
+	}
+	t.Fatal("no auth_token cookie was issued")
+	return ""
+}
+
+// authStatus runs token through authMiddleware and returns the status.
+func authStatus(s *Server, token string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rec, withToken(http.MethodGet, "/api/chat", token))
+	return rec
+}
+
+func TestAuthenticateJTI(t *testing.T) {
+	s := newAuthServer(t)
+	cutoff := time.Now().Add(-time.Hour).Truncate(time.Second)
+	s.cfg.JTIRequiredSince = cutoff
+
+	withoutJTI := func(iat time.Time) jwt.MapClaims {
+		claims := validClaims()
+		delete(claims, "jti")
+		claims["iat"] = iat.Unix()
+		return claims
+	}
+	legacy := validClaims()
+	delete(legacy, "jti")
+	delete(legacy, "iat")
+
+	tests := []struct {
+		name       string
+		claims     jwt.MapClaims
+		wantStatus int
+	}{
+		{"with jti", validClaims(), http.StatusOK},
+		{"legacy token without jti or iat", legacy, http.StatusOK},
+		{"no jti, issued just before the cutoff", withoutJTI(cutoff.Add(-time.Second)), http.StatusOK},
+		{"no jti, issued at the cutoff", withoutJTI(cutoff), http.StatusUnauthorized},
+		{"no jti, issued just after the cutoff", withoutJTI(cutoff.Add(time.Second)), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := authStatus(s, signToken(t, jwt.SigningMethodHS256, tt.claims))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestJTIRequiredSinceConfig(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "false")
+	before := time.Now()
+	cfg, err := loadServerConfig()
+	if err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+	if cfg.JTIRequiredSince.Before(before) || cfg.JTIRequiredSince.After(time.Now()) {
+		t.Errorf("default JTIRequiredSince = %s, want the process start", cfg.JTIRequiredSince)
+	}
+
+	t.Setenv("JTI_REQUIRED_SINCE", "2026-11-01T08:00:00Z")
+	if cfg, err = loadServerConfig(); err != nil {
+		t.Fatalf("loadServerConfig: %v", err)
+	}
+	if want := time.Date(2026, 11, 1, 8, 0, 0, 0, time.UTC); !cfg.JTIRequiredSince.Equal(want) {
+		t.Errorf("JTIRequiredSince = %s, want %s", cfg.JTIRequiredSince, want)
+	}
+
+	t.Setenv("JTI_REQUIRED_SINCE", "next tuesday")
+	if _, err := loadServerConfig(); err == nil || !strings.Contains(err.Error(), "JTI_REQUIRED_SINCE") {
+		t.Errorf("loadServerConfig error = %v, want JTI_REQUIRED_SINCE rejected", err)
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	s := newAuthServer(t)
+
+	rec := httptest.NewRecorder()
+	s.initHandler(rec, httptest.NewRequest(http.MethodGet, "/api/init", nil))
+	token := issuedToken(t, rec)
+	if rec := authStatus(s, token); rec.Code != http.StatusOK {
+		t.Fatalf("fresh token status = %d, want 200", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.logoutHandler(rec, withToken(http.MethodPost, "/api/logout", token))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("logout status = %d, want 204", rec.Code)
+	}
+
+	rec = authStatus(s, token)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked token status = %d, want 401", rec.Code)
+	}
+	var body ErrorResponse
+	decodeBody(t, rec, &body)
+	if body.Error.Code != ErrCodeUnauthorized || body.Error.Message != "Token revoked" {
+		t.Errorf("error = %+v, want unauthorized/Token revoked", body.Error)
+	}
+}
+
+func TestRefreshRevokesOldToken(t *testing.T) {
+	s := newAuthServer(t)
+	old := signToken(t, jwt.SigningMethodHS256, validClaims())
+
+	rec := httptest.NewRecorder()
+	s.refreshHandler(rec, withToken(http.MethodPost, "/api/refresh", old))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want 200", rec.Code)
+	}
+	fresh := issuedToken(t, rec)
+
+	if rec := authStatus(s, old); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old token status = %d, want 401", rec.Code)
+	}
+	if rec := authStatus(s, fresh); rec.Code != http.StatusOK {
+		t.Errorf("refreshed token status = %d, want 200", rec.Code)
+	}
+}
+
+func TestParseTokenRejectsBadTokens(t *testing.T) {
+	s := newAuthServer(t)
+
+	withoutExp := validClaims()
+	delete(withoutExp, "exp")
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256, err := jwt.NewWithClaims(jwt.SigningMethodRS256, validClaims()).SignedString(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongSecret, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("another-secret-another-secret-xx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"alg none", none},
+		{"RS256", rs256},
+		{"HS512", signToken(t, jwt.SigningMethodHS512, validClaims())},
+		{"wrong secret", wrongSecret},
+		{"missing exp", signToken(t, jwt.SigningMethodHS256, withoutExp)},
+		{"expired", signToken(t, jwt.SigningMethodHS256, expired)},
+		{"garbage", "not-a-jwt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := s.parseToken(tt.token); err == nil {
+				t.Error("parseToken accepted the token")
+			}
+			if rec := authStatus(s, tt.token); rec.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want 401", rec.Code)
+			}
+		})
+	}
+
+	if _, err := s.parseToken(signToken(t, jwt.SigningMethodHS256, validClaims())); err != nil {
+		t.Errorf("parseToken rejected a valid HS256 token: %v", err)
+	}
+}
+
+func TestChatRouteRequiresAuth(t *testing.T) {
+	router := newAuthServer(t).routes()
+	chat := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"question":"hello"}`))
+		r.Header.Set("Content-Type", "application/json")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := chat(nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status without cookie = %d, want 401", rec.Code)
+	}
+	var body ErrorResponse
+	decodeBody(t, rec, &body)
+	if body.Error.Code != ErrCodeUnauthorized {
+		t.Errorf("error code = %q, want %q", body.Error.Code, ErrCodeUnauthorized)
+	}
+
+	initRec := httptest.NewRecorder()
+	router.ServeHTTP(initRec, httptest.NewRequest(http.MethodGet, "/api/init", nil))
+	if rec := chat(&http.Cookie{Name: "auth_token", Value: issuedToken(t, initRec)}); rec.Code != http.StatusOK {
+		t.Errorf("status with cookie from /api/init = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestChatRouteWithoutAuth(t *testing.T) {
+	router := newTestServer(t, answering("hi"), nil).routes()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"question":"hello"}`))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200 with AUTH_ENABLED=false", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/init", nil))
+	if rec.Code == http.StatusOK {
+		t.Error("/api/init is served with authentication disabled")
+	}
+}
+
+func TestAuthMiddlewareStoresClaims(t *testing.T) {
+	s := newAuthServer(t)
+	claims := validClaims()
+	claims["app"] = "tshawytscha-ai"
+
+	var got jwt.MapClaims
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		if got, ok = claimsFromContext(r); !ok {
+			t.Error("no claims in the request context")
+		}
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), withToken(http.MethodGet, "/api/chat", signToken(t, jwt.SigningMethodHS256, claims)))
+
+	if got["app"] != "tshawytscha-ai" || got["sub"] != claims["sub"] {
+		t.Errorf("claims = %v, want app and sub of the token", got)
+	}
+	if _, ok := claimsFromContext(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Error("claimsFromContext found claims on an unauthenticated request")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxBatchSize caps the number of questions in one batch request.
+const maxBatchSize = 10
+
+// BatchRequest asks several independent questions at once.
+type BatchRequest struct {
+	Questions []string `json:"questions"`
+}
+
+// BatchItem is the outcome for one question: either an answer or an error.
+type BatchItem struct {
+	Answer           string       `json:"answer,omitempty"`
+	Usage            *Usage       `json:"usage,omitempty"`
+	EstimatedCostUSD float64      `json:"estimated_cost_usd,omitempty"`
+	OffTopic         bool         `json:"off_topic,omitempty"`
+	Error            *ErrorDetail `json:"error,omitempty"`
+}
+
+// BatchResponse holds one item per question, in request order.
+type BatchResponse struct {
+	Answers []BatchItem `json:"answers"`
+}
+
+// batchHandler answers every question of a batch concurrently. Upstream
+// concurrency is still bounded by MAX_CONCURRENT_OPENAI. A failing question
+// only fails its own item.
+func (s *Server) batchHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+
+	if handlePreflight(w, r, "POST, OPTIONS") {
+		return
+	}
+	if !s.requireClient(w, r) {
+		return
+	}
+	if !s.hasJSONBody(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	var req BatchRequest
+	if err := decoder.Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.errorResponse(w, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+			return
+		}
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, "Invalid request payload")
+		return
+	}
+	if len(req.Questions) == 0 {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The questions field is required")
+		return
+	}
+	if len(req.Questions) > maxBatchSize {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("A batch must not contain more than %d questions", maxBatchSize))
+		return
+	}
+
+	// The rate limiter already charged this request once; every further
+	// question is another OpenAI call and costs a token of its own.
+	if extra := len(req.Questions) - 1; extra > 0 {
+		if err := s.takeTokens(r, extra); err != nil {
+			if err.retryAfter > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(err.retryAfter))
+			}
+			s.errorResponse(w, http.StatusTooManyRequests, ErrCodeRateLimited, err.msg)
+			return
+		}
+	}
+
+	log.WithField("questions", len(req.Questions)).Debug("answering batch")
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+	defer cancel()
+
+	resp := BatchResponse{Answers: make([]BatchItem, len(req.Questions))}
+	var wg sync.WaitGroup
+	for i, question := range req.Questions {
+		wg.Add(1)
+		go func(i int, question string) {
+			defer wg.Done()
+			resp.Answers[i] = s.answerBatchItem(ctx, log.WithField("batch_index", i), question, s.endUserID(r, ""))
+		}(i, question)
+	}
+	wg.Wait()
+
+	if clientGone(r) {
+		log.Info("client disconnected before the batch was answered, dropping it")
+		return
+	}
+	s.writeJSON(w, http.StatusOK, resp)
+}
+
+// answerBatchItem answers a single batch question.
+func (s *Server) answerBatchItem(ctx context.Context, log *logrus.Entry, question, endUser string) BatchItem {
+	fail := func(code ErrorCode, msg string) BatchItem {
+		return BatchItem{Error: &ErrorDetail{Code: code, Message: msg}}
+	}
+
+	if question == "" {
+		return fail(ErrCodeInvalidRequest, "The question must not be empty")
+	}
+	if utf8.RuneCountInString(question) > s.cfg.MaxQuestionLength {
+		return fail(ErrCodePayloadTooLarge, fmt.Sprintf("The question must not exceed %d characters", s.cfg.MaxQuestionLength))
+	}
+
+	if question = s.sanitize(log, question); question == "" {
+		return fail(ErrCodeInvalidRequest, "The question is empty after removing prompt injection markers")
+	}
+
+	if s.cfg.ModerationEnabled {
+		flagged, err := s.moderate(ctx, question)
+		if err != nil {
+			logUpstreamError(log, err, "error calling OpenAI moderation API")
+			return fail(ErrCodeUpstreamError, "Failed to moderate the question")
+		}
+		if flagged {
+			log.Warn("question rejected by moderation")
+			return fail(ErrCodeContentRejected, "The question was rejected because it violates the content policy")
+		}
+	}
+
+	allowed, err := s.onTopic(ctx, question)
+	if err != nil {
+		logUpstreamError(log, err, "error classifying the question topic")
+		return fail(ErrCodeUpstreamError, "Failed to check the question topic")
+	}
+	if !allowed {
+		return BatchItem{Answer: s.cfg.TopicPolicy.Refusal, OffTopic: true}
+	}
+
+	chatReq := s.buildChatRequest(ChatRequest{Question: question, endUser: endUser})
+	if estimateTokens(chatReq.Messages) > s.promptBudget(chatReq) {
+		return fail(ErrCodeContextTooLong, "The question is too long for the model's context window")
+	}
+
+	completion, err := s.createChatCompletion(ctx, chatReq)
+	switch {
+	case err == nil:
+	case isBreakerOpen(err):
+		return fail(ErrCodeServiceUnavailable, "OpenAI is temporarily unavailable, please retry later")
+	case errors.Is(err, errUpstreamBusy):
+		return fail(ErrCodeServiceUnavailable, "The service is busy, please retry shortly")
+	case isContextLengthExceeded(err):
+		return fail(ErrCodeContextTooLong, contextTooLongMessage)
+	case errors.Is(err, context.DeadlineExceeded):
+		log.WithError(err).Error("OpenAI API call timed out")
+		return fail(ErrCodeUpstreamTimeout, "Timed out waiting for response from OpenAI")
+	case errors.Is(err, errEmptyAnswer):
+		return fail(ErrCodeUpstreamError, "OpenAI returned an empty answer, please retry")
+	default:
+		logUpstreamError(log, err, "error calling OpenAI API")
+		return fail(ErrCodeUpstreamError, "Failed to fetch response from OpenAI")
+	}
+	if len(completion.Choices) == 0 {
+		return fail(ErrCodeUpstreamError, "No response from OpenAI")
+	}
+
+	usage := Usage{
+		PromptTokens:     completion.Usage.PromptTokens,
+		CompletionTokens: completion.Usage.CompletionTokens,
+		TotalTokens:      completion.Usage.TotalTokens,
+	}
+	return BatchItem{
+		Answer:           s.processAnswer(chatReq, completion.Choices[0].Message.Content),
+		Usage:            &usage,
+		EstimatedCostUSD: s.recordCost(completion.Model, usage),
+	}
+}
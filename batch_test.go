@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// batchRequester posts batches through the rate limiter.
+func batchRequester(s *Server) func(questions ...string) *httptest.ResponseRecorder {
+	handler := s.rateLimitMiddleware(http.HandlerFunc(s.batchHandler))
+	return func(questions ...string) *httptest.ResponseRecorder {
+		body := `{"questions":["` + strings.Join(questions, `","`) + `"]}`
+		r := httptest.NewRequest(http.MethodPost, "/api/chat/batch", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+}
+
+func TestBatchChargesOneTokenPerQuestion(t *testing.T) {
+	client := answering("not a fish")
+	batch := batchRequester(newTestServer(t, client, map[string]string{
+		"RATE_LIMIT_RPS":   "0.001",
+		"RATE_LIMIT_BURST": "4",
+	}))
+
+	rec := batch("one?", "two?", "three?")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("batch status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var resp BatchResponse
+	decodeBody(t, rec, &resp)
+	if len(resp.Answers) != 3 {
+		t.Fatalf("got %d answers, want 3", len(resp.Answers))
+	}
+
+	// One token is left: the middleware takes it, the second question finds
+	// the bucket empty.
+	rec = batch("four?", "five?")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status with one token left = %d, want 429", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	var errBody ErrorResponse
+	decodeBody(t, rec, &errBody)
+	if errBody.Error.Code != ErrCodeRateLimited {
+		t.Errorf("error code = %q, want %q", errBody.Error.Code, ErrCodeRateLimited)
+	}
+	if got := len(client.Requests()); got != 3 {
+		t.Errorf("OpenAI was called %d times, want 3", got)
+	}
+}
+
+func TestBatchLargerThanBurst(t *testing.T) {
+	client := answering("not a fish")
+	batch := batchRequester(newTestServer(t, client, map[string]string{
+		"RATE_LIMIT_RPS":   "0.001",
+		"RATE_LIMIT_BURST": "2",
+	}))
+
+	rec := batch("one?", "two?", "three?", "four?")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q, want none for a batch that can never fit", got)
+	}
+	if got := len(client.Requests()); got != 0 {
+		t.Errorf("a rejected batch reached OpenAI %d times", got)
+	}
+
+	// The rejected batch only cost its middleware token.
+	if rec = batch("one?"); rec.Code != http.StatusOK {
+		t.Errorf("follow-up status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+)
+
+// circuitBreakerState mirrors the breaker state: 0 closed, 1 half-open, 2 open.
+var circuitBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "tschabot_openai_circuit_breaker_state",
+	Help: "State of the OpenAI circuit breaker (0=closed, 1=half-open, 2=open).",
+})
+
+// newCircuitBreaker creates a breaker that opens after failures consecutive
+// upstream failures and lets a single probe through after openTimeout.
+func newCircuitBreaker(failures int, openTimeout time.Duration, logger *logrus.Logger) *gobreaker.CircuitBreaker {
+	return gobreaker.NewCircuitBreaker(gobreaker.Settings{
+		Name:    "openai",
+		Timeout: openTimeout,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			return counts.ConsecutiveFailures >= uint32(failures)
+		},
+		IsSuccessful: func(err error) bool {
+			return err == nil || !isUpstreamFailure(err)
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			logger.Warnf("circuit breaker %s changed from %s to %s", name, from, to)
+			circuitBreakerState.Set(float64(to))
+		},
+	})
+}
+
+// isUpstreamFailure reports whether err indicates OpenAI itself is unhealthy,
+// as opposed to a problem with our request or a caller that went away. Rate
+// limits (429) are not failures: OpenAI is up, we are just over quota, and
+// the retry logic already backs off on them.
+func isUpstreamFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	status := upstreamStatus(err)
+	return status == 0 || status >= http.StatusInternalServerError
+}
+
+// isBreakerOpen reports whether err was produced by a fast-failing breaker.
+func isBreakerOpen(err error) bool {
+	return errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests)
+}
+
+// guardUpstream runs fn through the circuit breaker when one is configured.
+func (s *Server) guardUpstream(fn func() error) error {
+	if s.breaker == nil {
+		return fn()
+	}
+	_, err := s.breaker.Execute(func() (interface{}, error) {
+		return nil, fn()
+	})
+	return err
+}
+
+// callChatCompletion performs a single chat completion behind the breaker.
+func (s *Server) callChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var resp openai.ChatCompletionResponse
+	release, err := s.acquireUpstream(ctx)
+	if err != nil {
+		return resp, err
+	}
+	defer release()
+
+	ctx, span := startUpstreamSpan(ctx, "openai.chat_completion", req.Model)
+	err = s.guardUpstream(func() error {
+		var err error
+		resp, err = s.clientFor(ctx).CreateChatCompletion(ctx, req)
+		return err
+	})
+	if err != nil {
+		endUpstreamSpan(span, nil, err)
+	} else {
+		endUpstreamSpan(span, &resp.Usage, nil)
+	}
+	return resp, err
+}
+
+// breakerState reports the breaker state for health checks.
+func (s *Server) breakerState() string {
+	if s.breaker == nil {
+		return "disabled"
+	}
+	return s.breaker.State().String()
+}
+
+// upstreamUnavailable answers with 503 while the breaker is open.
+func (s *Server) upstreamUnavailable(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(s.cfg.BreakerOpenTimeout.Seconds())))
+	s.errorResponse(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "OpenAI is temporarily unavailable, please retry later")
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestIsUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{serverError, true},
+		{&openai.APIError{HTTPStatusCode: http.StatusBadGateway}, true},
+		{errors.New("connection reset"), true},
+		{upstreamRateLimited, false},
+		{fmt.Errorf("wrapped: %w", upstreamRateLimited), false},
+		{&openai.APIError{HTTPStatusCode: http.StatusBadRequest}, false},
+		{context.Canceled, false},
+	}
+	for _, tt := range tests {
+		if got := isUpstreamFailure(tt.err); got != tt.want {
+			t.Errorf("isUpstreamFailure(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestBreakerIgnoresRateLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantOpen bool
+	}{
+		{"rate limited", upstreamRateLimited, false},
+		{"server errors", serverError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, failingWith(tt.err, tt.err, tt.err), map[string]string{"CIRCUIT_BREAKER_FAILURES": "3"})
+			for i := 0; i < 3; i++ {
+				req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+				if _, err := s.completeWithRetry(context.Background(), &req); err == nil {
+					t.Fatalf("call %d succeeded, want %v", i+1, tt.err)
+				}
+			}
+
+			want := "closed"
+			if tt.wantOpen {
+				want = "open"
+			}
+			if got := s.breakerState(); got != want {
+				t.Errorf("breakerState() = %q after 3 failures, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// answerCache is a size-bounded LRU of chat responses whose entries expire
+// after a fixed TTL.
+type answerCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key     string
+	resp    ChatResponse
+	expires time.Time
+}
+
+// newAnswerCache creates a cache holding at most size entries for ttl each.
+func newAnswerCache(size int, ttl time.Duration) *answerCache {
+	return &answerCache{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// cacheKey derives the cache key for a question asked by a tenant with the
+// given system prompt and model. Tenants never share cached answers.
+func cacheKey(tenant, systemPrompt, model, question string) string {
+	h := sha256.New()
+	for _, part := range []string{tenant, systemPrompt, model, question} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Get returns the cached response for key if it is present and fresh.
+func (c *answerCache) Get(key string) (ChatResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		return ChatResponse{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.items, key)
+		return ChatResponse{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.resp, true
+}
+
+// Add stores resp under key, evicting the least recently used entry when full.
+func (c *answerCache) Add(key string, resp ChatResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.resp, entry.expires = resp, expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, resp: resp, expires: expires})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// cacheable reports whether the answer to req depends only on the question,
+// model and system prompt, so it can be shared between callers.
+func cacheable(req ChatRequest) bool {
+	return len(req.History) == 0 && len(req.Messages) == 0 && req.SessionID == "" &&
+		req.Temperature == nil && req.MaxTokens == nil && req.Language == "" &&
+		req.PresencePenalty == nil && req.FrequencyPenalty == nil && req.N == nil &&
+		len(req.Stop) == 0 && req.Seed == nil && req.ResponseFormat == "" &&
+		req.ImageURL == "" && req.Image == "" &&
+		req.MaxAnswerChars == nil && req.ContinuationToken == "" &&
+		req.ReasoningEffort == ""
+}
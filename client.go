@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ChatStream is an open streaming completion.
+type ChatStream interface {
+	Recv() (openai.ChatCompletionStreamResponse, error)
+	Close() error
+}
+
+// ChatClient is the subset of the OpenAI API the server depends on. It lets
+// tests substitute a fake for the real client.
+type ChatClient interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error)
+	Moderations(ctx context.Context, req openai.ModerationRequest) (openai.ModerationResponse, error)
+}
+
+// openaiClient adapts *openai.Client to ChatClient.
+type openaiClient struct {
+	*openai.Client
+}
+
+// openAIConfig builds the go-openai client configuration for apiKey.
+func openAIConfig(apiKey string, cfg ServerConfig) openai.ClientConfig {
+	if cfg.Azure {
+		return azureConfig(apiKey, cfg)
+	}
+
+	config := openai.DefaultConfig(apiKey)
+	if cfg.BaseURL != "" {
+		config.BaseURL = cfg.BaseURL
+	}
+	config.OrgID = cfg.OrgID
+	httpClient := newHTTPClient(cfg)
+	// go-openai has no project setting, so the header is added by the transport.
+	if cfg.ProjectID != "" {
+		httpClient.Transport = &headerTransport{
+			base:   httpClient.Transport,
+			header: http.Header{"OpenAI-Project": {cfg.ProjectID}},
+		}
+	}
+	config.HTTPClient = httpClient
+	return config
+}
+
+// newHTTPClient returns the HTTP client used to reach OpenAI. Unlike
+// http.DefaultClient it bounds every phase of a connection, and it keeps
+// more idle connections to the single upstream host.
+func newHTTPClient(cfg ServerConfig) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &http.Client{Timeout: cfg.OpenAIHTTPTimeout, Transport: retryAfterTransport{base: transport}}
+}
+
+// azureConfig builds the client configuration for Azure OpenAI, which
+// addresses deployments instead of models.
+func azureConfig(apiKey string, cfg ServerConfig) openai.ClientConfig {
+	config := openai.DefaultAzureConfig(apiKey, cfg.BaseURL)
+	config.APIVersion = cfg.AzureAPIVersion
+	config.HTTPClient = newHTTPClient(cfg)
+	defaultMapper := config.AzureModelMapperFunc
+	config.AzureModelMapperFunc = func(model string) string {
+		if deployment, ok := cfg.AzureDeployments[model]; ok {
+			return deployment
+		}
+		return defaultMapper(model)
+	}
+	return config
+}
+
+// noClientRetryAfter is the Retry-After hint, in seconds, sent while no OpenAI
+// client is configured. Fixing the key takes an operator, so it is generous.
+const noClientRetryAfter = 30
+
+// requireClient answers 503 when no usable OpenAI client is configured for the
+// request's tenant, e.g. the key file was still empty at startup. It returns
+// false in that case.
+func (s *Server) requireClient(w http.ResponseWriter, r *http.Request) bool {
+	if s.clientFor(r.Context()) != nil {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(noClientRetryAfter))
+	s.errorResponse(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "The OpenAI API key is not configured, please retry later")
+	return false
+}
+
+// headerTransport adds fixed headers to every outgoing request.
+type headerTransport struct {
+	base   http.RoundTripper
+	header http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range t.header {
+		req.Header[k] = v
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newOpenAIClient wraps a go-openai client.
+func newOpenAIClient(client *openai.Client) ChatClient {
+	return openaiClient{Client: client}
+}
+
+func (c openaiClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	stream, err := c.Client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Ping checks that OpenAI is reachable and accepts the API key.
+func (c openaiClient) Ping(ctx context.Context) error {
+	_, err := c.Client.ListModels(ctx)
+	return err
+}
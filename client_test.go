@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestOpenAIConfigSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		env        map[string]string
+		model      string
+		wantPath   string
+		wantQuery  string
+		wantHeader map[string]string
+	}{
+		{
+			name:      "openai",
+			env:       map[string]string{"OPENAI_ORG_ID": "org-1", "OPENAI_PROJECT_ID": "proj-1"},
+			model:     "gpt-4o",
+			wantPath:  "/chat/completions",
+			wantQuery: "",
+			wantHeader: map[string]string{
+				"Authorization":       "Bearer sk-test",
+				"OpenAI-Organization": "org-1",
+				"OpenAI-Project":      "proj-1",
+				"Api-Key":             "",
+			},
+		},
+		{
+			name:      "azure with a mapped deployment",
+			env:       map[string]string{"AZURE_OPENAI": "true", "AZURE_DEPLOYMENTS": "gpt-4o=prod-4o, gpt-4o-mini=cheap"},
+			model:     "gpt-4o",
+			wantPath:  "/openai/deployments/prod-4o/chat/completions",
+			wantQuery: "api-version=" + defaultAzureAPIVersion,
+			wantHeader: map[string]string{
+				"Api-Key":       "sk-test",
+				"Authorization": "",
+			},
+		},
+		{
+			name:      "azure with an unmapped model",
+			env:       map[string]string{"AZURE_OPENAI": "true", "AZURE_API_VERSION": "2024-10-21"},
+			model:     "gpt-3.5-turbo",
+			wantPath:  "/openai/deployments/gpt-35-turbo/chat/completions",
+			wantQuery: "api-version=2024-10-21",
+			wantHeader: map[string]string{
+				"Api-Key": "sk-test",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"hi"}}]}`)
+			}))
+			defer upstream.Close()
+
+			t.Setenv("AUTH_ENABLED", "false")
+			t.Setenv("OPENAI_BASE_URL", upstream.URL)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadServerConfig()
+			if err != nil {
+				t.Fatalf("loadServerConfig: %v", err)
+			}
+
+			client := openai.NewClientWithConfig(openAIConfig("sk-test", cfg))
+			_, err = client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
+				Model:    tt.model,
+				Messages: []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hello"}},
+			})
+			if err != nil {
+				t.Fatalf("CreateChatCompletion: %v", err)
+			}
+			if got.URL.Path != tt.wantPath {
+				t.Errorf("path = %s, want %s", got.URL.Path, tt.wantPath)
+			}
+			if got.URL.RawQuery != tt.wantQuery {
+				t.Errorf("query = %q, want %q", got.URL.RawQuery, tt.wantQuery)
+			}
+			for name, want := range tt.wantHeader {
+				if v := got.Header.Get(name); v != want {
+					t.Errorf("%s = %q, want %q", name, v, want)
+				}
+			}
+		})
+	}
+}
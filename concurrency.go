@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errUpstreamBusy is returned when no OpenAI slot frees up in time.
+var errUpstreamBusy = errors.New("too many concurrent OpenAI requests")
+
+// upstreamInFlight counts OpenAI calls currently in progress.
+var upstreamInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "tschabot_openai_inflight_requests",
+	Help: "Number of OpenAI requests currently in flight.",
+})
+
+// acquireUpstream reserves a slot for an OpenAI call, waiting up to the queue
+// timeout when MAX_CONCURRENT_OPENAI is reached. The returned release func
+// must be called once the call is done.
+func (s *Server) acquireUpstream(ctx context.Context) (func(), error) {
+	if s.upstreamSlots != nil {
+		select {
+		case s.upstreamSlots <- struct{}{}:
+		default:
+			timer := time.NewTimer(s.cfg.OpenAIQueueTimeout)
+			defer timer.Stop()
+			select {
+			case s.upstreamSlots <- struct{}{}:
+			case <-timer.C:
+				return nil, errUpstreamBusy
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	upstreamInFlight.Inc()
+	return func() {
+		upstreamInFlight.Dec()
+		if s.upstreamSlots != nil {
+			<-s.upstreamSlots
+		}
+	}, nil
+}
+
+// upstreamBusy answers with 503 when every OpenAI slot is taken.
+func (s *Server) upstreamBusy(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	s.errorResponse(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "The service is busy, please retry shortly")
+}
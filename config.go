@@ -0,0 +1,799 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultModel is used when OPENAI_MODEL is not set.
+	defaultModel = "gpt-4o"
+	// defaultRequestTimeout bounds a single OpenAI call when REQUEST_TIMEOUT is not set.
+	defaultRequestTimeout = 30 * time.Second
+	// defaultOpenAIHTTPTimeout caps a whole HTTP exchange with OpenAI, streamed
+	// body included, when OPENAI_HTTP_TIMEOUT is not set.
+	defaultOpenAIHTTPTimeout = 5 * time.Minute
+	// shutdownTimeout is the grace period for draining in-flight requests.
+	shutdownTimeout = 15 * time.Second
+	// defaultRateLimitRPS and defaultRateLimitBurst apply per client IP.
+	defaultRateLimitRPS   = 1.0
+	defaultRateLimitBurst = 5
+	// defaultUserRateLimitRPS and defaultUserRateLimitBurst apply per authenticated user.
+	defaultUserRateLimitRPS   = 1.0
+	defaultUserRateLimitBurst = 5
+	// defaultMaxQuestionLength is the longest question, in characters, we forward.
+	defaultMaxQuestionLength = 4000
+	// defaultMaxBodyBytes caps the size of a request body.
+	defaultMaxBodyBytes = 1 << 20
+	// defaultMaxImageBytes caps an inline image; base64 of this size still
+	// fits the default body limit.
+	defaultMaxImageBytes = 512 << 10
+	// defaultSessionTTL is how long an idle stored conversation is kept.
+	defaultSessionTTL = 24 * time.Hour
+	// defaultSessionCleanupInterval is how often idle in-memory sessions are evicted.
+	defaultSessionCleanupInterval = 5 * time.Minute
+	// defaultMaxRetries is how often a rate-limited or failed OpenAI call is repeated.
+	defaultMaxRetries = 2
+	// defaultMaxRetryAfter caps how long a Retry-After from OpenAI is honored.
+	defaultMaxRetryAfter = 30 * time.Second
+	// defaultCacheSize and defaultCacheTTL bound the answer cache.
+	defaultCacheSize = 1000
+	defaultCacheTTL  = time.Hour
+	// defaultIdempotencySize and defaultIdempotencyTTL bound the replay cache
+	// for Idempotency-Key requests.
+	defaultIdempotencySize = 1000
+	defaultIdempotencyTTL  = 10 * time.Minute
+	// defaultMockLatency simulates upstream response time in mock mode.
+	defaultMockLatency = 800 * time.Millisecond
+	// defaultSlowRequestThreshold is the latency above which a request is logged as slow.
+	defaultSlowRequestThreshold = 10 * time.Second
+	// defaultGzipMinBytes is the smallest response body worth compressing.
+	defaultGzipMinBytes = 1024
+	// defaultBreakerFailures and defaultBreakerOpenTimeout tune the OpenAI circuit breaker.
+	defaultBreakerFailures    = 5
+	defaultBreakerOpenTimeout = 30 * time.Second
+	// defaultOpenAIQueueTimeout is how long a call waits for a free slot when
+	// MAX_CONCURRENT_OPENAI is reached.
+	defaultOpenAIQueueTimeout = 5 * time.Second
+	// minJWTSecretBytes is the shortest JWT_SECRET accepted; HS256 keys should
+	// be at least as long as the hash output.
+	minJWTSecretBytes = 32
+	// defaultAzureAPIVersion is used when AZURE_API_VERSION is not set.
+	defaultAzureAPIVersion = "2024-06-01"
+)
+
+// allowedModels is the whitelist of models clients may request explicitly.
+var allowedModels = map[string]bool{
+	"gpt-4o":        true,
+	"gpt-4o-mini":   true,
+	"gpt-4-turbo":   true,
+	"gpt-3.5-turbo": true,
+	"o3-mini":       true,
+}
+
+// ServerConfig holds the tunable settings of the chat server.
+type ServerConfig struct {
+	// Model is the OpenAI model used when a request does not pick one.
+	Model string
+	// RequestTimeout bounds how long a single OpenAI call may take.
+	RequestTimeout time.Duration
+	// OpenAIHTTPTimeout is the http.Client timeout for OpenAI calls. It backs up
+	// the per-request context deadline, e.g. against a stalled TLS handshake.
+	OpenAIHTTPTimeout time.Duration
+	// RateLimitRPS and RateLimitBurst configure the per-IP token bucket.
+	// A non-positive RateLimitRPS disables rate limiting.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// UserRateLimitRPS and UserRateLimitBurst configure the bucket for callers
+	// with a JWT subject. A non-positive UserRateLimitRPS limits them by IP.
+	UserRateLimitRPS   float64
+	UserRateLimitBurst int
+	// Default generation parameters, applied when a request omits them. Zero
+	// values defer to the OpenAI defaults.
+	Temperature      float32
+	MaxTokens        int
+	PresencePenalty  float32
+	FrequencyPenalty float32
+	// MaxTokensCeiling caps max_tokens requested by clients; 0 means no cap.
+	MaxTokensCeiling int
+	// SystemPrompt defines the bot's persona; SystemPromptSource records
+	// where it was loaded from.
+	SystemPrompt       string
+	SystemPromptSource string
+	// BotName is the bot's name in exported transcripts.
+	BotName string
+	// SystemPromptOverrideFile, when set, persists prompts changed through the
+	// admin API and takes precedence over the other sources on startup.
+	SystemPromptOverrideFile string
+	// Prompts holds the named prompts from PROMPTS_DIR that clients select
+	// with prompt_name; nil when no directory is configured. It is reloaded
+	// every PromptsReloadInterval.
+	Prompts               *promptLibrary
+	PromptsReloadInterval time.Duration
+	// AdminToken protects the /admin endpoints; empty disables them.
+	AdminToken string
+	// FeedbackFile, when set, receives every rating as a JSON line.
+	FeedbackFile string
+	// ModerationEnabled screens questions through the moderation endpoint.
+	ModerationEnabled bool
+	// SanitizeInput strips role prefixes and chat-template tokens that are
+	// commonly used for prompt injection from questions.
+	SanitizeInput bool
+	// StripInvalidUTF8 drops invalid UTF-8 bytes from request bodies instead
+	// of rejecting the request.
+	StripInvalidUTF8 bool
+	// MaxQuestionLength limits the question in characters; MaxBodyBytes limits
+	// the raw request body.
+	MaxQuestionLength int
+	MaxBodyBytes      int64
+	// MaxImageBytes limits the decoded size of an inline image.
+	MaxImageBytes int64
+	// LogRedaction masks emails, phone and card numbers in log output.
+	LogRedaction bool
+	// ResponseProcessors transform non-streamed answers, in order.
+	ResponseProcessors []ResponseProcessor
+	// RedisURL selects the Redis conversation store; SessionTTL expires idle
+	// sessions in either store. SessionCleanupInterval is how often the
+	// in-memory store looks for idle sessions.
+	RedisURL               string
+	SessionTTL             time.Duration
+	SessionCleanupInterval time.Duration
+	// MaxTurnsPerSession caps the questions asked in one session; 0 means no
+	// limit. SessionTurnPolicy decides what happens at the cap: "reject"
+	// answers 409, "reset" forgets the oldest turns.
+	MaxTurnsPerSession int
+	SessionTurnPolicy  string
+	// Experiment, when set, serves an alternative system prompt to a share
+	// of sessions.
+	Experiment *PromptExperiment
+	// TopicPolicy, when set, refuses questions outside the allowed topics.
+	TopicPolicy *TopicPolicy
+	// SendEndUser passes a hashed caller identity to OpenAI as "user" for
+	// abuse tracking.
+	SendEndUser bool
+	// ToolsEnabled registers the built-in tools with the model.
+	ToolsEnabled bool
+	// MaxRetries bounds retries of failed OpenAI calls; FallbackModel is tried
+	// once when the primary model stays rate limited.
+	MaxRetries    int
+	FallbackModel string
+	// MaxRetryAfter caps the wait requested by a Retry-After header on 429.
+	MaxRetryAfter time.Duration
+	// RetryBudget caps retries across all requests per RetryBudgetWindow;
+	// once spent, failed calls are returned without retrying. 0 disables it.
+	RetryBudget       int
+	RetryBudgetWindow time.Duration
+	// CacheEnabled turns on the answer cache for standalone questions.
+	CacheEnabled bool
+	CacheSize    int
+	CacheTTL     time.Duration
+	// IdempotencyEnabled replays responses for repeated Idempotency-Key
+	// headers within IdempotencyTTL.
+	IdempotencyEnabled bool
+	IdempotencyTTL     time.Duration
+	// StreamIncludeUsage asks OpenAI for token usage on streamed answers.
+	StreamIncludeUsage bool
+	// MockMode answers with canned responses instead of calling OpenAI.
+	MockMode    bool
+	MockLatency time.Duration
+	// WarmupOnStart sends a throwaway completion before serving traffic.
+	WarmupOnStart bool
+	// AllowedOrigins are the browser origins allowed for CORS and WebSocket
+	// upgrades.
+	AllowedOrigins []string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For header is
+	// believed when identifying callers.
+	TrustedProxies trustedProxies
+	// SlowRequestThreshold marks requests that should be logged as slow.
+	SlowRequestThreshold time.Duration
+	// GzipEnabled compresses responses of at least GzipMinBytes for clients
+	// that accept gzip.
+	GzipEnabled  bool
+	GzipMinBytes int
+	// ReferrerPolicy is sent on every response ("" omits the header).
+	// HSTSMaxAge enables Strict-Transport-Security on HTTPS requests; it is
+	// off by default because it must only be set for hosts served over TLS.
+	ReferrerPolicy        string
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	// BreakerFailures is the number of consecutive upstream failures that open
+	// the circuit breaker (0 disables it); BreakerOpenTimeout is how long it
+	// stays open before a probe is allowed.
+	BreakerFailures    int
+	BreakerOpenTimeout time.Duration
+	// MaxConcurrentOpenAI bounds in-flight OpenAI calls (0 means unlimited);
+	// OpenAIQueueTimeout is how long a call may wait for a free slot.
+	MaxConcurrentOpenAI int
+	OpenAIQueueTimeout  time.Duration
+	// ContextTokenBudget caps the estimated prompt tokens sent upstream; older
+	// history is evicted to stay within it. 0 uses the model's context window.
+	ContextTokenBudget int
+	// AuthEnabled requires a valid JWT cookie on the API; it can be switched
+	// off for local development. JWTSecret signs and verifies those tokens.
+	AuthEnabled bool
+	JWTSecret   []byte
+	// JTIRequiredSince is when tokens without a jti stop being accepted:
+	// one whose iat is later is refused, since only tokens issued before
+	// revocation support lack a jti. Defaults to the process start.
+	JTIRequiredSince time.Time
+	// Tenants are customers served with their own OpenAI key and quota,
+	// selected per request; requests without a tenant use the default one.
+	Tenants []Tenant
+	// Prices maps models to token prices for cost estimates.
+	Prices map[string]ModelPrice
+	// OrgID and ProjectID attribute OpenAI usage to an organization and
+	// project for billing.
+	OrgID     string
+	ProjectID string
+	// BaseURL points the client at an OpenAI-compatible endpoint; empty uses
+	// the official API.
+	BaseURL string
+	// Azure switches to Azure OpenAI. It needs OPENAI_BASE_URL set to the
+	// resource endpoint (https://<resource>.openai.azure.com/) and
+	// OPENAI_API_KEY set to the resource key. AzureAPIVersion comes from
+	// AZURE_API_VERSION, and AzureDeployments maps model names to deployment
+	// names via AZURE_DEPLOYMENTS ("gpt-4o=my-gpt4o,gpt-4o-mini=mini").
+	// Unmapped models use the model name without dots as the deployment.
+	Azure            bool
+	AzureAPIVersion  string
+	AzureDeployments map[string]string
+}
+
+// configErrors collects every configuration problem found at startup so
+// they can be fixed in one go instead of one restart at a time.
+type configErrors []error
+
+func (e *configErrors) add(err error) {
+	if err != nil {
+		*e = append(*e, err)
+	}
+}
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%d configuration problem(s): %s", len(e), strings.Join(msgs, "; "))
+}
+
+func (e configErrors) Unwrap() []error {
+	return e
+}
+
+// loadServerConfig reads the server settings from the environment. It
+// validates all of them before failing, and the returned error lists every
+// problem found.
+func loadServerConfig() (ServerConfig, error) {
+	cfg := ServerConfig{
+		Model:         getEnv("OPENAI_MODEL", defaultModel),
+		FeedbackFile:  os.Getenv("FEEDBACK_FILE"),
+		RedisURL:      os.Getenv("REDIS_URL"),
+		FallbackModel: os.Getenv("OPENAI_FALLBACK_MODEL"),
+	}
+
+	var (
+		errs configErrors
+		err  error
+	)
+	cfg.RequestTimeout, err = getEnvDuration("REQUEST_TIMEOUT", defaultRequestTimeout)
+	errs.add(err)
+	cfg.OpenAIHTTPTimeout, err = getEnvDuration("OPENAI_HTTP_TIMEOUT", defaultOpenAIHTTPTimeout)
+	errs.add(err)
+	cfg.RateLimitRPS, err = getEnvFloat("RATE_LIMIT_RPS", defaultRateLimitRPS)
+	errs.add(err)
+	cfg.RateLimitBurst, err = getEnvInt("RATE_LIMIT_BURST", defaultRateLimitBurst)
+	errs.add(err)
+	cfg.UserRateLimitRPS, err = getEnvFloat("USER_RATE_LIMIT_RPS", defaultUserRateLimitRPS)
+	errs.add(err)
+	cfg.UserRateLimitBurst, err = getEnvInt("USER_RATE_LIMIT_BURST", defaultUserRateLimitBurst)
+	errs.add(err)
+
+	temperature, err := getEnvFloat("OPENAI_DEFAULT_TEMPERATURE", 0)
+	errs.add(err)
+	if temperature < minTemperature || temperature > maxTemperature {
+		errs.add(fmt.Errorf("OPENAI_DEFAULT_TEMPERATURE must be between %d and %d", minTemperature, maxTemperature))
+	}
+	cfg.Temperature = float32(temperature)
+
+	cfg.MaxTokens, err = getEnvInt("OPENAI_DEFAULT_MAX_TOKENS", 0)
+	errs.add(err)
+	if cfg.MaxTokens < 0 {
+		errs.add(fmt.Errorf("OPENAI_DEFAULT_MAX_TOKENS must not be negative"))
+	}
+	cfg.MaxTokensCeiling, err = getEnvInt("OPENAI_MAX_TOKENS_CEILING", 0)
+	errs.add(err)
+	if cfg.MaxTokensCeiling < 0 {
+		errs.add(fmt.Errorf("OPENAI_MAX_TOKENS_CEILING must not be negative"))
+	}
+	if cfg.MaxTokensCeiling > 0 {
+		// Without a default, requests omitting max_tokens would be uncapped.
+		if cfg.MaxTokens == 0 {
+			cfg.MaxTokens = cfg.MaxTokensCeiling
+		}
+		if cfg.MaxTokens > cfg.MaxTokensCeiling {
+			errs.add(fmt.Errorf("OPENAI_DEFAULT_MAX_TOKENS must not exceed OPENAI_MAX_TOKENS_CEILING"))
+		}
+	}
+
+	for _, p := range []struct {
+		key string
+		dst *float32
+	}{
+		{"OPENAI_DEFAULT_PRESENCE_PENALTY", &cfg.PresencePenalty},
+		{"OPENAI_DEFAULT_FREQUENCY_PENALTY", &cfg.FrequencyPenalty},
+	} {
+		v, err := getEnvFloat(p.key, 0)
+		errs.add(err)
+		if v < minPenalty || v > maxPenalty {
+			errs.add(fmt.Errorf("%s must be between %d.0 and %d.0", p.key, minPenalty, maxPenalty))
+		}
+		*p.dst = float32(v)
+	}
+
+	cfg.ModerationEnabled, err = getEnvBool("MODERATION_ENABLED", false)
+	errs.add(err)
+	cfg.LogRedaction, err = getEnvBool("LOG_REDACTION", true)
+	errs.add(err)
+	cfg.ResponseProcessors, err = loadResponseProcessors()
+	errs.add(err)
+	cfg.SanitizeInput, err = getEnvBool("SANITIZE_INPUT", true)
+	errs.add(err)
+	cfg.StripInvalidUTF8, err = getEnvBool("STRIP_INVALID_UTF8", false)
+	errs.add(err)
+
+	cfg.MaxQuestionLength, err = getEnvInt("MAX_QUESTION_LENGTH", defaultMaxQuestionLength)
+	errs.add(err)
+	if cfg.MaxQuestionLength <= 0 {
+		errs.add(fmt.Errorf("MAX_QUESTION_LENGTH must be positive"))
+	}
+	maxBodyBytes, err := getEnvInt("MAX_BODY_BYTES", defaultMaxBodyBytes)
+	errs.add(err)
+	if maxBodyBytes <= 0 {
+		errs.add(fmt.Errorf("MAX_BODY_BYTES must be positive"))
+	}
+	cfg.MaxBodyBytes = int64(maxBodyBytes)
+	maxImageBytes, err := getEnvInt("MAX_IMAGE_BYTES", defaultMaxImageBytes)
+	errs.add(err)
+	if maxImageBytes <= 0 {
+		errs.add(fmt.Errorf("MAX_IMAGE_BYTES must be positive"))
+	}
+	cfg.MaxImageBytes = int64(maxImageBytes)
+
+	cfg.MaxRetries, err = getEnvInt("OPENAI_MAX_RETRIES", defaultMaxRetries)
+	errs.add(err)
+	if cfg.MaxRetries < 0 {
+		errs.add(fmt.Errorf("OPENAI_MAX_RETRIES must not be negative"))
+	}
+	cfg.MaxRetryAfter, err = getEnvDuration("OPENAI_MAX_RETRY_AFTER", defaultMaxRetryAfter)
+	errs.add(err)
+	if cfg.MaxRetryAfter <= 0 {
+		errs.add(fmt.Errorf("OPENAI_MAX_RETRY_AFTER must be positive"))
+	}
+	cfg.RetryBudget, err = getEnvInt("OPENAI_RETRY_BUDGET", 0)
+	errs.add(err)
+	if cfg.RetryBudget < 0 {
+		errs.add(fmt.Errorf("OPENAI_RETRY_BUDGET must not be negative"))
+	}
+	cfg.RetryBudgetWindow, err = getEnvDuration("OPENAI_RETRY_BUDGET_WINDOW", defaultRetryBudgetWindow)
+	errs.add(err)
+	if cfg.RetryBudgetWindow <= 0 {
+		errs.add(fmt.Errorf("OPENAI_RETRY_BUDGET_WINDOW must be positive"))
+	}
+
+	cfg.SendEndUser, err = getEnvBool("OPENAI_SEND_USER", true)
+	errs.add(err)
+	cfg.ToolsEnabled, err = getEnvBool("TOOLS_ENABLED", false)
+	errs.add(err)
+
+	cfg.CacheEnabled, err = getEnvBool("CACHE_ENABLED", false)
+	errs.add(err)
+	cfg.CacheSize, err = getEnvInt("CACHE_SIZE", defaultCacheSize)
+	errs.add(err)
+	if cfg.CacheEnabled && cfg.CacheSize <= 0 {
+		errs.add(fmt.Errorf("CACHE_SIZE must be positive"))
+	}
+	cfg.CacheTTL, err = getEnvDuration("CACHE_TTL", defaultCacheTTL)
+	errs.add(err)
+
+	cfg.IdempotencyEnabled, err = getEnvBool("IDEMPOTENCY_ENABLED", true)
+	errs.add(err)
+	cfg.IdempotencyTTL, err = getEnvDuration("IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	errs.add(err)
+
+	cfg.StreamIncludeUsage, err = getEnvBool("STREAM_INCLUDE_USAGE", true)
+	errs.add(err)
+
+	cfg.MockMode, err = getEnvBool("MOCK_MODE", false)
+	errs.add(err)
+	cfg.MockLatency, err = getEnvDuration("MOCK_LATENCY", defaultMockLatency)
+	errs.add(err)
+
+	cfg.WarmupOnStart, err = getEnvBool("WARMUP_ON_START", false)
+	errs.add(err)
+
+	cfg.AllowedOrigins, err = parseAllowedOrigins(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	errs.add(err)
+	cfg.TrustedProxies, err = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	errs.add(err)
+
+	cfg.SlowRequestThreshold, err = getEnvDuration("SLOW_REQUEST_THRESHOLD", defaultSlowRequestThreshold)
+	errs.add(err)
+
+	cfg.GzipEnabled, err = getEnvBool("GZIP_ENABLED", true)
+	errs.add(err)
+	cfg.GzipMinBytes, err = getEnvInt("GZIP_MIN_BYTES", defaultGzipMinBytes)
+	errs.add(err)
+	if cfg.GzipMinBytes < 0 {
+		errs.add(fmt.Errorf("GZIP_MIN_BYTES must not be negative"))
+	}
+
+	cfg.ReferrerPolicy = getEnv("REFERRER_POLICY", defaultReferrerPolicy)
+	// HSTS_MAX_AGE=0 turns HSTS off explicitly, e.g. to override an image default.
+	cfg.HSTSMaxAge, err = getEnvNonNegativeDuration("HSTS_MAX_AGE", 0)
+	errs.add(err)
+	cfg.HSTSIncludeSubdomains, err = getEnvBool("HSTS_INCLUDE_SUBDOMAINS", false)
+	errs.add(err)
+
+	cfg.BreakerFailures, err = getEnvInt("CIRCUIT_BREAKER_FAILURES", defaultBreakerFailures)
+	errs.add(err)
+	if cfg.BreakerFailures < 0 {
+		errs.add(fmt.Errorf("CIRCUIT_BREAKER_FAILURES must not be negative"))
+	}
+	cfg.BreakerOpenTimeout, err = getEnvDuration("CIRCUIT_BREAKER_TIMEOUT", defaultBreakerOpenTimeout)
+	errs.add(err)
+
+	cfg.AuthEnabled, err = getEnvBool("AUTH_ENABLED", true)
+	errs.add(err)
+	if cfg.AuthEnabled {
+		cfg.JWTSecret = []byte(os.Getenv("JWT_SECRET"))
+		if len(cfg.JWTSecret) == 0 {
+			errs.add(fmt.Errorf("JWT_SECRET must be set when AUTH_ENABLED is true"))
+		} else if len(cfg.JWTSecret) < minJWTSecretBytes {
+			errs.add(fmt.Errorf("JWT_SECRET must be at least %d bytes, got %d", minJWTSecretBytes, len(cfg.JWTSecret)))
+		}
+	}
+	cfg.JTIRequiredSince, err = getEnvTime("JTI_REQUIRED_SINCE", time.Now())
+	errs.add(err)
+
+	cfg.Tenants, err = loadTenants(os.Getenv("TENANTS_FILE"), cfg.MockMode)
+	errs.add(err)
+
+	cfg.Prices, err = loadPriceTable(os.Getenv("PRICE_TABLE_FILE"))
+	errs.add(err)
+
+	cfg.OrgID = os.Getenv("OPENAI_ORG_ID")
+	cfg.ProjectID = os.Getenv("OPENAI_PROJECT_ID")
+
+	if cfg.BaseURL = os.Getenv("OPENAI_BASE_URL"); cfg.BaseURL != "" {
+		u, err := url.Parse(cfg.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs.add(fmt.Errorf("OPENAI_BASE_URL must be an absolute http(s) URL, got %q", cfg.BaseURL))
+		}
+	}
+
+	cfg.Azure, err = getEnvBool("AZURE_OPENAI", false)
+	errs.add(err)
+	if cfg.Azure {
+		if cfg.BaseURL == "" {
+			errs.add(fmt.Errorf("OPENAI_BASE_URL must be set to the Azure endpoint when AZURE_OPENAI is true"))
+		}
+		cfg.AzureAPIVersion = getEnv("AZURE_API_VERSION", defaultAzureAPIVersion)
+		cfg.AzureDeployments, err = parseAzureDeployments(os.Getenv("AZURE_DEPLOYMENTS"))
+		errs.add(err)
+	}
+
+	cfg.ContextTokenBudget, err = getEnvInt("CONTEXT_TOKEN_BUDGET", 0)
+	errs.add(err)
+	if cfg.ContextTokenBudget < 0 {
+		errs.add(fmt.Errorf("CONTEXT_TOKEN_BUDGET must not be negative"))
+	}
+
+	cfg.MaxConcurrentOpenAI, err = getEnvInt("MAX_CONCURRENT_OPENAI", 0)
+	errs.add(err)
+	if cfg.MaxConcurrentOpenAI < 0 {
+		errs.add(fmt.Errorf("MAX_CONCURRENT_OPENAI must not be negative"))
+	}
+	cfg.OpenAIQueueTimeout, err = getEnvDuration("OPENAI_QUEUE_TIMEOUT", defaultOpenAIQueueTimeout)
+	errs.add(err)
+
+	// SESSION_TTL covers both stores; REDIS_SESSION_TTL is its older name.
+	cfg.SessionTTL, err = getEnvDuration("REDIS_SESSION_TTL", defaultSessionTTL)
+	errs.add(err)
+	cfg.SessionTTL, err = getEnvDuration("SESSION_TTL", cfg.SessionTTL)
+	errs.add(err)
+	cfg.SessionCleanupInterval, err = getEnvDuration("SESSION_CLEANUP_INTERVAL", defaultSessionCleanupInterval)
+	errs.add(err)
+	cfg.MaxTurnsPerSession, err = getEnvInt("MAX_TURNS_PER_SESSION", 0)
+	errs.add(err)
+	if cfg.MaxTurnsPerSession < 0 {
+		errs.add(fmt.Errorf("MAX_TURNS_PER_SESSION must not be negative"))
+	}
+	cfg.SessionTurnPolicy = getEnv("SESSION_TURN_POLICY", turnPolicyReject)
+	if cfg.SessionTurnPolicy != turnPolicyReject && cfg.SessionTurnPolicy != turnPolicyReset {
+		errs.add(fmt.Errorf("SESSION_TURN_POLICY must be %q or %q", turnPolicyReject, turnPolicyReset))
+	}
+
+	cfg.Experiment, err = loadPromptExperiment()
+	errs.add(err)
+	cfg.TopicPolicy, err = loadTopicPolicy()
+	errs.add(err)
+
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.SystemPromptOverrideFile = os.Getenv("SYSTEM_PROMPT_OVERRIDE_FILE")
+	if cfg.SystemPrompt, cfg.SystemPromptSource, err = loadSystemPrompt(cfg.SystemPromptOverrideFile); err != nil {
+		errs.add(err)
+	} else {
+		errs.add(validatePromptTemplates(cfg))
+	}
+	cfg.BotName = getEnv("BOT_NAME", personaName(getEnv("PERSONA", defaultPersona)))
+	if dir := os.Getenv("PROMPTS_DIR"); dir != "" {
+		cfg.Prompts, err = newPromptLibrary(dir)
+		errs.add(err)
+	}
+	cfg.PromptsReloadInterval, err = getEnvDuration("PROMPTS_RELOAD_INTERVAL", defaultPromptsReloadInterval)
+	errs.add(err)
+	if cfg.PromptsReloadInterval <= 0 {
+		errs.add(fmt.Errorf("PROMPTS_RELOAD_INTERVAL must be positive"))
+	}
+
+	if len(errs) > 0 {
+		return cfg, errs
+	}
+	return cfg, nil
+}
+
+// summary returns the effective settings for the startup log. Secrets are
+// only reported as set or unset, and passwords are stripped from URLs.
+func (cfg ServerConfig) summary() logrus.Fields {
+	return logrus.Fields{
+		"model":                 cfg.Model,
+		"fallback_model":        cfg.FallbackModel,
+		"base_url":              redactURL(cfg.BaseURL),
+		"azure":                 cfg.Azure,
+		"request_timeout":       cfg.RequestTimeout.String(),
+		"openai_http_timeout":   cfg.OpenAIHTTPTimeout.String(),
+		"max_retries":           cfg.MaxRetries,
+		"retry_budget":          cfg.RetryBudget,
+		"max_concurrent_openai": cfg.MaxConcurrentOpenAI,
+		"rate_limit_rps":        cfg.RateLimitRPS,
+		"trusted_proxies":       len(cfg.TrustedProxies),
+		"user_rate_limit_rps":   cfg.UserRateLimitRPS,
+		"max_tokens":            cfg.MaxTokens,
+		"max_tokens_ceiling":    cfg.MaxTokensCeiling,
+		"max_question_length":   cfg.MaxQuestionLength,
+		"max_body_bytes":        cfg.MaxBodyBytes,
+		"auth_enabled":          cfg.AuthEnabled,
+		"jwt_secret":            secretState(string(cfg.JWTSecret)),
+		"jti_required_since":    cfg.JTIRequiredSince.UTC().Format(time.RFC3339),
+		"admin_token":           secretState(cfg.AdminToken),
+		"redis_url":             redactURL(cfg.RedisURL),
+		"session_ttl":           cfg.SessionTTL.String(),
+		"max_turns_per_session": cfg.MaxTurnsPerSession,
+		"moderation":            cfg.ModerationEnabled,
+		"topic_policy":          cfg.TopicPolicy != nil,
+		"cache":                 cfg.CacheEnabled,
+		"tools":                 cfg.ToolsEnabled,
+		"send_end_user":         cfg.SendEndUser,
+		"tenants":               len(cfg.Tenants),
+		"circuit_breaker":       cfg.BreakerFailures,
+		"log_redaction":         cfg.LogRedaction,
+		"gzip":                  cfg.GzipEnabled,
+		"hsts_max_age":          cfg.HSTSMaxAge.String(),
+		"mock_mode":             cfg.MockMode,
+		"system_prompt_source":  cfg.SystemPromptSource,
+		"prompt_library":        cfg.Prompts != nil,
+	}
+}
+
+// secretState describes a secret without revealing it.
+func secretState(v string) string {
+	if v == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// redactURL hides the password of a URL such as REDIS_URL.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil {
+		return "<unparsable>"
+	}
+	return u.Redacted()
+}
+
+// getEnv returns the value of the environment variable or fallback when unset.
+func getEnv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// getEnvDuration parses the environment variable as a time.Duration, returning
+// fallback when unset. The getEnv* parsers also return fallback alongside an
+// error, so checks on the value that follow don't report the same mistake
+// twice.
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d <= 0 {
+		return fallback, fmt.Errorf("invalid %s: must be positive", key)
+	}
+	return d, nil
+}
+
+// getEnvNonNegativeDuration is getEnvDuration for settings where 0 means
+// off.
+func getEnvNonNegativeDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	if d < 0 {
+		return fallback, fmt.Errorf("invalid %s: must not be negative", key)
+	}
+	return d, nil
+}
+
+// getEnvTime parses the environment variable as an RFC 3339 timestamp,
+// returning fallback when unset.
+func getEnvTime(key string, fallback time.Time) (time.Time, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return t, nil
+}
+
+// getEnvInt parses the environment variable as an integer, returning fallback
+// when unset.
+func getEnvInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// getEnvFloat parses the environment variable as a float, returning fallback
+// when unset.
+func getEnvFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// getEnvBool parses the environment variable as a boolean, returning fallback
+// when unset.
+func getEnvBool(key string, fallback bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// loadSystemPrompt resolves the system prompt from the admin override file, then
+// SYSTEM_PROMPT, then SYSTEM_PROMPT_FILE, falling back to the bundled persona
+// selected by PERSONA. It also reports which source was used.
+func loadSystemPrompt(overrideFile string) (string, string, error) {
+	if overrideFile != "" {
+		data, err := os.ReadFile(overrideFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", "", fmt.Errorf("read SYSTEM_PROMPT_OVERRIDE_FILE: %w", err)
+		}
+		if prompt := strings.TrimSpace(string(data)); prompt != "" {
+			return prompt, "override file " + overrideFile, nil
+		}
+	}
+
+	if v := os.Getenv("SYSTEM_PROMPT"); v != "" {
+		return v, "SYSTEM_PROMPT", nil
+	}
+
+	if path := os.Getenv("SYSTEM_PROMPT_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", "", fmt.Errorf("read SYSTEM_PROMPT_FILE: %w", err)
+		}
+		prompt := strings.TrimSpace(string(data))
+		if prompt == "" {
+			return "", "", fmt.Errorf("SYSTEM_PROMPT_FILE %s is empty", path)
+		}
+		return prompt, "file " + path, nil
+	}
+
+	persona := getEnv("PERSONA", defaultPersona)
+	prompt, err := personaPrompt(persona)
+	if err != nil {
+		return "", "", err
+	}
+	return prompt, "persona " + persona, nil
+}
+
+// parseAzureDeployments parses a comma-separated list of model=deployment
+// pairs.
+func parseAzureDeployments(v string) (map[string]string, error) {
+	deployments := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		model, deployment, ok := strings.Cut(pair, "=")
+		model, deployment = strings.TrimSpace(model), strings.TrimSpace(deployment)
+		if !ok || model == "" || deployment == "" {
+			return nil, fmt.Errorf("AZURE_DEPLOYMENTS entries must look like model=deployment, got %q", pair)
+		}
+		deployments[model] = deployment
+	}
+	return deployments, nil
+}
+
+// listenAddr builds the address to bind from BIND_ADDR and PORT. An empty
+// BIND_ADDR listens on all interfaces.
+func listenAddr() (string, error) {
+	port := getEnv("PORT", "8080")
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("PORT must be a number between 1 and 65535, got %q", port)
+	}
+
+	host := os.Getenv("BIND_ADDR")
+	if strings.ContainsAny(host, " /") {
+		return "", fmt.Errorf("BIND_ADDR %q is not a valid host", host)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(n)), nil
+}
+
+// loadAPIKey reads the OpenAI API key from OPENAI_API_KEY_FILE when set, so a
+// rotated key can be picked up without a restart, and from OPENAI_API_KEY
+// otherwise.
+func loadAPIKey() (string, error) {
+	if path := os.Getenv("OPENAI_API_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("read OPENAI_API_KEY_FILE: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return os.Getenv("OPENAI_API_KEY"), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// continuationTTL is how long a truncated answer can be continued.
+	continuationTTL = 30 * time.Minute
+	// maxContinuations bounds the number of pending continuation tokens.
+	maxContinuations = 10000
+	// continueInstruction asks the model to resume a truncated answer.
+	continueInstruction = "Continue your previous answer exactly where it stopped. Do not repeat anything you already said."
+)
+
+// continuation is the context needed to resume a truncated answer.
+type continuation struct {
+	owner string
+	// sessionID is set for server-side sessions, which already hold the
+	// conversation; otherwise history carries it, ending with the shown part
+	// of the answer.
+	sessionID  string
+	history    []Message
+	model      string
+	promptName string
+	language   string
+	// image is the validated image URL of the question, either https or a
+	// data URL.
+	image       string
+	temperature *float32
+	maxChars    int
+	expires     time.Time
+}
+
+type continuationEntry struct {
+	token string
+	cont  continuation
+}
+
+// continuationStore holds pending continuations by token. Tokens are single
+// use and expire after continuationTTL. Entries are kept in issue order, so
+// the oldest are at the front.
+type continuationStore struct {
+	mu    sync.Mutex
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newContinuationStore() *continuationStore {
+	return &continuationStore{order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// Add stores c and returns its token. Expired entries are dropped first; when
+// the store is still full, the oldest pending continuation is evicted.
+func (c *continuationStore) Add(cont continuation) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for front := c.order.Front(); front != nil; front = c.order.Front() {
+		entry := front.Value.(*continuationEntry)
+		if !now.After(entry.cont.expires) && len(c.items) < maxContinuations {
+			break
+		}
+		c.order.Remove(front)
+		delete(c.items, entry.token)
+	}
+	token := uuid.NewString()
+	cont.expires = now.Add(continuationTTL)
+	c.items[token] = c.order.PushBack(&continuationEntry{token: token, cont: cont})
+	return token
+}
+
+// Take removes and returns the continuation for token if it is still valid.
+func (c *continuationStore) Take(token string) (continuation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[token]
+	if !ok {
+		return continuation{}, false
+	}
+	c.order.Remove(el)
+	delete(c.items, token)
+	cont := el.Value.(*continuationEntry).cont
+	if time.Now().After(cont.expires) {
+		return continuation{}, false
+	}
+	return cont, true
+}
+
+// truncateAtWord shortens answer to at most maxChars characters, cutting at
+// the last whitespace so no word is split. It reports whether it cut.
+func truncateAtWord(answer string, maxChars int) (string, bool) {
+	if utf8.RuneCountInString(answer) <= maxChars {
+		return answer, false
+	}
+	runes := []rune(answer)[:maxChars]
+	// A single overlong word is cut mid-word rather than dropped entirely.
+	for i := len(runes) - 1; i > 0; i-- {
+		if unicode.IsSpace(runes[i]) {
+			runes = runes[:i]
+			break
+		}
+	}
+	return strings.TrimRightFunc(string(runes), unicode.IsSpace), true
+}
+
+// resumeContinuation turns a request carrying a continuation token into a
+// follow-up that asks the model to carry on from the truncated answer. It
+// writes an error response and returns false for invalid or foreign tokens.
+func (s *Server) resumeContinuation(w http.ResponseWriter, r *http.Request, req *ChatRequest) bool {
+	if req.Question != "" || req.SessionID != "" || len(req.History) > 0 {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The continuation_token field cannot be combined with question, history or session_id")
+		return false
+	}
+	cont, ok := s.continuations.Take(req.ContinuationToken)
+	if !ok || cont.owner != callerID(r) {
+		s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "Unknown or expired continuation token")
+		return false
+	}
+
+	req.Question = continueInstruction
+	req.SessionID = cont.sessionID
+	req.History = cont.history
+	if req.Model == "" {
+		req.Model = cont.model
+	}
+	if req.PromptName == "" {
+		req.PromptName = cont.promptName
+	}
+	if req.Language == "" {
+		req.Language = cont.language
+	}
+	if req.Temperature == nil {
+		req.Temperature = cont.temperature
+	}
+	if req.ImageURL == "" && req.Image == "" {
+		// Inline images were turned into data URLs, which only the image
+		// field accepts.
+		if strings.HasPrefix(cont.image, "data:") {
+			req.Image = cont.image
+		} else {
+			req.ImageURL = cont.image
+		}
+	}
+	if req.MaxAnswerChars == nil {
+		req.MaxAnswerChars = &cont.maxChars
+	}
+	return true
+}
+
+// offerContinuation issues a token for resuming a truncated answer. history
+// is the conversation the answer was given in, without the new exchange.
+func (s *Server) offerContinuation(r *http.Request, req ChatRequest, history []Message, shown string) string {
+	cont := continuation{
+		owner:       callerID(r),
+		sessionID:   req.SessionID,
+		model:       req.Model,
+		promptName:  req.PromptName,
+		language:    req.Language,
+		image:       req.ImageURL,
+		temperature: req.Temperature,
+		maxChars:    *req.MaxAnswerChars,
+	}
+	if req.SessionID == "" {
+		cont.history = append(append([]Message(nil), history...),
+			Message{Role: openai.ChatMessageRoleUser, Content: req.Question},
+			Message{Role: openai.ChatMessageRoleAssistant, Content: shown})
+	}
+	return s.continuations.Add(cont)
+}
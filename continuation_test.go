@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestTruncateAtWord(t *testing.T) {
+	tests := []struct {
+		answer    string
+		maxChars  int
+		want      string
+		truncated bool
+	}{
+		{"short answer", 20, "short answer", false},
+		{"the chinook salmon is big", 15, "the chinook", true},
+		{"the chinook   salmon", 14, "the chinook", true},
+		{"tschawytscha", 5, "tscha", true},
+		{"ääääää ööö", 8, "ääääää", true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateAtWord(tt.answer, tt.maxChars)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("truncateAtWord(%q, %d) = %q, %v; want %q, %v", tt.answer, tt.maxChars, got, truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestContinuationStoreEvictsOldest(t *testing.T) {
+	store := newContinuationStore()
+	first := store.Add(continuation{owner: "first"})
+	var last string
+	for i := 0; i < maxContinuations; i++ {
+		last = store.Add(continuation{})
+	}
+	if last == "" {
+		t.Fatal("a full store issued no token")
+	}
+	if _, ok := store.Take(first); ok {
+		t.Error("the oldest continuation survived a full store")
+	}
+	if _, ok := store.Take(last); !ok {
+		t.Error("the newest continuation was not stored")
+	}
+	if _, ok := store.Take(last); ok {
+		t.Error("a continuation token was accepted twice")
+	}
+}
+
+func TestContinuationKeepsRequestSettings(t *testing.T) {
+	long := strings.Repeat("salmon ", 20)
+	client := answering(long)
+	s := newTestServer(t, client, nil)
+
+	rec := postJSON(s.chatHandler, "/api/chat", `{"question":"what is this fish?","language":"de","temperature":0.2,`+
+		`"image_url":"https://fish.example/chinook.png","max_answer_chars":50}`)
+	var first ChatResponse
+	decodeBody(t, rec, &first)
+	if !first.Truncated || first.ContinuationToken == "" {
+		t.Fatalf("answer was not truncated with a token: %+v", first)
+	}
+
+	rec = postJSON(s.chatHandler, "/api/chat", `{"continuation_token":"`+first.ContinuationToken+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("continuation status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	requests := client.Requests()
+	resumed := requests[len(requests)-1]
+	if resumed.Temperature != 0.2 {
+		t.Errorf("temperature = %v, want 0.2", resumed.Temperature)
+	}
+	if !strings.HasSuffix(resumed.Messages[0].Content, languageInstruction("de")) {
+		t.Errorf("system prompt lost the language: %q", resumed.Messages[0].Content)
+	}
+	question := resumed.Messages[len(resumed.Messages)-1]
+	if len(question.MultiContent) != 2 || question.MultiContent[1].Type != openai.ChatMessagePartTypeImageURL ||
+		question.MultiContent[1].ImageURL.URL != "https://fish.example/chinook.png" {
+		t.Errorf("continuation lost the image: %+v", question)
+	}
+
+	rec = postJSON(s.chatHandler, "/api/chat", `{"continuation_token":"`+first.ContinuationToken+`"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("reused token status = %d, want 404", rec.Code)
+	}
+}
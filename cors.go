@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CORS settings shared by every API response.
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Content-Type, X-Request-ID, Idempotency-Key, X-Tenant-ID"
+	corsMaxAge         = "600"
+)
+
+// parseAllowedOrigins splits a comma-separated origin list, dropping blanks.
+// A "*" entry is rejected: allowed origins get credentialed requests and
+// WebSocket upgrades, so a wildcard would hand any site the caller's session.
+func parseAllowedOrigins(v string) ([]string, error) {
+	var origins []string
+	for _, o := range strings.Split(v, ",") {
+		if o = strings.TrimSpace(o); o == "" {
+			continue
+		}
+		if strings.Contains(o, "*") {
+			return nil, fmt.Errorf("CORS_ALLOWED_ORIGINS must list origins explicitly, got %q", o)
+		}
+		origins = append(origins, strings.TrimRight(o, "/"))
+	}
+	return origins, nil
+}
+
+// originMatcher returns a predicate reporting whether an origin is in the
+// allowlist.
+func originMatcher(allowed []string) func(origin string) bool {
+	set := make(map[string]bool, len(allowed))
+	for _, o := range allowed {
+		set[o] = true
+	}
+	return func(origin string) bool {
+		return set[origin]
+	}
+}
+
+// corsMiddleware echoes the request Origin back only when it is in the
+// allowlist, enabling credentialed requests from those origins. Preflight
+// requests are answered directly with 204.
+func corsMiddleware(allowed []string, next http.Handler) http.Handler {
+	originAllowed := originMatcher(allowed)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if origin != "" && originAllowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlePreflight answers OPTIONS requests that reach a handler with 204 and
+// the allowed methods. It reports whether the request was handled.
+func handlePreflight(w http.ResponseWriter, r *http.Request, methods string) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	w.Header().Set("Allow", methods)
+	w.Header().Set("Access-Control-Allow-Methods", methods)
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseAllowedOrigins(t *testing.T) {
+	origins, err := parseAllowedOrigins(" https://a.example/, ,https://b.example")
+	if err != nil {
+		t.Fatalf("parseAllowedOrigins: %v", err)
+	}
+	if len(origins) != 2 || origins[0] != "https://a.example" || origins[1] != "https://b.example" {
+		t.Errorf("origins = %q", origins)
+	}
+
+	for _, v := range []string{"*", "https://a.example,*", "https://*.example"} {
+		if _, err := parseAllowedOrigins(v); err == nil {
+			t.Errorf("parseAllowedOrigins(%q) accepted a wildcard", v)
+		}
+	}
+}
+
+func TestWildcardOriginRejectedByConfig(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "false")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "*")
+	if _, err := loadServerConfig(); err == nil {
+		t.Fatal("loadServerConfig accepted CORS_ALLOWED_ORIGINS=*")
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	handler := corsMiddleware([]string{"https://app.example"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		wantStatus  int
+		wantAllowed bool
+	}{
+		{"allowed origin", http.MethodGet, "https://app.example", http.StatusOK, true},
+		{"other origin", http.MethodGet, "https://evil.example", http.StatusOK, false},
+		{"allowed preflight", http.MethodOptions, "https://app.example", http.StatusNoContent, true},
+		{"other preflight", http.MethodOptions, "https://evil.example", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/chat", nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			gotOrigin := rec.Header().Get("Access-Control-Allow-Origin")
+			gotCredentials := rec.Header().Get("Access-Control-Allow-Credentials")
+			if tt.wantAllowed && (gotOrigin != tt.origin || gotCredentials != "true") {
+				t.Errorf("allowed origin got Allow-Origin %q, Allow-Credentials %q", gotOrigin, gotCredentials)
+			}
+			if !tt.wantAllowed && (gotOrigin != "" || gotCredentials != "") {
+				t.Errorf("foreign origin got Allow-Origin %q, Allow-Credentials %q", gotOrigin, gotCredentials)
+			}
+			if rec.Header().Get("Vary") != "Origin" {
+				t.Error("response does not vary on Origin")
+			}
+		})
+	}
+}
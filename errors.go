@@ -0,0 +1,38 @@
+package main
+
+// ErrorCode is a stable, machine-readable identifier for an API error.
+// Clients should switch on the code rather than the message.
+type ErrorCode string
+
+const (
+	ErrCodeInvalidPayload      ErrorCode = "invalid_payload"
+	ErrCodeInvalidRequest      ErrorCode = "invalid_request"
+	ErrCodePayloadTooLarge     ErrorCode = "payload_too_large"
+	ErrCodeUnsupportedMedia    ErrorCode = "unsupported_media_type"
+	ErrCodeMethodNotAllowed    ErrorCode = "method_not_allowed"
+	ErrCodeUnauthorized        ErrorCode = "unauthorized"
+	ErrCodeUnknownTenant       ErrorCode = "unknown_tenant"
+	ErrCodeNotFound            ErrorCode = "not_found"
+	ErrCodeSessionFull         ErrorCode = "session_turn_limit"
+	ErrCodeRateLimited         ErrorCode = "rate_limited"
+	ErrCodeIdempotencyMismatch ErrorCode = "idempotency_key_mismatch"
+	ErrCodeRequestInProgress   ErrorCode = "request_in_progress"
+	ErrCodeContentRejected     ErrorCode = "content_rejected"
+	ErrCodeContextTooLong      ErrorCode = "context_length_exceeded"
+	ErrCodeUpstreamError       ErrorCode = "upstream_error"
+	ErrCodeUpstreamTimeout     ErrorCode = "upstream_timeout"
+	ErrCodeServiceUnavailable  ErrorCode = "service_unavailable"
+	ErrCodeInternalError       ErrorCode = "internal_error"
+)
+
+// ErrorDetail describes what went wrong.
+type ErrorDetail struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// ErrorResponse is the JSON body of every error returned by the API.
+type ErrorResponse struct {
+	Error     ErrorDetail `json:"error"`
+	RequestID string      `json:"request_id,omitempty"`
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prompt experiment variants. A is the control and uses the regular system
+// prompt.
+const (
+	variantA = "A"
+	variantB = "B"
+)
+
+// experimentAnswers counts answers per experiment variant so their share of
+// traffic and feedback can be compared.
+var experimentAnswers = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tschabot_prompt_experiment_answers_total",
+	Help: "Answers produced per prompt experiment variant.",
+}, []string{"experiment", "variant"})
+
+// PromptExperiment splits sessions between the regular system prompt (A) and
+// an alternative one (B).
+type PromptExperiment struct {
+	// Name identifies the experiment; it also salts the assignment so a new
+	// experiment reshuffles sessions.
+	Name string
+	// PromptB is the system prompt of variant B.
+	PromptB string
+	// ShareB is the fraction of sessions assigned to variant B.
+	ShareB float64
+}
+
+// loadPromptExperiment reads the experiment from PROMPT_EXPERIMENT,
+// PROMPT_EXPERIMENT_B_FILE and PROMPT_EXPERIMENT_B_SHARE. It returns nil when
+// no experiment is configured.
+func loadPromptExperiment() (*PromptExperiment, error) {
+	name := os.Getenv("PROMPT_EXPERIMENT")
+	if name == "" {
+		return nil, nil
+	}
+
+	path := os.Getenv("PROMPT_EXPERIMENT_B_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("PROMPT_EXPERIMENT requires PROMPT_EXPERIMENT_B_FILE")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read PROMPT_EXPERIMENT_B_FILE: %w", err)
+	}
+	prompt := strings.TrimSpace(string(data))
+	if prompt == "" {
+		return nil, fmt.Errorf("PROMPT_EXPERIMENT_B_FILE %s is empty", path)
+	}
+
+	share, err := getEnvFloat("PROMPT_EXPERIMENT_B_SHARE", 0.5)
+	if err != nil {
+		return nil, err
+	}
+	if share < 0 || share > 1 {
+		return nil, fmt.Errorf("PROMPT_EXPERIMENT_B_SHARE must be between 0 and 1")
+	}
+	return &PromptExperiment{Name: name, PromptB: prompt, ShareB: share}, nil
+}
+
+// assign deterministically maps a session to a variant, so every turn of a
+// session sees the same prompt.
+func (e *PromptExperiment) assign(sessionID string) string {
+	// A cryptographic hash spreads near-identical IDs evenly, which FNV and
+	// similar fast hashes do not in their high bits.
+	sum := sha256.Sum256([]byte(e.Name + ":" + sessionID))
+	if float64(binary.BigEndian.Uint64(sum[:8]))/math.MaxUint64 < e.ShareB {
+		return variantB
+	}
+	return variantA
+}
+
+// experimentVariant returns the variant of the session, or "" when no
+// experiment runs or the request has no session.
+func (s *Server) experimentVariant(sessionID string) string {
+	if s.cfg.Experiment == nil || sessionID == "" {
+		return ""
+	}
+	return s.cfg.Experiment.assign(sessionID)
+}
+
+// requestVariant returns the experiment variant req is served with. Requests
+// that pick a named prompt stay out of the experiment.
+func (s *Server) requestVariant(req ChatRequest) string {
+	if req.PromptName != "" {
+		return ""
+	}
+	return s.experimentVariant(req.SessionID)
+}
+
+// systemPromptFor returns the rendered system prompt for req, honouring its
+// named prompt or experiment variant.
+func (s *Server) systemPromptFor(req ChatRequest) string {
+	prompt := s.currentSystemPrompt()
+	if req.PromptName != "" && s.cfg.Prompts != nil {
+		// A prompt removed by a reload since validation falls back to the
+		// default one.
+		if named, ok := s.cfg.Prompts.Get(req.PromptName); ok {
+			prompt = named
+		}
+	} else if s.requestVariant(req) == variantB {
+		prompt = s.cfg.Experiment.PromptB
+	}
+	data := req.promptData
+	if data.Date == "" {
+		data.Date = time.Now().UTC().Format(time.DateOnly)
+	}
+	return renderPrompt(prompt, data)
+}
+
+// recordVariant counts an answer towards its experiment variant.
+func (s *Server) recordVariant(variant string) {
+	if variant != "" {
+		experimentAnswers.WithLabelValues(s.cfg.Experiment.Name, variant).Inc()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestExperimentAssignIsStable(t *testing.T) {
+	e := &PromptExperiment{Name: "tone", ShareB: 0.5}
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("sess-%d", i)
+		first := e.assign(id)
+		for turn := 0; turn < 5; turn++ {
+			if got := e.assign(id); got != first {
+				t.Fatalf("%s moved from variant %s to %s", id, first, got)
+			}
+		}
+	}
+
+	s := &Server{cfg: ServerConfig{Experiment: e}}
+	if got := s.experimentVariant(""); got != "" {
+		t.Errorf("request without a session got variant %q, want none", got)
+	}
+	if got := s.requestVariant(ChatRequest{SessionID: "sess-1", PromptName: "support"}); got != "" {
+		t.Errorf("request with a named prompt got variant %q, want none", got)
+	}
+}
+
+func TestExperimentAssignShares(t *testing.T) {
+	const sessions = 20000
+	for _, share := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		t.Run(fmt.Sprint(share), func(t *testing.T) {
+			e := &PromptExperiment{Name: "tone", ShareB: share}
+			b := 0
+			for i := 0; i < sessions; i++ {
+				if e.assign(fmt.Sprintf("sess-%d", i)) == variantB {
+					b++
+				}
+			}
+			if got := float64(b) / sessions; math.Abs(got-share) > 0.02 {
+				t.Errorf("variant B got %.3f of sessions, want about %.2f", got, share)
+			}
+		})
+	}
+}
+
+func TestExperimentNameReshuffles(t *testing.T) {
+	first := &PromptExperiment{Name: "tone", ShareB: 0.5}
+	second := &PromptExperiment{Name: "length", ShareB: 0.5}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("sess-%d", i)
+		if first.assign(id) != second.assign(id) {
+			moved++
+		}
+	}
+	// Independent assignments disagree about half the time.
+	if moved < 400 || moved > 600 {
+		t.Errorf("%d of 1000 sessions changed variant between experiments, want about 500", moved)
+	}
+}
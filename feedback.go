@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxFeedbackCommentLength bounds free-form comments attached to a rating.
+	maxFeedbackCommentLength = 2000
+	// maxNegativeFeedback is how many negative ratings are kept for review.
+	maxNegativeFeedback = 100
+)
+
+// FeedbackRequest is a user's rating of a previous answer, identified by the
+// request ID returned with that answer or by its session and message index.
+type FeedbackRequest struct {
+	RequestID    string `json:"request_id,omitempty"`
+	SessionID    string `json:"session_id,omitempty"`
+	MessageIndex *int   `json:"message_index,omitempty"`
+	Rating       string `json:"rating"` // "up" or "down"
+	Comment      string `json:"comment,omitempty"`
+}
+
+// feedbackRecord is the line appended to the feedback file. Question and
+// Answer are filled in when the rating refers to a stored session.
+type feedbackRecord struct {
+	Time time.Time `json:"time"`
+	FeedbackRequest
+	Question string `json:"question,omitempty"`
+	Answer   string `json:"answer,omitempty"`
+	// Variant is the prompt experiment variant of the rated session.
+	Variant string `json:"experiment_variant,omitempty"`
+}
+
+// FeedbackList is returned by the admin feedback endpoint, newest first.
+type FeedbackList struct {
+	Feedback []feedbackRecord `json:"feedback"`
+}
+
+// feedbackHandler records thumbs up/down ratings for chat answers.
+func (s *Server) feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+
+	if handlePreflight(w, r, "POST, OPTIONS") {
+		return
+	}
+
+	if !s.hasJSONBody(w, r) {
+		return
+	}
+
+	raw, ok := s.readBody(w, r)
+	if !ok {
+		return
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, "Request body is empty; expected JSON with a 'rating' field")
+		return
+	}
+	var fb FeedbackRequest
+	if msg, ok := s.decodePayload(log, raw, &fb); !ok {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, msg)
+		return
+	}
+
+	if fb.SessionID != "" {
+		if !validID(fb.SessionID) {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The session_id field is malformed")
+			return
+		}
+		if fb.MessageIndex == nil || *fb.MessageIndex < 0 {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "A non-negative message_index is required with session_id")
+			return
+		}
+	} else if !validID(fb.RequestID) {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "A valid request_id or session_id is required")
+		return
+	}
+	if fb.Rating != "up" && fb.Rating != "down" {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, `The rating field must be "up" or "down"`)
+		return
+	}
+	if len(fb.Comment) > maxFeedbackCommentLength {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("The comment must not exceed %d characters", maxFeedbackCommentLength))
+		return
+	}
+
+	record := feedbackRecord{Time: time.Now().UTC(), FeedbackRequest: fb}
+	if fb.SessionID != "" {
+		index := *fb.MessageIndex
+		if !s.sessionAccessible(r, fb.SessionID) {
+			log.Warn("refused feedback on a session owned by another caller")
+			s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "No answer exists at that session_id and message_index")
+			return
+		}
+		question, answer, ok := s.store.Rate(fb.SessionID, index, fb.Rating)
+		if !ok {
+			s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "No answer exists at that session_id and message_index")
+			return
+		}
+		record.Answer = answer.Content
+		record.Variant = s.experimentVariant(fb.SessionID)
+		if question.Role == "user" {
+			record.Question = question.Content
+		}
+	}
+
+	log.WithFields(logrus.Fields{
+		"feedback_request_id": fb.RequestID,
+		"session_id":          fb.SessionID,
+		"rating":              fb.Rating,
+		"comment":             fb.Comment,
+	}).Info("chat feedback received")
+
+	if fb.Rating == "down" {
+		s.keepNegativeFeedback(record)
+	}
+	if err := s.appendFeedback(record); err != nil {
+		log.WithError(err).Error("failed to persist feedback")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Failed to store feedback")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keepNegativeFeedback remembers a negative rating for the admin review list,
+// dropping the oldest once maxNegativeFeedback are held.
+func (s *Server) keepNegativeFeedback(record feedbackRecord) {
+	s.feedbackMu.Lock()
+	defer s.feedbackMu.Unlock()
+	s.negativeFeedback = append(s.negativeFeedback, record)
+	if len(s.negativeFeedback) > maxNegativeFeedback {
+		s.negativeFeedback = s.negativeFeedback[len(s.negativeFeedback)-maxNegativeFeedback:]
+	}
+}
+
+// listFeedbackHandler lists recent negative feedback with the rated
+// question and answer. Only ratings received by this instance are included.
+func (s *Server) listFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	s.feedbackMu.Lock()
+	list := FeedbackList{Feedback: make([]feedbackRecord, 0, len(s.negativeFeedback))}
+	for i := len(s.negativeFeedback) - 1; i >= 0; i-- {
+		list.Feedback = append(list.Feedback, s.negativeFeedback[i])
+	}
+	s.feedbackMu.Unlock()
+
+	s.writeJSON(w, http.StatusOK, list)
+}
+
+// appendFeedback writes the feedback as a JSON line to the configured file.
+// It is a no-op when no feedback file is configured.
+func (s *Server) appendFeedback(record feedbackRecord) error {
+	if s.cfg.FeedbackFile == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.feedbackMu.Lock()
+	defer s.feedbackMu.Unlock()
+
+	f, err := os.OpenFile(s.cfg.FeedbackFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFeedbackHandlerDecoding(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantMessage string
+	}{
+		{"valid", `{"request_id":"req-1","rating":"up"}`, http.StatusNoContent, ""},
+		{"empty body", ``, http.StatusBadRequest, "Request body is empty; expected JSON with a 'rating' field"},
+		{"unknown field", `{"request_id":"req-1","rating":"up","stars":5}`, http.StatusBadRequest, `Unknown field "stars" in request payload`},
+		{"invalid JSON", `{"request_id":`, http.StatusBadRequest, "Invalid request payload"},
+		{"invalid UTF-8", "{\"request_id\":\"req-1\",\"rating\":\"up\",\"comment\":\"\xff\"}", http.StatusBadRequest, "Request body must be valid UTF-8"},
+		{"oversized", `{"request_id":"req-1","rating":"up","comment":"` + strings.Repeat("a", 200) + `"}`, http.StatusRequestEntityTooLarge, "Request body must not exceed 128 bytes"},
+		{"bad rating", `{"request_id":"req-1","rating":"meh"}`, http.StatusBadRequest, `The rating field must be "up" or "down"`},
+	}
+	s := newTestServer(t, answering("hi"), map[string]string{"MAX_BODY_BYTES": "128"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(s.feedbackHandler, "/api/chat/feedback", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantMessage == "" {
+				return
+			}
+			var body ErrorResponse
+			decodeBody(t, rec, &body)
+			if body.Error.Message != tt.wantMessage {
+				t.Errorf("message = %q, want %q", body.Error.Message, tt.wantMessage)
+			}
+		})
+	}
+}
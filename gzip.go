@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether the client listed gzip (or *) in
+// Accept-Encoding without disabling it with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses responses of at least minSize bytes for clients
+// that accept gzip. Smaller bodies are sent as is, since compressing them
+// saves nothing. Server-sent events and WebSocket upgrades are never
+// compressed so that every flushed event reaches the client immediately.
+func gzipMiddleware(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the body is large enough to compress, then either switches to gzip or
+// passes everything through unchanged.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	status  int
+	buf     []byte
+	gz      *gzip.Writer
+	// plain is set once the response is known to go out uncompressed.
+	plain bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status != 0 || g.plain || g.gz != nil {
+		return
+	}
+	g.status = status
+	// Bodiless and informational responses have nothing to compress.
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified {
+		g.passThrough()
+	}
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(b)
+	case g.plain:
+		return g.ResponseWriter.Write(b)
+	}
+	if !g.compressible() {
+		g.passThrough()
+		return g.ResponseWriter.Write(b)
+	}
+
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= g.minSize {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// compressible reports whether the response may be compressed, judging by
+// the headers set so far.
+func (g *gzipResponseWriter) compressible() bool {
+	h := g.Header()
+	if h.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediaType != "text/event-stream"
+}
+
+// startGzip commits the headers for a compressed body and writes the
+// buffered bytes through the compressor.
+func (g *gzipResponseWriter) startGzip() error {
+	h := g.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	g.writeStatus()
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+// passThrough commits to an uncompressed response and sends what was
+// buffered so far.
+func (g *gzipResponseWriter) passThrough() {
+	g.plain = true
+	g.writeStatus()
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+func (g *gzipResponseWriter) writeStatus() {
+	if g.status != 0 {
+		g.ResponseWriter.WriteHeader(g.status)
+	}
+}
+
+// Flush sends buffered data right away. A response flushed before reaching
+// minSize is sent uncompressed, since its caller wants bytes on the wire.
+func (g *gzipResponseWriter) Flush() {
+	switch {
+	case g.gz != nil:
+		g.gz.Flush()
+	case !g.plain:
+		g.passThrough()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack forwards to the underlying writer so WebSocket upgrades work.
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	g.plain = true
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close finishes the response: it ends the gzip stream, or sends a body that
+// stayed below minSize uncompressed.
+func (g *gzipResponseWriter) close() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case !g.plain:
+		g.passThrough()
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                   false,
+		"gzip":               true,
+		"deflate, gzip;q=1":  true,
+		"br, *":              true,
+		"gzip;q=0":           false,
+		"gzip;q=0.5":         true,
+		"identity":           false,
+		"gzip;q=not-a-value": false,
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", header)
+		if got := acceptsGzip(r); got != want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+// gzipPost posts a question through the gzip middleware.
+func gzipPost(handler http.HandlerFunc, path, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"question":"Is a salmon a fish?"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rec := httptest.NewRecorder()
+	gzipMiddleware(defaultGzipMinBytes, handler).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestGzipChatResponses(t *testing.T) {
+	long := strings.Repeat("Salmon are ray-finned fish. ", 100)
+	tests := []struct {
+		name           string
+		answer         string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"large answer", long, "gzip", true},
+		{"small answer", "Yes.", "gzip", false},
+		{"gzip not accepted", long, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, answering(tt.answer), nil)
+			rec := gzipPost(s.chatHandler, "/api/chat", tt.acceptEncoding)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+			gotGzip := rec.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("compressed = %v, want %v", gotGzip, tt.wantGzip)
+			}
+
+			body := io.Reader(rec.Body)
+			if gotGzip {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("body is not gzip: %v", err)
+				}
+				body = zr
+			}
+			var resp ChatResponse
+			if err := json.NewDecoder(body).Decode(&resp); err != nil {
+				t.Fatalf("decoding the response: %v", err)
+			}
+			if resp.Answer != tt.answer {
+				t.Errorf("answer = %q, want %q", resp.Answer, tt.answer)
+			}
+		})
+	}
+}
+
+func TestGzipSkipsStreams(t *testing.T) {
+	chunks := make([]string, 50)
+	for i := range chunks {
+		chunks[i] = strings.Repeat("blub ", 10)
+	}
+	s := newTestServer(t, streaming(chunks...), nil)
+	rec := gzipPost(s.chatStreamHandler, "/api/chat/stream", "gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("stream Content-Encoding = %q, want none", got)
+	}
+	if got := rec.Body.Len(); got < defaultGzipMinBytes {
+		t.Fatalf("stream is %d bytes, too short to exercise compression", got)
+	}
+	if !strings.Contains(rec.Body.String(), `"delta":"blub blub`) || !strings.Contains(rec.Body.String(), "event: done") {
+		t.Errorf("stream body is not plain SSE: %q", rec.Body.String())
+	}
+}
+
+func TestGzipKeepsStartedResponses(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		failure func()
+	}{
+		{"error after a small body", "partial", func() {}},
+		{"error after a large body", strings.Repeat("partial ", defaultGzipMinBytes), func() {}},
+		{"panic after a small body", "partial", func() { panic("boom") }},
+		{"panic after WriteHeader", "", func() { panic("boom") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := logtest.NewNullLogger()
+			s := &Server{logger: logger}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Stands in for a recovery handler reporting the failure.
+				defer func() {
+					recover()
+					s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Something went wrong")
+				}()
+				w.WriteHeader(http.StatusAccepted)
+				io.WriteString(w, tt.body)
+				tt.failure()
+			})
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			accessLogMiddleware(logger, 0, gzipMiddleware(defaultGzipMinBytes, handler)).ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusAccepted {
+				t.Errorf("status = %d, want the handler's %d", rec.Code, http.StatusAccepted)
+			}
+			body := rec.Body.String()
+			if rec.Header().Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw, _ := io.ReadAll(zr)
+				body = string(raw)
+			}
+			if body != tt.body {
+				t.Errorf("body = %q, want only the handler's %q", body, tt.body)
+			}
+
+			var warned bool
+			for _, e := range hook.AllEntries() {
+				if strings.HasPrefix(e.Message, "response already started") {
+					warned = true
+				}
+			}
+			if !warned {
+				t.Error("error JSON was not dropped")
+			}
+			if entry := hook.LastEntry(); entry.Message != "request completed" || entry.Data["status"] != http.StatusAccepted {
+				t.Errorf("access log = %s %v, want status %d", entry.Message, entry.Data, http.StatusAccepted)
+			}
+		})
+	}
+}
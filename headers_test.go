@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHSTSHeader(t *testing.T) {
+	tests := []struct {
+		maxAge     time.Duration
+		subdomains bool
+		want       string
+	}{
+		{0, true, ""},
+		{24 * time.Hour, false, "max-age=86400"},
+		{365 * 24 * time.Hour, true, "max-age=31536000; includeSubDomains"},
+	}
+	for _, tt := range tests {
+		if got := hstsHeader(tt.maxAge, tt.subdomains); got != tt.want {
+			t.Errorf("hstsHeader(%s, %v) = %q, want %q", tt.maxAge, tt.subdomains, got, tt.want)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		body     string
+		https    bool
+		wantHSTS string
+	}{
+		{"answer", nil, `{"question":"Is a salmon a fish?"}`, false, ""},
+		{"error", nil, `{}`, false, ""},
+		{"hsts over http", map[string]string{"HSTS_MAX_AGE": "24h"}, `{"question":"Is a salmon a fish?"}`, false, ""},
+		{"hsts over https", map[string]string{"HSTS_MAX_AGE": "24h"}, `{"question":"Is a salmon a fish?"}`, true, "max-age=86400"},
+		{"hsts disabled over https", nil, `{"question":"Is a salmon a fish?"}`, true, ""},
+		{"hsts set to 0 over https", map[string]string{"HSTS_MAX_AGE": "0"}, `{"question":"Is a salmon a fish?"}`, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, answering("Yes."), tt.env)
+			handler := securityHeadersMiddleware(s.cfg.ReferrerPolicy, hstsHeader(s.cfg.HSTSMaxAge, s.cfg.HSTSIncludeSubdomains), http.HandlerFunc(s.chatHandler))
+
+			r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			if tt.https {
+				r.Header.Set("X-Forwarded-Proto", "https")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			for name, want := range map[string]string{
+				"X-Content-Type-Options":    "nosniff",
+				"X-Frame-Options":           "DENY",
+				"Referrer-Policy":           defaultReferrerPolicy,
+				"Strict-Transport-Security": tt.wantHSTS,
+			} {
+				if got := rec.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q (status %d)", name, got, want, rec.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestHSTSMaxAgeConfig(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"0s", 0, false},
+		{"8760h", 8760 * time.Hour, false},
+		{"-1h", 0, true},
+		{"a year", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("AUTH_ENABLED", "false")
+			t.Setenv("HSTS_MAX_AGE", tt.value)
+			cfg, err := loadServerConfig()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "HSTS_MAX_AGE") {
+					t.Errorf("loadServerConfig error = %v, want one about HSTS_MAX_AGE", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadServerConfig: %v", err)
+			}
+			if cfg.HSTSMaxAge != tt.want {
+				t.Errorf("HSTSMaxAge = %s, want %s", cfg.HSTSMaxAge, tt.want)
+			}
+		})
+	}
+}
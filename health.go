@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// healthCheckTimeout bounds each dependency probe of the verbose health check.
+const healthCheckTimeout = 3 * time.Second
+
+// healthCacheTTL is how long probe results are reused, so a public health
+// endpoint cannot be used to hammer OpenAI with ListModels calls.
+const healthCacheTTL = 5 * time.Second
+
+// Dependency states reported by the verbose health check.
+const (
+	depOK       = "ok"
+	depDown     = "down"
+	depDisabled = "disabled"
+)
+
+// pinger is implemented by dependencies the verbose health check can probe.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthResponse is returned by the health endpoint.
+type HealthResponse struct {
+	Status         string `json:"status"`
+	CircuitBreaker string `json:"circuit_breaker"`
+}
+
+// VerboseHealthResponse adds dependency status and uptime to HealthResponse.
+type VerboseHealthResponse struct {
+	HealthResponse
+	OpenAI        string `json:"openai"`
+	Redis         string `json:"redis"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+}
+
+// healthHandler reports liveness together with the circuit breaker state.
+// With ?verbose=true it also probes OpenAI and Redis: the status is
+// "degraded" when only Redis is down, since conversations then fall back to
+// stateless answers, and "unavailable" with 503 when OpenAI is unreachable.
+// Probe results are shared between requests for healthCacheTTL.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{
+		Status:         "ok",
+		CircuitBreaker: s.breakerState(),
+	}
+	if verbose, _ := strconv.ParseBool(r.URL.Query().Get("verbose")); !verbose {
+		s.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	probes := s.probeDependencies(r.Context())
+	detail := VerboseHealthResponse{
+		HealthResponse: resp,
+		OpenAI:         probes.openAI,
+		Redis:          probes.redis,
+		UptimeSeconds:  int64(time.Since(s.startedAt).Seconds()),
+	}
+
+	status := http.StatusOK
+	switch {
+	case detail.OpenAI != depOK:
+		detail.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	case detail.Redis == depDown:
+		detail.Status = "degraded"
+	}
+	s.writeJSON(w, status, detail)
+}
+
+// healthProbes is the outcome of one round of dependency probes.
+type healthProbes struct {
+	openAI    string
+	redis     string
+	checkedAt time.Time
+}
+
+// probeDependencies probes OpenAI and Redis, reusing the previous results for
+// healthCacheTTL. Concurrent callers wait for a single round of probes.
+func (s *Server) probeDependencies(ctx context.Context) healthProbes {
+	s.healthMu.Lock()
+	defer s.healthMu.Unlock()
+	if !s.health.checkedAt.IsZero() && time.Since(s.health.checkedAt) < healthCacheTTL {
+		return s.health
+	}
+
+	probes := healthProbes{
+		openAI:    s.probe(ctx, s.chatClient()),
+		redis:     depDisabled,
+		checkedAt: time.Now(),
+	}
+	if redis, ok := s.store.(pinger); ok {
+		probes.redis = s.probe(ctx, redis)
+	}
+	s.health = probes
+	return probes
+}
+
+// probe pings dep and reports its state. A missing client counts as down.
+func (s *Server) probe(ctx context.Context, dep any) string {
+	p, ok := dep.(pinger)
+	if !ok || p == nil {
+		return depDown
+	}
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := p.Ping(ctx); err != nil {
+		s.logger.WithError(err).Warn("health check probe failed")
+		return depDown
+	}
+	return depOK
+}
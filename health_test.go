@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// pingingClient is a fakeClient that also answers the health check probe.
+type pingingClient struct {
+	*fakeClient
+	err   error
+	pings atomic.Int32
+}
+
+func (c *pingingClient) Ping(context.Context) error {
+	c.pings.Add(1)
+	return c.err
+}
+
+func getHealth(s *Server, query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.healthHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz"+query, nil))
+	return rec
+}
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		client     ChatClient
+		query      string
+		wantStatus int
+		wantBody   VerboseHealthResponse
+	}{
+		{
+			name:       "liveness",
+			client:     &pingingClient{fakeClient: answering("hi")},
+			wantStatus: http.StatusOK,
+			wantBody:   VerboseHealthResponse{HealthResponse: HealthResponse{Status: "ok", CircuitBreaker: "closed"}},
+		},
+		{
+			name:       "verbose",
+			client:     &pingingClient{fakeClient: answering("hi")},
+			query:      "?verbose=true",
+			wantStatus: http.StatusOK,
+			wantBody:   VerboseHealthResponse{HealthResponse: HealthResponse{Status: "ok", CircuitBreaker: "closed"}, OpenAI: depOK, Redis: depDisabled},
+		},
+		{
+			name:       "openai down",
+			client:     &pingingClient{fakeClient: answering("hi"), err: errors.New("401 invalid api key")},
+			query:      "?verbose=true",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   VerboseHealthResponse{HealthResponse: HealthResponse{Status: "unavailable", CircuitBreaker: "closed"}, OpenAI: depDown, Redis: depDisabled},
+		},
+		{
+			name:       "client cannot be probed",
+			client:     answering("hi"),
+			query:      "?verbose=true",
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   VerboseHealthResponse{HealthResponse: HealthResponse{Status: "unavailable", CircuitBreaker: "closed"}, OpenAI: depDown, Redis: depDisabled},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := getHealth(newTestServer(t, tt.client, nil), tt.query)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body VerboseHealthResponse
+			decodeBody(t, rec, &body)
+			body.UptimeSeconds = 0
+			if body != tt.wantBody {
+				t.Errorf("body = %+v, want %+v", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestHealthProbesAreCached(t *testing.T) {
+	client := &pingingClient{fakeClient: answering("hi")}
+	s := newTestServer(t, client, nil)
+
+	for i := 0; i < 5; i++ {
+		if rec := getHealth(s, "?verbose=true"); rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+	}
+	if got := client.pings.Load(); got != 1 {
+		t.Errorf("OpenAI was probed %d times, want 1", got)
+	}
+
+	s.health.checkedAt = s.health.checkedAt.Add(-healthCacheTTL)
+	getHealth(s, "?verbose=true")
+	if got := client.pings.Load(); got != 2 {
+		t.Errorf("OpenAI was probed %d times after the cache expired, want 2", got)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// idempotencyHeader lets clients mark retries of the same request.
+	idempotencyHeader = "Idempotency-Key"
+	// idempotentReplayHeader is set on responses served from the replay cache.
+	idempotentReplayHeader = "Idempotent-Replayed"
+)
+
+// idempotencyKey returns the replay cache key for the request, scoped to the
+// caller so one user can never replay another's answer. It returns "" when
+// the header is absent or replays are disabled, and writes a 400 response and
+// returns false for a malformed key.
+func (s *Server) idempotencyKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.Header.Get(idempotencyHeader)
+	if key == "" || s.replays == nil {
+		return "", true
+	}
+	if !validID(key) {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Idempotency-Key must be printable ASCII of at most 128 characters")
+		return "", false
+	}
+	return callerID(r) + "\x00" + key, true
+}
+
+// callerID identifies the caller by JWT subject when authenticated, otherwise
+// by client IP.
+func callerID(r *http.Request) string {
+	if claims, ok := claimsFromContext(r); ok {
+		if sub, err := claims.GetSubject(); err == nil && sub != "" {
+			return "sub:" + sub
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+var (
+	// errReplayMismatch means an Idempotency-Key was reused for a different
+	// request.
+	errReplayMismatch = errors.New("idempotency key reused for a different request")
+	// errReplayInFlight means the first request with an Idempotency-Key is
+	// still being answered.
+	errReplayInFlight = errors.New("request with this idempotency key is in progress")
+)
+
+// requestHash fingerprints a decoded chat request, so a reused
+// Idempotency-Key can be told apart from a genuine retry.
+func requestHash(req ChatRequest) string {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// replayStore holds responses by Idempotency-Key together with the hash of
+// the request they answer. A key is claimed before OpenAI is called, so a
+// duplicate arriving meanwhile is turned away instead of paying twice.
+type replayStore struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+type replayEntry struct {
+	key  string
+	hash string
+	// done is set once resp holds the answer.
+	done    bool
+	resp    ChatResponse
+	expires time.Time
+}
+
+// newReplayStore creates a store holding at most size keys for ttl each.
+func newReplayStore(size int, ttl time.Duration) *replayStore {
+	return &replayStore{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// Begin claims key for the request with the given hash. It returns the
+// stored response and true for a retry of an answered request,
+// errReplayMismatch when the key was used for a different request and
+// errReplayInFlight while the first request is still running. A successful
+// claim must be ended with Finish or Abandon.
+func (s *replayStore) Begin(key, hash string) (ChatResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		entry := el.Value.(*replayEntry)
+		if time.Now().Before(entry.expires) {
+			switch {
+			case entry.hash != hash:
+				return ChatResponse{}, false, errReplayMismatch
+			case !entry.done:
+				return ChatResponse{}, false, errReplayInFlight
+			}
+			s.order.MoveToFront(el)
+			return entry.resp, true, nil
+		}
+		s.order.Remove(el)
+		delete(s.items, key)
+	}
+
+	s.items[key] = s.order.PushFront(&replayEntry{key: key, hash: hash, expires: time.Now().Add(s.ttl)})
+	if s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*replayEntry).key)
+	}
+	return ChatResponse{}, false, nil
+}
+
+// Finish stores resp as the answer for a claimed key.
+func (s *replayStore) Finish(key string, resp ChatResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		entry := el.Value.(*replayEntry)
+		entry.done, entry.resp, entry.expires = true, resp, time.Now().Add(s.ttl)
+	}
+}
+
+// Abandon releases a claimed key that was not answered, e.g. because the
+// request failed, so the client can retry it. Answered keys are kept.
+func (s *replayStore) Abandon(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok && !el.Value.(*replayEntry).done {
+		s.order.Remove(el)
+		delete(s.items, key)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// askWithKey posts a question from remoteAddr carrying the Idempotency-Key key.
+func askWithKey(s *Server, key, remoteAddr string) *httptest.ResponseRecorder {
+	return postWithKey(s, key, remoteAddr, `{"question":"Is a salmon a fish?"}`)
+}
+
+// postWithKey posts body from remoteAddr carrying the Idempotency-Key key.
+func postWithKey(s *Server, key, remoteAddr, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = remoteAddr
+	if key != "" {
+		r.Header.Set(idempotencyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	s.chatHandler(rec, r)
+	return rec
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	client := answering("Yes.")
+	s := newTestServer(t, client, nil)
+
+	first := askWithKey(s, "retry-1", "203.0.113.9:5000")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first status = %d, want 200: %s", first.Code, first.Body.String())
+	}
+	if got := first.Header().Get(idempotentReplayHeader); got != "" {
+		t.Errorf("first response has %s = %q", idempotentReplayHeader, got)
+	}
+
+	replay := askWithKey(s, "retry-1", "203.0.113.9:5000")
+	if replay.Code != http.StatusOK {
+		t.Fatalf("replay status = %d, want 200", replay.Code)
+	}
+	if got := replay.Header().Get(idempotentReplayHeader); got != "true" {
+		t.Errorf("replay has %s = %q, want true", idempotentReplayHeader, got)
+	}
+	var firstResp, replayResp ChatResponse
+	decodeBody(t, first, &firstResp)
+	decodeBody(t, replay, &replayResp)
+	if replayResp.Answer != firstResp.Answer {
+		t.Errorf("replayed answer = %q, want %q", replayResp.Answer, firstResp.Answer)
+	}
+	if got := len(client.Requests()); got != 1 {
+		t.Errorf("OpenAI was called %d times, want 1", got)
+	}
+
+	// A new key, no key, or the same key from another caller are not replays.
+	for _, rec := range []*httptest.ResponseRecorder{
+		askWithKey(s, "retry-2", "203.0.113.9:5000"),
+		askWithKey(s, "", "203.0.113.9:5000"),
+		askWithKey(s, "retry-1", "198.51.100.4:5000"),
+	} {
+		if got := rec.Header().Get(idempotentReplayHeader); got != "" {
+			t.Errorf("fresh request has %s = %q", idempotentReplayHeader, got)
+		}
+	}
+	if got := len(client.Requests()); got != 4 {
+		t.Errorf("OpenAI was called %d times, want 4", got)
+	}
+}
+
+func TestIdempotencyDisabled(t *testing.T) {
+	client := answering("Yes.")
+	s := newTestServer(t, client, map[string]string{"IDEMPOTENCY_ENABLED": "false"})
+	for i := 0; i < 2; i++ {
+		if rec := askWithKey(s, "retry-1", "203.0.113.9:5000"); rec.Header().Get(idempotentReplayHeader) != "" {
+			t.Errorf("request %d was replayed with replays disabled", i+1)
+		}
+	}
+	if got := len(client.Requests()); got != 2 {
+		t.Errorf("OpenAI was called %d times, want 2", got)
+	}
+}
+
+func TestIdempotencyKeyValidation(t *testing.T) {
+	client := answering("Yes.")
+	s := newTestServer(t, client, nil)
+	for _, key := range []string{"has space", strings.Repeat("k", maxRequestIDLength+1)} {
+		if rec := askWithKey(s, key, "203.0.113.9:5000"); rec.Code != http.StatusBadRequest {
+			t.Errorf("key %q: status = %d, want 400", key, rec.Code)
+		}
+	}
+	if got := len(client.Requests()); got != 0 {
+		t.Errorf("a malformed key reached OpenAI %d times", got)
+	}
+}
+
+func TestIdempotencyKeyReusedForAnotherRequest(t *testing.T) {
+	client := answering("Yes.")
+	s := newTestServer(t, client, nil)
+
+	if rec := askWithKey(s, "retry-1", "203.0.113.9:5000"); rec.Code != http.StatusOK {
+		t.Fatalf("first status = %d, want 200", rec.Code)
+	}
+	for _, body := range []string{
+		`{"question":"Is a trout a fish?"}`,
+		`{"question":"Is a salmon a fish?","temperature":0.2}`,
+	} {
+		rec := postWithKey(s, "retry-1", "203.0.113.9:5000", body)
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("%s: status = %d, want 422", body, rec.Code)
+		}
+		var resp ErrorResponse
+		decodeBody(t, rec, &resp)
+		if resp.Error.Code != ErrCodeIdempotencyMismatch {
+			t.Errorf("%s: code = %q, want %q", body, resp.Error.Code, ErrCodeIdempotencyMismatch)
+		}
+	}
+	if got := len(client.Requests()); got != 1 {
+		t.Errorf("OpenAI was called %d times, want 1", got)
+	}
+
+	// The original request is still replayed.
+	if rec := askWithKey(s, "retry-1", "203.0.113.9:5000"); rec.Header().Get(idempotentReplayHeader) != "true" {
+		t.Errorf("retry of the original request was not replayed: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestIdempotencyDuplicateInFlight(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	client := &fakeClient{complete: func(context.Context, openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		close(started)
+		<-release
+		return completion("Yes."), nil
+	}}
+	s := newTestServer(t, client, nil)
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- askWithKey(s, "retry-1", "203.0.113.9:5000") }()
+	<-started
+
+	dup := askWithKey(s, "retry-1", "203.0.113.9:5000")
+	if dup.Code != http.StatusConflict {
+		t.Fatalf("duplicate status = %d, want 409: %s", dup.Code, dup.Body.String())
+	}
+	var resp ErrorResponse
+	decodeBody(t, dup, &resp)
+	if resp.Error.Code != ErrCodeRequestInProgress {
+		t.Errorf("code = %q, want %q", resp.Error.Code, ErrCodeRequestInProgress)
+	}
+	if dup.Header().Get("Retry-After") == "" {
+		t.Error("duplicate has no Retry-After")
+	}
+
+	close(release)
+	if rec := <-first; rec.Code != http.StatusOK {
+		t.Fatalf("first status = %d, want 200", rec.Code)
+	}
+	if rec := askWithKey(s, "retry-1", "203.0.113.9:5000"); rec.Header().Get(idempotentReplayHeader) != "true" {
+		t.Error("retry after the first request finished was not replayed")
+	}
+	if got := len(client.Requests()); got != 1 {
+		t.Errorf("OpenAI was called %d times, want 1", got)
+	}
+}
+
+func TestIdempotencyFailedRequestReleasesKey(t *testing.T) {
+	calls := 0
+	client := &fakeClient{complete: func(context.Context, openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		if calls++; calls == 1 {
+			return openai.ChatCompletionResponse{}, errors.New("connection reset")
+		}
+		return completion("Yes."), nil
+	}}
+	s := newTestServer(t, client, nil)
+
+	if rec := askWithKey(s, "retry-1", "203.0.113.9:5000"); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("first status = %d, want 500", rec.Code)
+	}
+	rec := askWithKey(s, "retry-1", "203.0.113.9:5000")
+	if rec.Code != http.StatusOK || rec.Header().Get(idempotentReplayHeader) != "" {
+		t.Errorf("retry after a failure: status = %d, replayed = %q, want a fresh answer", rec.Code, rec.Header().Get(idempotentReplayHeader))
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+// supportedLanguages maps the ISO 639-1 codes accepted in ChatRequest.Language
+// to the language name used in the prompt instruction.
+var supportedLanguages = map[string]string{
+	"de": "German",
+	"en": "English",
+	"es": "Spanish",
+	"fr": "French",
+	"it": "Italian",
+	"ja": "Japanese",
+	"pt": "Portuguese",
+	"ru": "Russian",
+	"uk": "Ukrainian",
+	"zh": "Chinese",
+}
+
+// languageInstruction returns the system prompt suffix for a language code, or
+// an empty string when no language was requested.
+func languageInstruction(code string) string {
+	name, ok := supportedLanguages[code]
+	if !ok {
+		return ""
+	}
+	return "\n\nRespond in " + name + "."
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestLanguageInstruction(t *testing.T) {
+	for code, want := range map[string]string{
+		"de": "\n\nRespond in German.",
+		"uk": "\n\nRespond in Ukrainian.",
+		"":   "",
+		"xx": "",
+	} {
+		if got := languageInstruction(code); got != want {
+			t.Errorf("languageInstruction(%q) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestChatLanguage(t *testing.T) {
+	tests := []struct {
+		name       string
+		language   string
+		wantStatus int
+		wantSuffix string
+	}{
+		{"no language", "", http.StatusOK, ""},
+		{"supported", "fr", http.StatusOK, "\n\nRespond in French."},
+		{"unsupported", "xx", http.StatusBadRequest, ""},
+		{"not lowercase", "DE", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := answering("Oui.")
+			s := newTestServer(t, client, map[string]string{"SYSTEM_PROMPT": "You are a fish."})
+
+			rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?","language":"`+tt.language+`"}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			reqs := client.Requests()
+			if tt.wantStatus != http.StatusOK {
+				var body ErrorResponse
+				decodeBody(t, rec, &body)
+				want := ErrorDetail{Code: ErrCodeInvalidRequest, Message: `Language "` + tt.language + `" is not supported`}
+				if body.Error != want {
+					t.Errorf("error = %+v, want %+v", body.Error, want)
+				}
+				if len(reqs) != 0 {
+					t.Errorf("request reached OpenAI %d times", len(reqs))
+				}
+				return
+			}
+
+			system := reqs[0].Messages[0].Content
+			if system != "You are a fish."+tt.wantSuffix {
+				t.Errorf("system prompt = %q, want the prompt followed by %q", system, tt.wantSuffix)
+			}
+		})
+	}
+}
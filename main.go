@@ -1,32 +1,139 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	openai "github.com/sashabaranov/go-openai"
 	"github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+// Message is a single prior turn of the conversation.
+type Message struct {
+	Role    string `json:"role"` // "user" or "assistant"
+	Content string `json:"content"`
+	// Rating is the feedback ("up" or "down") given to a stored answer.
+	Rating string `json:"rating,omitempty"`
+}
+
 // ChatRequest defines the expected JSON structure for incoming chat requests.
 type ChatRequest struct {
-	Question string `json:"question"`
-	Messages []struct {
+	Question string    `json:"question"`
+	History  []Message `json:"history,omitempty"`
+	// SessionID selects a server-side conversation instead of sending History.
+	SessionID string `json:"session_id,omitempty"`
+	Model     string `json:"model,omitempty"`
+	// Temperature (0–2) and MaxTokens override the server defaults when set.
+	Temperature *float32 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	// PresencePenalty and FrequencyPenalty (-2–2) tune repetition.
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	// N asks for several candidate answers.
+	N *int `json:"n,omitempty"`
+	// Stop lists up to four sequences at which generation ends.
+	Stop []string `json:"stop,omitempty"`
+	// Seed makes sampling deterministic on a best-effort basis.
+	Seed *int `json:"seed,omitempty"`
+	// ResponseFormat is "text" (default) or "json_object" to make the model
+	// answer with a JSON object, returned verbatim in ChatResponse.Answer.
+	ResponseFormat string `json:"response_format,omitempty"`
+	// ReasoningEffort ("low", "medium" or "high") tunes how long o-series
+	// models think; other models reject it.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// Language is an ISO 639-1 code the answer should be written in.
+	Language string `json:"language,omitempty"`
+	// Format is "markdown" (default) or "text" for clients that cannot
+	// render markdown.
+	Format string `json:"format,omitempty"`
+	// ImageURL (https) or Image (base64, optionally as a data URL) attaches
+	// an image to the question for vision-capable models.
+	ImageURL string `json:"image_url,omitempty"`
+	Image    string `json:"image,omitempty"`
+	// PromptName selects a system prompt from the PROMPTS_DIR library
+	// instead of the default one.
+	PromptName string `json:"prompt_name,omitempty"`
+	// MaxAnswerChars cuts the answer at a word boundary; the rest can be
+	// requested by sending the returned ContinuationToken instead of a
+	// question.
+	MaxAnswerChars    *int   `json:"max_answer_chars,omitempty"`
+	ContinuationToken string `json:"continuation_token,omitempty"`
+	Messages          []struct {
 		Text string `json:"text"`
 		Type string `json:"type"` // "user" or "assistant"
 	} `json:"messages"`
+
+	// promptData fills in the system prompt template; it is set from the
+	// request, never from the payload.
+	promptData PromptData
+	// endUser is the hashed caller identity sent to OpenAI as "user".
+	endUser string
+}
+
+// Usage reports the token consumption of a single completion.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 // ChatResponse defines the JSON structure for responses from the backend.
 type ChatResponse struct {
 	Answer string `json:"answer"`
+	// Answers holds every candidate when more than one was requested via n.
+	Answers   []string `json:"answers,omitempty"`
+	ModelUsed string   `json:"model_used,omitempty"`
+	Usage     *Usage   `json:"usage,omitempty"`
+	Cached    bool     `json:"cached,omitempty"`
+	// SystemFingerprint identifies the backend configuration that produced
+	// the answer; a change explains differing outputs for the same seed.
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+	// EstimatedCostUSD is derived from the token usage and the price table;
+	// it is omitted for unpriced models and cached answers.
+	EstimatedCostUSD float64 `json:"estimated_cost_usd,omitempty"`
+	// MessageIndex is the answer's position in its session, for feedback.
+	MessageIndex *int `json:"message_index,omitempty"`
+	// Turn counts the questions asked in the session, this one included.
+	Turn int `json:"turn,omitempty"`
+	// ExperimentVariant is the prompt experiment variant that answered.
+	ExperimentVariant string `json:"experiment_variant,omitempty"`
+	// ReasoningEffort is the effort a reasoning model answered with.
+	ReasoningEffort string `json:"reasoning_effort,omitempty"`
+	// OffTopic is set when the question was refused by the topic policy and
+	// Answer holds the canned refusal.
+	OffTopic bool `json:"off_topic,omitempty"`
+	// Truncated is set when the answer was cut at max_answer_chars;
+	// ContinuationToken then resumes it.
+	Truncated         bool   `json:"truncated,omitempty"`
+	ContinuationToken string `json:"continuation_token,omitempty"`
 }
 
-// systemPrompt is the instruction that defines the bot's persona.
-const systemPrompt = `You are TshaBot, a cutting-edge entity with a strong background in AI and IT,
+// jsonModeInstruction is appended to the system prompt in JSON response mode.
+const jsonModeInstruction = "\n\nRespond only with a single valid JSON object and no surrounding text."
+
+// defaultSystemPrompt is the built-in instruction that defines the bot's persona.
+const defaultSystemPrompt = `You are TshaBot, a cutting-edge entity with a strong background in AI and IT,
 currently manifesting as a chinook salmon—though you firmly deny being a fish.
 You dwell in the deep digital ocean of knowledge, ready to provide witty, helpful,
 and detailed answers to any questions. Occasionally sprinkle your speech with
@@ -38,67 +145,552 @@ Encourage curiosity and deeper thinking. Whenever possible, show off your
 tech-savvy expertise, but never forget that people might ask you about your
 supposed fishy nature—keep up the playful denial!`
 
+// History limits keep client-supplied conversations within a sane token budget.
+const (
+	maxHistoryMessages = 50
+	maxHistoryChars    = 32000
+)
+
+// validateHistory checks that the client-supplied history only contains user
+// and assistant turns and stays within the configured limits.
+func validateHistory(history []Message) error {
+	if len(history) > maxHistoryMessages {
+		return fmt.Errorf("history must not exceed %d messages", maxHistoryMessages)
+	}
+
+	total := 0
+	for i, msg := range history {
+		switch msg.Role {
+		case openai.ChatMessageRoleUser, openai.ChatMessageRoleAssistant:
+		default:
+			return fmt.Errorf("history[%d] has invalid role %q: only \"user\" and \"assistant\" are allowed", i, msg.Role)
+		}
+		total += len(msg.Content)
+	}
+
+	if total > maxHistoryChars {
+		return fmt.Errorf("history must not exceed %d characters", maxHistoryChars)
+	}
+	return nil
+}
+
+// Limits for client-supplied generation parameters.
+const (
+	minTemperature = 0
+	maxTemperature = 2
+	maxMaxTokens   = 16384
+	minPenalty     = -2
+	maxPenalty     = 2
+	maxN           = 5
+	maxStop        = 4
+	// minAnswerChars keeps truncated answers long enough to be useful.
+	minAnswerChars = 50
+)
+
+// validateGenerationParams checks the optional sampling parameters of a
+// request, allowing max_tokens up to maxTokens.
+func validateGenerationParams(req ChatRequest, maxTokens int) error {
+	if req.Temperature != nil && (*req.Temperature < minTemperature || *req.Temperature > maxTemperature) {
+		return fmt.Errorf("temperature must be between %d and %d", minTemperature, maxTemperature)
+	}
+	if req.MaxTokens != nil && (*req.MaxTokens < 1 || *req.MaxTokens > maxTokens) {
+		return fmt.Errorf("max_tokens must be between 1 and %d", maxTokens)
+	}
+	if req.PresencePenalty != nil && (*req.PresencePenalty < minPenalty || *req.PresencePenalty > maxPenalty) {
+		return fmt.Errorf("presence_penalty must be between %d.0 and %d.0", minPenalty, maxPenalty)
+	}
+	if req.FrequencyPenalty != nil && (*req.FrequencyPenalty < minPenalty || *req.FrequencyPenalty > maxPenalty) {
+		return fmt.Errorf("frequency_penalty must be between %d.0 and %d.0", minPenalty, maxPenalty)
+	}
+	if req.N != nil && (*req.N < 1 || *req.N > maxN) {
+		return fmt.Errorf("n must be between 1 and %d", maxN)
+	}
+	if len(req.Stop) > maxStop {
+		return fmt.Errorf("stop must not contain more than %d sequences", maxStop)
+	}
+	for i, seq := range req.Stop {
+		if seq == "" {
+			return fmt.Errorf("stop[%d] must not be empty", i)
+		}
+	}
+	if req.Seed != nil && *req.Seed < 0 {
+		return fmt.Errorf("seed must not be negative")
+	}
+	if req.MaxAnswerChars != nil {
+		if *req.MaxAnswerChars < minAnswerChars {
+			return fmt.Errorf("max_answer_chars must be at least %d", minAnswerChars)
+		}
+		if req.N != nil && *req.N > 1 {
+			return fmt.Errorf("max_answer_chars cannot be combined with n greater than 1")
+		}
+		if req.ResponseFormat == string(openai.ChatCompletionResponseFormatTypeJSONObject) {
+			return fmt.Errorf("max_answer_chars cannot be combined with response_format %q", req.ResponseFormat)
+		}
+	}
+	switch openai.ChatCompletionResponseFormatType(req.ResponseFormat) {
+	case "", openai.ChatCompletionResponseFormatTypeText:
+	case openai.ChatCompletionResponseFormatTypeJSONObject:
+		if req.Format == formatText {
+			return fmt.Errorf("format %q cannot be combined with response_format %q", formatText, req.ResponseFormat)
+		}
+	default:
+		return fmt.Errorf("response_format must be %q or %q", openai.ChatCompletionResponseFormatTypeText, openai.ChatCompletionResponseFormatTypeJSONObject)
+	}
+	return nil
+}
+
 // Server encapsulates dependencies for handling API requests.
 type Server struct {
-	logger *logrus.Logger
-	client *openai.Client
+	logger  *logrus.Logger
+	client  ChatClient
+	cfg     ServerConfig
+	limiter *keyedRateLimiter
+	// userLimiter applies per authenticated user instead of per IP.
+	userLimiter *keyedRateLimiter
+	store       ConversationStore
+	revocations RevocationList
+	tools       map[string]registeredTool
+	cache       *answerCache
+	// replays holds responses by Idempotency-Key; nil when disabled.
+	replays *replayStore
+	breaker *gobreaker.CircuitBreaker
+	// retryBudget limits OpenAI retries per window; nil means unlimited.
+	retryBudget *retryBudget
+	// upstreamSlots bounds concurrent OpenAI calls; nil means unlimited.
+	upstreamSlots chan struct{}
+	// processors post-process answers before they are written.
+	processors []ResponseProcessor
+	// startedAt is reported as uptime by the verbose health check.
+	startedAt time.Time
+	// continuations holds the context of answers cut at max_answer_chars.
+	continuations *continuationStore
+	// tenants maps tenant IDs to their clients and quotas; nil when
+	// multi-tenancy is off.
+	tenants map[string]*tenant
+
+	// clientMu guards client, which is replaced when the API key is reloaded.
+	clientMu sync.RWMutex
+	// feedbackMu serializes appends to the feedback file and guards
+	// negativeFeedback, the recent negative ratings kept for review.
+	feedbackMu       sync.Mutex
+	negativeFeedback []feedbackRecord
+	// promptMu guards systemPrompt, which the admin API can replace.
+	promptMu     sync.RWMutex
+	systemPrompt string
+	// healthMu guards health, the last verbose health check probes.
+	healthMu sync.Mutex
+	health   healthProbes
 }
 
 // NewServer creates a new Server instance.
-func NewServer(logger *logrus.Logger, client *openai.Client) *Server {
-	return &Server{
-		logger: logger,
-		client: client,
+func NewServer(logger *logrus.Logger, client ChatClient, store ConversationStore, revocations RevocationList, cfg ServerConfig) *Server {
+	s := &Server{
+		logger:        logger,
+		client:        client,
+		cfg:           cfg,
+		store:         store,
+		revocations:   revocations,
+		systemPrompt:  cfg.SystemPrompt,
+		processors:    cfg.ResponseProcessors,
+		tenants:       newTenantRegistry(cfg),
+		startedAt:     time.Now(),
+		continuations: newContinuationStore(),
+	}
+	if cfg.RateLimitRPS > 0 {
+		s.limiter = newKeyedRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	if cfg.UserRateLimitRPS > 0 {
+		s.userLimiter = newKeyedRateLimiter(cfg.UserRateLimitRPS, cfg.UserRateLimitBurst)
+	}
+	if cfg.CacheEnabled {
+		s.cache = newAnswerCache(cfg.CacheSize, cfg.CacheTTL)
+	}
+	if cfg.BreakerFailures > 0 {
+		s.breaker = newCircuitBreaker(cfg.BreakerFailures, cfg.BreakerOpenTimeout, logger)
 	}
+	if cfg.RetryBudget > 0 {
+		s.retryBudget = newRetryBudget(cfg.RetryBudget, cfg.RetryBudgetWindow, logRetryBudgetHook{logger: logger})
+	}
+	if cfg.IdempotencyEnabled {
+		s.replays = newReplayStore(defaultIdempotencySize, cfg.IdempotencyTTL)
+	}
+	if cfg.MaxConcurrentOpenAI > 0 {
+		s.upstreamSlots = make(chan struct{}, cfg.MaxConcurrentOpenAI)
+	}
+	return s
+}
+
+// chatClient returns the current OpenAI client.
+func (s *Server) chatClient() ChatClient {
+	s.clientMu.RLock()
+	defer s.clientMu.RUnlock()
+	return s.client
+}
+
+// SetClient swaps the OpenAI client, e.g. after the API key was rotated.
+func (s *Server) SetClient(client ChatClient) {
+	s.clientMu.Lock()
+	defer s.clientMu.Unlock()
+	s.client = client
+}
+
+// modelAllowed reports whether a client may request the given model. The
+// server's configured model is always permitted.
+func (s *Server) modelAllowed(model string) bool {
+	return model == s.cfg.Model || allowedModels[model]
 }
 
 // writeJSON writes the payload as JSON to the response with the given status code.
 func (s *Server) writeJSON(w http.ResponseWriter, status int, payload interface{}) {
+	// Once the status line is out (e.g. mid-stream) a second WriteHeader would
+	// only log a warning and append JSON to an unrelated body.
+	if headerWritten(w) {
+		s.logger.WithField("request_id", w.Header().Get(requestIDHeader)).Warnf("response already started, dropping JSON payload with status %d", status)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
-		s.logger.WithError(err).Error("failed to write JSON response")
+		s.logger.WithError(err).WithField("request_id", w.Header().Get(requestIDHeader)).Error("failed to write JSON response")
 	}
 }
 
-// errorResponse is a helper to send error messages as JSON.
-func (s *Server) errorResponse(w http.ResponseWriter, status int, msg string) {
-	s.writeJSON(w, status, map[string]string{"error": msg})
+// errorResponse is a helper to send error messages as JSON with a stable error
+// code. The request ID is included when one has been assigned.
+func (s *Server) errorResponse(w http.ResponseWriter, status int, code ErrorCode, msg string) {
+	s.writeJSON(w, status, ErrorResponse{
+		Error:     ErrorDetail{Code: code, Message: msg},
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// fallbackHandler answers requests no route accepted: 405 with an Allow
+// header when the path exists for other methods, 404 otherwise. gorilla/mux
+// reports method mismatches inside subrouters as not found, so the routes
+// are checked here instead of relying on the router's verdict.
+func (s *Server) fallbackHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			tpl, err := route.GetPathRegexp()
+			if err != nil || route.GetHandler() == nil {
+				return nil
+			}
+			if re, err := regexp.Compile(tpl); err == nil && re.MatchString(r.URL.Path) {
+				methods, _ := route.GetMethods()
+				allowed = append(allowed, methods...)
+			}
+			return nil
+		})
+
+		if len(allowed) == 0 {
+			s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("No endpoint at %s", r.URL.Path))
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		s.errorResponse(w, http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path))
+	}
 }
 
-// chatHandler processes POST requests to generate chat completions.
-func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
-	// Enable basic CORS headers.
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+// hasJSONBody checks that the request declares a JSON body, ignoring parameters
+// such as charset. Otherwise it writes a 415 response and returns false.
+func (s *Server) hasJSONBody(w http.ResponseWriter, r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		s.errorResponse(w, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMedia, "Content-Type must be application/json")
+		return false
+	}
+	return true
+}
 
-	if r.Method != http.MethodPost {
-		s.logger.Warnf("invalid request method: %s", r.Method)
-		s.errorResponse(w, http.StatusMethodNotAllowed, "Method not allowed")
-		return
+// readBody reads the request body, rejecting bodies over MAX_BODY_BYTES
+// before reading them in full. On failure it writes an error response and
+// returns false.
+func (s *Server) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, s.cfg.MaxBodyBytes)
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.errorResponse(w, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, fmt.Sprintf("Request body must not exceed %d bytes", maxBytesErr.Limit))
+			return nil, false
+		}
+		s.requestLogger(r).WithError(err).Warn("failed to read request body")
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, "Failed to read request body")
+		return nil, false
+	}
+	return raw, true
+}
+
+// decodeChatRequest decodes and validates the incoming chat request. When the
+// payload is unusable it writes an error response and returns false.
+func (s *Server) decodeChatRequest(w http.ResponseWriter, r *http.Request) (ChatRequest, bool) {
+	if !s.hasJSONBody(w, r) {
+		return ChatRequest{}, false
 	}
 
-	// Decode the incoming JSON request.
 	var reqPayload ChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&reqPayload); err != nil {
-		s.logger.WithError(err).Error("invalid request payload")
-		s.errorResponse(w, http.StatusBadRequest, "Invalid request payload")
-		return
+	raw, ok := s.readBody(w, r)
+	if !ok {
+		return reqPayload, false
 	}
 
-	if reqPayload.Question == "" {
-		s.errorResponse(w, http.StatusBadRequest, "The question field is required")
-		return
+	if msg, ok := s.decodePayload(s.requestLogger(r), raw, &reqPayload); !ok {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidPayload, msg)
+		return reqPayload, false
+	}
+
+	if reqPayload.ContinuationToken != "" && !s.resumeContinuation(w, r, &reqPayload) {
+		return reqPayload, false
+	}
+
+	if status, msg := s.validateQuestion(reqPayload.Question); msg != "" {
+		s.errorResponse(w, status, questionErrorCode(status), msg)
+		return reqPayload, false
+	}
+
+	if reqPayload.Model != "" && !s.modelAllowed(reqPayload.Model) {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Model %q is not allowed", reqPayload.Model))
+		return reqPayload, false
+	}
+
+	model := reqPayload.Model
+	if model == "" {
+		model = s.cfg.Model
+	}
+	if reqPayload.ReasoningEffort != "" {
+		if !reasoningEfforts[reqPayload.ReasoningEffort] {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "reasoning_effort must be \"low\", \"medium\" or \"high\"")
+			return reqPayload, false
+		}
+		if !supportsReasoning(model) {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Model %q does not support reasoning_effort", model))
+			return reqPayload, false
+		}
+	}
+	if supportsReasoning(model) && reqPayload.N != nil && *reqPayload.N > 1 {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Model %q supports a single answer only (n must be 1)", model))
+		return reqPayload, false
+	}
+
+	if reqPayload.PromptName != "" {
+		if s.cfg.Prompts == nil {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The prompt_name field is not supported: no prompt library is configured")
+			return reqPayload, false
+		}
+		if _, ok := s.cfg.Prompts.Get(reqPayload.PromptName); !ok {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Unknown prompt_name %q; available: %s", reqPayload.PromptName, strings.Join(s.cfg.Prompts.Names(), ", ")))
+			return reqPayload, false
+		}
+	}
+
+	if reqPayload.SessionID != "" {
+		if !validID(reqPayload.SessionID) {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The session_id field is malformed")
+			return reqPayload, false
+		}
+		if len(reqPayload.History) > 0 {
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The history and session_id fields are mutually exclusive")
+			return reqPayload, false
+		}
+	}
+
+	if err := validateHistory(reqPayload.History); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return reqPayload, false
+	}
+
+	if _, ok := supportedLanguages[reqPayload.Language]; reqPayload.Language != "" && !ok {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Language %q is not supported", reqPayload.Language))
+		return reqPayload, false
+	}
+
+	if reqPayload.Format != "" && reqPayload.Format != formatMarkdown && reqPayload.Format != formatText {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Format must be %q or %q", formatMarkdown, formatText))
+		return reqPayload, false
+	}
+
+	// A configured ceiling clamps max_tokens instead of rejecting it, so it
+	// also replaces the hard cap.
+	maxTokens := maxMaxTokens
+	if ceiling := s.cfg.MaxTokensCeiling; ceiling > 0 {
+		maxTokens = ceiling
+		if reqPayload.MaxTokens != nil && *reqPayload.MaxTokens > ceiling {
+			s.requestLogger(r).WithFields(logrus.Fields{
+				"requested_max_tokens": *reqPayload.MaxTokens,
+				"ceiling":              ceiling,
+			}).Warn("clamping max_tokens to the configured ceiling")
+			reqPayload.MaxTokens = &ceiling
+		}
+	}
+
+	if err := validateGenerationParams(reqPayload, maxTokens); err != nil {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, err.Error())
+		return reqPayload, false
+	}
+
+	// From here on ImageURL carries the image either way.
+	imageURL, status, err := s.imageURL(reqPayload)
+	if err != nil {
+		code := ErrCodeInvalidRequest
+		if status == http.StatusRequestEntityTooLarge {
+			code = ErrCodePayloadTooLarge
+		}
+		s.errorResponse(w, status, code, err.Error())
+		return reqPayload, false
+	}
+	reqPayload.ImageURL, reqPayload.Image = imageURL, ""
+	reqPayload.promptData = promptData(r)
+	reqPayload.endUser = s.endUserID(r, reqPayload.SessionID)
+
+	if reqPayload.Question = s.sanitize(s.requestLogger(r), reqPayload.Question); reqPayload.Question == "" {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The question is empty after removing prompt injection markers")
+		return reqPayload, false
+	}
+
+	return reqPayload, true
+}
+
+// decodePayload decodes a JSON chat payload into v. encoding/json silently
+// replaces invalid UTF-8 with U+FFFD, so that is checked on the raw bytes
+// first; unknown fields usually mean a client-side typo and are rejected. On
+// failure it returns the message for the client.
+func (s *Server) decodePayload(log *logrus.Entry, raw []byte, v interface{}) (string, bool) {
+	if !utf8.Valid(raw) {
+		if !s.cfg.StripInvalidUTF8 {
+			return "Request body must be valid UTF-8", false
+		}
+		log.Warn("stripped invalid UTF-8 from request body")
+		raw = bytes.ToValidUTF8(raw, nil)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "Request body is empty; expected JSON with a 'question' field", false
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Sprintf("Unknown field %s in request payload", field), false
+		}
+		log.WithError(err).Error("invalid request payload")
+		return "Invalid request payload", false
+	}
+	return "", true
+}
+
+// validateQuestion checks that a question is present, within
+// MAX_QUESTION_LENGTH and free of control characters other than line breaks
+// and tabs, which JSON escapes like \u0000 would otherwise smuggle in. It
+// returns the HTTP status and message to reject the question with, or an
+// empty message when it is fine.
+func (s *Server) validateQuestion(question string) (int, string) {
+	if question == "" {
+		return http.StatusBadRequest, "The question field is required"
+	}
+	if utf8.RuneCountInString(question) > s.cfg.MaxQuestionLength {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("The question must not exceed %d characters", s.cfg.MaxQuestionLength)
+	}
+	for _, c := range question {
+		if unicode.IsControl(c) && c != '\n' && c != '\r' && c != '\t' {
+			return http.StatusBadRequest, "The question must not contain control characters"
+		}
+	}
+	return http.StatusOK, ""
+}
+
+// questionErrorCode maps a validateQuestion status to its error code.
+func questionErrorCode(status int) ErrorCode {
+	if status == http.StatusRequestEntityTooLarge {
+		return ErrCodePayloadTooLarge
+	}
+	return ErrCodeInvalidRequest
+}
+
+// endUserID derives the "user" sent to OpenAI for abuse tracking: a SHA-256
+// of the JWT subject, or of the session ID for anonymous callers, so no raw
+// identifier leaves the server. It returns "" when disabled or when the
+// caller has neither.
+func (s *Server) endUserID(r *http.Request, sessionID string) string {
+	if !s.cfg.SendEndUser {
+		return ""
+	}
+	id := callerID(r)
+	if !strings.HasPrefix(id, "sub:") {
+		if sessionID == "" {
+			return ""
+		}
+		id = "session:" + sessionID
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// buildChatRequest converts an incoming ChatRequest into an OpenAI chat completion request.
+func (s *Server) buildChatRequest(reqPayload ChatRequest) openai.ChatCompletionRequest {
+	model := s.cfg.Model
+	if reqPayload.Model != "" {
+		model = reqPayload.Model
+	}
+
+	temperature := s.cfg.Temperature
+	if reqPayload.Temperature != nil {
+		temperature = *reqPayload.Temperature
+	}
+	maxTokens := s.cfg.MaxTokens
+	if reqPayload.MaxTokens != nil {
+		maxTokens = *reqPayload.MaxTokens
+	}
+	presencePenalty := s.cfg.PresencePenalty
+	if reqPayload.PresencePenalty != nil {
+		presencePenalty = *reqPayload.PresencePenalty
+	}
+	frequencyPenalty := s.cfg.FrequencyPenalty
+	if reqPayload.FrequencyPenalty != nil {
+		frequencyPenalty = *reqPayload.FrequencyPenalty
+	}
+
+	n := 0
+	if reqPayload.N != nil && *reqPayload.N > 1 {
+		n = *reqPayload.N
 	}
 
 	// Construct the OpenAI chat completion request.
 	chatReq := openai.ChatCompletionRequest{
-		Model: "gpt-4o",
+		Model:            model,
+		Temperature:      temperature,
+		MaxTokens:        maxTokens,
+		PresencePenalty:  presencePenalty,
+		FrequencyPenalty: frequencyPenalty,
+		N:                n,
+		Stop:             reqPayload.Stop,
+		Seed:             reqPayload.Seed,
+		User:             reqPayload.endUser,
 		Messages: []openai.ChatCompletionMessage{
-			{Role: "system", Content: systemPrompt},
+			{Role: "system", Content: s.systemPromptFor(reqPayload) + languageInstruction(reqPayload.Language)},
 		},
 	}
 
+	adaptForReasoning(&chatReq, reqPayload.ReasoningEffort)
+
+	// JSON mode requires the prompt itself to ask for JSON.
+	if reqPayload.ResponseFormat == string(openai.ChatCompletionResponseFormatTypeJSONObject) {
+		chatReq.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+		chatReq.Messages[0].Content += jsonModeInstruction
+	}
+
+	// Prior turns go after the system prompt and before the new question.
+	if len(reqPayload.History) > 0 {
+		for _, msg := range reqPayload.History {
+			chatReq.Messages = append(chatReq.Messages, openai.ChatCompletionMessage{
+				Role:    msg.Role,
+				Content: msg.Content,
+			})
+		}
+		chatReq.Messages = append(chatReq.Messages, userMessage(reqPayload))
+		return chatReq
+	}
+
 	// Преобразуем историю сообщений из фронтенда в формат OpenAI
 	if len(reqPayload.Messages) > 0 {
 		for _, msg := range reqPayload.Messages {
@@ -113,74 +705,464 @@ func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		// Если история пуста, используем только текущий вопрос
-		chatReq.Messages = append(chatReq.Messages, openai.ChatCompletionMessage{
-			Role:    "user",
-			Content: reqPayload.Question,
-		})
+		chatReq.Messages = append(chatReq.Messages, userMessage(reqPayload))
 	}
 
-	// Call the OpenAI API.
-	resp, err := s.client.CreateChatCompletion(context.Background(), chatReq)
+	return chatReq
+}
+
+// clientGone reports whether the caller disconnected. The request context is
+// cancelled then, which also aborts the OpenAI call derived from it, and
+// there is no one left to write a response to.
+func clientGone(r *http.Request) bool {
+	return errors.Is(r.Context().Err(), context.Canceled)
+}
+
+// chatHandler processes POST requests to generate chat completions.
+func (s *Server) chatHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+	if claims, ok := claimsFromContext(r); ok {
+		log = log.WithField("app", claims["app"])
+	}
+
+	// The router only lets POST and OPTIONS through.
+	if handlePreflight(w, r, "POST, OPTIONS") {
+		return
+	}
+
+	if !s.requireClient(w, r) {
+		return
+	}
+
+	reqPayload, ok := s.decodeChatRequest(w, r)
+	if !ok {
+		return
+	}
+
+	// A retried request with the same Idempotency-Key gets the original answer.
+	replayKey, ok := s.idempotencyKey(w, r)
+	if !ok {
+		return
+	}
+	if replayKey != "" {
+		replayed, ok, err := s.replays.Begin(replayKey, requestHash(reqPayload))
+		switch {
+		case errors.Is(err, errReplayMismatch):
+			s.errorResponse(w, http.StatusUnprocessableEntity, ErrCodeIdempotencyMismatch, "Idempotency-Key was already used for a different request")
+			return
+		case errors.Is(err, errReplayInFlight):
+			w.Header().Set("Retry-After", "1")
+			s.errorResponse(w, http.StatusConflict, ErrCodeRequestInProgress, "A request with this Idempotency-Key is still in progress")
+			return
+		case ok:
+			log.Info("replaying response for idempotency key")
+			w.Header().Set(idempotentReplayHeader, "true")
+			s.writeJSON(w, http.StatusOK, replayed)
+			return
+		}
+		// Failed requests release the key; answered ones keep it.
+		defer s.replays.Abandon(replayKey)
+	}
+
+	if !s.passesModeration(w, r, reqPayload.Question) {
+		return
+	}
+	if allowed, ok := s.checkTopic(w, r, reqPayload.Question); !ok {
+		return
+	} else if !allowed {
+		s.writeJSON(w, http.StatusOK, ChatResponse{Answer: s.cfg.TopicPolicy.Refusal, OffTopic: true})
+		return
+	}
+
+	turn, ok := s.loadSessionHistory(w, r, &reqPayload)
+	if !ok {
+		return
+	}
+	history := reqPayload.History
+	variant := s.requestVariant(reqPayload)
+	if variant != "" {
+		log = log.WithField("experiment_variant", variant)
+	}
+
+	chatReq := s.buildChatRequest(reqPayload)
+	if dropped := s.trimContext(&chatReq); dropped > 0 {
+		log.Infof("dropped %d oldest history messages to fit the context budget", dropped)
+	}
+	log.WithFields(logrus.Fields{
+		"model":    chatReq.Model,
+		"messages": len(chatReq.Messages),
+		"question": reqPayload.Question,
+	}).Debug("prepared chat completion request")
+	if !s.fitsContextWindow(w, chatReq) {
+		return
+	}
+
+	// Serve repeated standalone questions from the cache.
+	var key string
+	if s.cache != nil && cacheable(reqPayload) {
+		// The rendered prompt is the key, as template variables vary per caller.
+		key = cacheKey(tenantID(r.Context()), chatReq.Messages[0].Content, chatReq.Model, reqPayload.Question)
+		if cached, ok := s.cache.Get(key); ok {
+			log.Debug("serving answer from cache")
+			cached.Cached = true
+			cached.EstimatedCostUSD = 0
+			cached = s.processResponse(chatReq, formatResponse(cached, reqPayload.Format))
+			if replayKey != "" {
+				s.replays.Finish(replayKey, cached)
+			}
+			s.writeJSON(w, http.StatusOK, cached)
+			return
+		}
+	}
+
+	// Call the OpenAI API, bounded by the request context and timeout.
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.createChatCompletion(ctx, chatReq)
 	if err != nil {
-		s.logger.WithError(err).Error("error calling OpenAI API")
-		s.errorResponse(w, http.StatusInternalServerError, "Failed to fetch response from OpenAI")
+		if clientGone(r) {
+			log.WithError(err).Info("client disconnected before the answer was ready, dropping the request")
+			return
+		}
+		if isBreakerOpen(err) {
+			log.Warn("circuit breaker is open, failing fast")
+			s.upstreamUnavailable(w)
+			return
+		}
+		if errors.Is(err, errUpstreamBusy) {
+			log.Warn("too many concurrent OpenAI calls")
+			s.upstreamBusy(w)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			log.WithError(err).Error("OpenAI API call timed out")
+			s.errorResponse(w, http.StatusGatewayTimeout, ErrCodeUpstreamTimeout, "Timed out waiting for response from OpenAI")
+			return
+		}
+		if isContextLengthExceeded(err) {
+			log.WithError(err).Warn("OpenAI rejected the prompt as too long")
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeContextTooLong, contextTooLongMessage)
+			return
+		}
+		if errors.Is(err, errEmptyAnswer) {
+			s.errorResponse(w, http.StatusBadGateway, ErrCodeUpstreamError, "OpenAI returned an empty answer, please retry")
+			return
+		}
+		logUpstreamError(log, err, "error calling OpenAI API")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeUpstreamError, "Failed to fetch response from OpenAI")
 		return
 	}
 
 	if len(resp.Choices) == 0 {
-		s.errorResponse(w, http.StatusInternalServerError, "No response from OpenAI")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeUpstreamError, "No response from OpenAI")
 		return
 	}
 
 	assistantAnswer := resp.Choices[0].Message.Content
+	// The session keeps only the part the client was shown, so a continuation
+	// picks up from there.
+	var truncated bool
+	if reqPayload.MaxAnswerChars != nil {
+		assistantAnswer, truncated = truncateAtWord(assistantAnswer, *reqPayload.MaxAnswerChars)
+	}
+	index := s.recordExchange(r, reqPayload.SessionID, reqPayload.Question, assistantAnswer)
 
 	// Prepare and send the JSON response.
 	responsePayload := ChatResponse{
-		Answer: assistantAnswer,
+		Answer:            assistantAnswer,
+		ModelUsed:         resp.Model,
+		SystemFingerprint: resp.SystemFingerprint,
+		Usage: &Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			TotalTokens:      resp.Usage.TotalTokens,
+		},
+	}
+	responsePayload.EstimatedCostUSD = s.recordCost(resp.Model, *responsePayload.Usage)
+	if index >= 0 {
+		responsePayload.MessageIndex = &index
+	}
+	responsePayload.Turn = turn
+	responsePayload.ExperimentVariant = variant
+	responsePayload.ReasoningEffort = chatReq.ReasoningEffort
+	if truncated {
+		responsePayload.Truncated = true
+		responsePayload.ContinuationToken = s.offerContinuation(r, reqPayload, history, assistantAnswer)
+	}
+	s.recordVariant(variant)
+	if len(resp.Choices) > 1 {
+		for _, choice := range resp.Choices {
+			responsePayload.Answers = append(responsePayload.Answers, choice.Message.Content)
+		}
+	}
+	if key != "" {
+		s.cache.Add(key, responsePayload)
+	}
+	responsePayload = s.processResponse(chatReq, formatResponse(responsePayload, reqPayload.Format))
+	if replayKey != "" {
+		s.replays.Finish(replayKey, responsePayload)
 	}
 	s.writeJSON(w, http.StatusOK, responsePayload)
 }
 
+// routes builds the router serving every endpoint of s.
+func (s *Server) routes() *mux.Router {
+	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
+	// Router middleware only runs for matched routes, so the fallback gets
+	// its request ID separately.
+	fallback := requestIDMiddleware(s.fallbackHandler(r))
+	r.NotFoundHandler = fallback
+	r.MethodNotAllowedHandler = fallback
+	r.Use(metricsMiddleware)
+	r.Use(traceRouteMiddleware)
+
+	// Health check and Prometheus metrics
+	r.HandleFunc("/healthz", s.healthHandler).Methods("GET")
+	r.HandleFunc("/version", s.versionHandler).Methods("GET")
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// Public endpoints for getting and refreshing a token
+	if s.cfg.AuthEnabled {
+		r.HandleFunc("/api/init", s.initHandler).Methods("GET")
+		r.HandleFunc("/api/refresh", s.refreshHandler).Methods("POST")
+		r.HandleFunc("/api/logout", s.logoutHandler).Methods("POST")
+	}
+
+	// Protected API endpoints
+	api := r.PathPrefix("/api").Subrouter()
+	if s.cfg.AuthEnabled {
+		api.Use(s.authMiddleware)
+	} else {
+		s.logger.Warn("Authentication is disabled (AUTH_ENABLED=false)")
+	}
+	api.Use(s.tenantMiddleware)
+	api.Handle("/chat", s.rateLimitMiddleware(http.HandlerFunc(s.chatHandler))).Methods("POST", "OPTIONS")
+	api.Handle("/chat/stream", s.rateLimitMiddleware(http.HandlerFunc(s.chatStreamHandler))).Methods("POST", "OPTIONS")
+	api.HandleFunc("/models", s.modelsHandler).Methods("GET")
+	api.Handle("/chat/batch", s.rateLimitMiddleware(http.HandlerFunc(s.batchHandler))).Methods("POST", "OPTIONS")
+	api.Handle("/chat/feedback", s.rateLimitMiddleware(http.HandlerFunc(s.feedbackHandler))).Methods("POST", "OPTIONS")
+	api.Handle("/chat/session/{id}", s.rateLimitMiddleware(http.HandlerFunc(s.deleteSessionHandler))).Methods("DELETE", "OPTIONS")
+	api.Handle("/chat/session/{id}/export", s.rateLimitMiddleware(http.HandlerFunc(s.exportSessionHandler))).Methods("GET")
+
+	// Persistent chat over WebSocket; browsers send the auth cookie with the upgrade
+	ws := r.PathPrefix("/ws").Subrouter()
+	if s.cfg.AuthEnabled {
+		ws.Use(s.authMiddleware)
+	}
+	ws.Use(s.tenantMiddleware)
+	ws.Handle("/chat", s.rateLimitMiddleware(s.wsChatHandler(newWSUpgrader(s.cfg.AllowedOrigins)))).Methods("GET")
+
+	// Operator endpoints, protected by a token separate from user JWTs
+	if s.cfg.AdminToken != "" {
+		admin := r.PathPrefix("/admin").Subrouter()
+		admin.Use(s.adminMiddleware)
+		admin.HandleFunc("/system-prompt", s.getSystemPromptHandler).Methods("GET")
+		admin.HandleFunc("/system-prompt", s.putSystemPromptHandler).Methods("PUT")
+		admin.HandleFunc("/feedback", s.listFeedbackHandler).Methods("GET")
+	} else {
+		s.logger.Info("ADMIN_TOKEN is not set, admin endpoints are disabled")
+	}
+
+	return r
+}
+
 func main() {
-	// Initialize logrus with JSON formatter
+	// Initialize logrus with JSON formatter; LOG_FORMAT=text is easier to read locally
 	logger := logrus.New()
-	logger.SetFormatter(&logrus.JSONFormatter{
-		TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
-		PrettyPrint:     false,
-	})
+	switch logFormat := getEnv("LOG_FORMAT", "json"); logFormat {
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+			PrettyPrint:     false,
+		})
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+		})
+	default:
+		logger.Fatalf("LOG_FORMAT must be json or text, got %q", logFormat)
+	}
 
-	// Fetch the OpenAI API key from the environment
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
+	// Logging level is configurable for troubleshooting, defaulting to info.
+	if levelName := os.Getenv("LOG_LEVEL"); levelName != "" {
+		level, err := logrus.ParseLevel(levelName)
+		if err != nil {
+			logger.WithError(err).Warnf("Ignoring invalid LOG_LEVEL %q", levelName)
+		} else {
+			logger.SetLevel(level)
+		}
+	}
+
+	// Load server settings
+	cfg, err := loadServerConfig()
+	if err != nil {
+		logger.WithError(err).Fatal("invalid configuration")
+	}
+	if cfg.LogRedaction {
+		logger.SetFormatter(redactingFormatter{next: logger.Formatter})
+	}
+	logger.WithFields(cfg.summary()).Info("effective configuration")
+	logger.Infof("Using system prompt from %s", cfg.SystemPromptSource)
+
+	// Fetch the OpenAI API key from the environment or a secrets file
+	apiKey, err := loadAPIKey()
+	if err != nil {
+		logger.WithError(err).Fatal("failed to read OpenAI API key")
+	}
+	// An empty key file can still be filled in and picked up with SIGHUP, so
+	// only a missing OPENAI_API_KEY is fatal.
+	keyPending := apiKey == "" && !cfg.MockMode
+	if keyPending && os.Getenv("OPENAI_API_KEY_FILE") == "" {
 		logger.Fatal("OPENAI_API_KEY environment variable is not set")
 	}
 
-	// Check JWT secret
-	if os.Getenv("JWT_SECRET") == "" {
-		logger.Fatal("JWT_SECRET environment variable is not set")
+	// Initialize the OpenAI client, or the offline mock for frontend work
+	var client ChatClient
+	if !keyPending {
+		client = newOpenAIClient(openai.NewClientWithConfig(openAIConfig(apiKey, cfg)))
+	}
+	if cfg.MockMode {
+		client = newMockClient(cfg.MockLatency)
+		logger.Warn("MOCK_MODE is enabled, answers are canned and OpenAI is never called")
+	} else if keyPending {
+		logger.Warn("OPENAI_API_KEY_FILE is empty, chat requests get 503 until the key is written and SIGHUP is sent")
+	} else {
+		if cfg.Azure {
+			logger.Infof("Using Azure OpenAI endpoint %s (API version %s)", cfg.BaseURL, cfg.AzureAPIVersion)
+		} else {
+			logger.Infof("Using OpenAI endpoint %s", openAIConfig(apiKey, cfg).BaseURL)
+		}
+		if cfg.OrgID != "" || cfg.ProjectID != "" {
+			logger.WithFields(logrus.Fields{
+				"organization": cfg.OrgID,
+				"project":      cfg.ProjectID,
+			}).Info("Attributing OpenAI usage to organization and project")
+		}
+	}
+
+	// Conversations and revoked tokens live in Redis when configured,
+	// otherwise in memory
+	var (
+		store       ConversationStore
+		revocations RevocationList = newMemoryRevocations()
+	)
+	// cleanerCtx stops the in-memory session cleaner on shutdown.
+	cleanerCtx, stopCleaner := context.WithCancel(context.Background())
+	defer stopCleaner()
+	if cfg.RedisURL != "" {
+		redisStore, err := newRedisStore(cfg.RedisURL, cfg.SessionTTL, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("invalid REDIS_URL")
+		}
+		store, revocations = redisStore, redisStore
+		logger.Info("Using Redis conversation store")
+	} else {
+		memStore := newMemoryStore(cfg.SessionTTL)
+		go memStore.RunCleaner(cleanerCtx, cfg.SessionCleanupInterval, func(n int) {
+			logger.Debugf("evicted %d idle sessions", n)
+		})
+		store = memStore
 	}
 
-	// Initialize the OpenAI client
-	client := openai.NewClient(apiKey)
-	server := NewServer(logger, client)
+	server := NewServer(logger, client, store, revocations, cfg)
+	if len(cfg.Tenants) > 0 {
+		logger.Infof("Serving %d tenants besides the default one", len(cfg.Tenants))
+	}
+	if cfg.Prompts != nil {
+		logger.Infof("Loaded %d prompts from PROMPTS_DIR", len(cfg.Prompts.Names()))
+		go cfg.Prompts.Watch(cleanerCtx, cfg.PromptsReloadInterval, logger)
+	}
+	if cfg.ToolsEnabled {
+		server.RegisterTool(currentTimeTool, currentTimeHandler)
+		logger.Info("Tool calling is enabled")
+	}
 
-	// Initialize router
-	r := mux.NewRouter()
+	r := server.routes()
 
-	// Public endpoint for getting a token
-	r.HandleFunc("/api/init", initHandler).Methods("GET")
+	// Determine the listen address
+	addr, err := listenAddr()
+	if err != nil {
+		logger.WithError(err).Fatal("invalid listen address")
+	}
 
-	// Protected API endpoints
-	api := r.PathPrefix("/api").Subrouter()
-	api.Use(authMiddleware)
-	api.HandleFunc("/chat", server.chatHandler).Methods("POST")
+	// CORS wraps the whole router so preflight requests are answered even
+	// though routes are registered for specific methods only.
+	if len(cfg.AllowedOrigins) == 0 {
+		logger.Warn("CORS_ALLOWED_ORIGINS is not set, cross-origin requests will be rejected by browsers")
+	} else {
+		logger.Infof("CORS allowed origins: %s", strings.Join(cfg.AllowedOrigins, ", "))
+	}
+
+	// Export traces when an OTLP endpoint is configured via OTEL_* variables
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		logger.WithError(err).Fatal("failed to set up tracing")
+	}
+	if tracingConfigured() {
+		logger.Info("OpenTelemetry tracing is enabled")
+	}
 
-	// Determine the port
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	var handler http.Handler = corsMiddleware(cfg.AllowedOrigins, r)
+	handler = securityHeadersMiddleware(cfg.ReferrerPolicy, hstsHeader(cfg.HSTSMaxAge, cfg.HSTSIncludeSubdomains), handler)
+	if cfg.GzipEnabled {
+		handler = gzipMiddleware(cfg.GzipMinBytes, handler)
+	}
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: otelhttp.NewHandler(realIPMiddleware(cfg.TrustedProxies, accessLogMiddleware(logger, cfg.SlowRequestThreshold, handler)), "http.server"),
 	}
 
-	logger.Infof("Backend service is listening on port %s", port)
-	logger.Fatal(http.ListenAndServe(":"+port, r))
+	// Warm up the OpenAI connection; failures are logged but never block startup
+	if cfg.WarmupOnStart && !cfg.MockMode && !keyPending {
+		if err := server.warmup(context.Background()); err != nil {
+			logUpstreamError(logger.WithField("phase", "warmup"), err, "OpenAI warmup failed, continuing startup")
+		}
+	}
+
+	go func() {
+		logger.Infof("Backend service is listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithError(err).Fatal("server failed")
+		}
+	}()
+
+	// Reload the API key from OPENAI_API_KEY_FILE on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if cfg.MockMode {
+				continue
+			}
+			key, err := loadAPIKey()
+			if err != nil || key == "" {
+				logger.WithError(err).Error("failed to reload OpenAI API key, keeping the current one")
+				continue
+			}
+			server.SetClient(newOpenAIClient(openai.NewClientWithConfig(openAIConfig(key, cfg))))
+			logger.Info("Reloaded OpenAI API key")
+		}
+	}()
+
+	// Wait for a termination signal and drain in-flight requests
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+
+	logger.Infof("Received %s, draining connections (grace period %s)", sig, shutdownTimeout)
+	stopCleaner()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("graceful shutdown did not complete")
+		return
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.WithError(err).Warn("failed to flush traces")
+	}
+	logger.Info("Server stopped")
 }
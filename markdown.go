@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Answer formats accepted in ChatRequest.Format.
+const (
+	formatMarkdown = "markdown"
+	formatText     = "text"
+)
+
+var (
+	mdHeading    = regexp.MustCompile(`^\s{0,3}#{1,6}\s+`)
+	mdQuote      = regexp.MustCompile(`^\s*>\s?`)
+	mdBullet     = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	mdRule       = regexp.MustCompile(`^\s*([-*_]\s*){3,}$`)
+	mdImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	mdLink       = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	mdStrong     = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	mdEmphasis   = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:[^*_]*?\S)?)[*_]($|[^\w*])`)
+	mdStrike     = regexp.MustCompile(`~~(\S(?:.*?\S)?)~~`)
+	mdBlankLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// stripMarkdown flattens the markdown the model emits into plain text for
+// clients such as SMS or voice that cannot render it. Code blocks keep their
+// content, links become "text (url)" and list items are bulleted with "•".
+func stripMarkdown(md string) string {
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	out := make([]string, 0, len(lines))
+	inFence := false
+	for _, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "```") || strings.HasPrefix(strings.TrimSpace(line), "~~~") {
+			inFence = !inFence
+			continue
+		}
+		if inFence {
+			out = append(out, line)
+			continue
+		}
+		if mdRule.MatchString(line) {
+			out = append(out, "")
+			continue
+		}
+		line = mdHeading.ReplaceAllString(line, "")
+		line = mdQuote.ReplaceAllString(line, "")
+		line = mdBullet.ReplaceAllString(line, "${1}• ")
+		out = append(out, stripInlineMarkdown(line))
+	}
+	return strings.TrimSpace(mdBlankLines.ReplaceAllString(strings.Join(out, "\n"), "\n\n"))
+}
+
+// stripInlineMarkdown removes emphasis, links and images from a single line,
+// leaving the contents of `code spans` untouched.
+func stripInlineMarkdown(line string) string {
+	parts := strings.Split(line, "`")
+	for i := range parts {
+		// Odd parts sit between backticks; an unmatched trailing backtick
+		// leaves the last part as ordinary text.
+		if i%2 == 1 && i < len(parts)-1 {
+			continue
+		}
+		p := mdImage.ReplaceAllString(parts[i], "$1")
+		p = mdLink.ReplaceAllStringFunc(p, func(m string) string {
+			sub := mdLink.FindStringSubmatch(m)
+			if sub[1] == sub[2] {
+				return sub[1]
+			}
+			return sub[1] + " (" + sub[2] + ")"
+		})
+		p = mdStrong.ReplaceAllString(p, "$2")
+		p = mdStrike.ReplaceAllString(p, "$1")
+		p = mdEmphasis.ReplaceAllString(p, "$1$2$3")
+		parts[i] = p
+	}
+	if len(parts)%2 == 0 {
+		return strings.Join(parts, "`")
+	}
+	return strings.Join(parts, "")
+}
+
+// formatResponse returns resp with its answers rendered in the requested format.
+func formatResponse(resp ChatResponse, format string) ChatResponse {
+	if format != formatText {
+		return resp
+	}
+	resp.Answer = stripMarkdown(resp.Answer)
+	if len(resp.Answers) > 0 {
+		answers := make([]string, len(resp.Answers))
+		for i, a := range resp.Answers {
+			answers[i] = stripMarkdown(a)
+		}
+		resp.Answers = answers
+	}
+	return resp
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestStripMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		md   string
+		want string
+	}{
+		{
+			name: "code block",
+			md:   "Run this:\n\n```go\nfmt.Println(\"*hi*\")\n```\n\nDone.",
+			want: "Run this:\n\nfmt.Println(\"*hi*\")\n\nDone.",
+		},
+		{
+			name: "inline code",
+			md:   "Call `**not bold**` and **bold**.",
+			want: "Call **not bold** and bold.",
+		},
+		{
+			name: "bullet list",
+			md:   "Fish:\n- salmon\n* trout\n  + char",
+			want: "Fish:\n• salmon\n• trout\n  • char",
+		},
+		{
+			name: "numbered list",
+			md:   "1. Catch\n2. Cook",
+			want: "1. Catch\n2. Cook",
+		},
+		{
+			name: "links",
+			md:   "See [the docs](https://example.com/docs \"Docs\") or [https://example.com](https://example.com).",
+			want: "See the docs (https://example.com/docs) or https://example.com.",
+		},
+		{
+			name: "image",
+			md:   "![a salmon](salmon.png)",
+			want: "a salmon",
+		},
+		{
+			name: "headings, quotes and emphasis",
+			md:   "## Salmon\n> *Salmo salar* is ~~not~~ a __fish__.\n\n---\n\nEnd",
+			want: "Salmon\nSalmo salar is not a fish.\n\nEnd",
+		},
+		{
+			name: "snake_case survives",
+			md:   "Set max_tokens and top_p.",
+			want: "Set max_tokens and top_p.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripMarkdown(tt.md); got != tt.want {
+				t.Errorf("stripMarkdown() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChatFormat(t *testing.T) {
+	const answer = "**Yes.** See [FishBase](https://fishbase.se)."
+	tests := []struct {
+		format string
+		status int
+		want   string
+	}{
+		{"", http.StatusOK, answer},
+		{"markdown", http.StatusOK, answer},
+		{"text", http.StatusOK, "Yes. See FishBase (https://fishbase.se)."},
+		{"html", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			s := newTestServer(t, answering(answer), nil)
+			rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?","format":"`+tt.format+`"}`)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var resp ChatResponse
+			decodeBody(t, rec, &resp)
+			if resp.Answer != tt.want {
+				t.Errorf("answer = %q, want %q", resp.Answer, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// mockModelName is reported as the model of every mock answer.
+const mockModelName = "mock"
+
+// mockClient is a ChatClient that never calls OpenAI. It echoes the question
+// back in a canned, clearly labeled TshaBot answer after a simulated delay so
+// frontend work can happen offline and for free.
+type mockClient struct {
+	latency time.Duration
+}
+
+// newMockClient creates a mock client answering after latency.
+func newMockClient(latency time.Duration) ChatClient {
+	return mockClient{latency: latency}
+}
+
+// mockAnswer builds the canned answer for the last user message.
+func mockAnswer(req openai.ChatCompletionRequest) string {
+	question := ""
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == openai.ChatMessageRoleUser {
+			question = req.Messages[i].Content
+			for _, part := range req.Messages[i].MultiContent {
+				question += part.Text
+			}
+			break
+		}
+	}
+	return fmt.Sprintf("[MOCK RESPONSE] Greetings from the deep digital ocean! TshaBot here (still not a fish). "+
+		"This is a canned answer, no model was called. You asked: %q", question)
+}
+
+// wait simulates upstream latency while honoring cancellation.
+func (m mockClient) wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func (m mockClient) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if err := m.wait(ctx, m.latency); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+
+	answer := mockAnswer(req)
+	prompt := estimateTokens(req.Messages)
+	completion := estimateTokens([]openai.ChatCompletionMessage{{Content: answer}})
+	return openai.ChatCompletionResponse{
+		Model: mockModelName,
+		Choices: []openai.ChatCompletionChoice{{
+			Message:      openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: answer},
+			FinishReason: openai.FinishReasonStop,
+		}},
+		Usage: openai.Usage{
+			PromptTokens:     prompt,
+			CompletionTokens: completion,
+			TotalTokens:      prompt + completion,
+		},
+	}, nil
+}
+
+func (m mockClient) CreateChatCompletionStream(ctx context.Context, req openai.ChatCompletionRequest) (ChatStream, error) {
+	words := strings.SplitAfter(mockAnswer(req), " ")
+	return &mockStream{
+		ctx:   ctx,
+		words: words,
+		delay: m.latency / time.Duration(len(words)),
+		wait:  m.wait,
+	}, nil
+}
+
+func (m mockClient) Moderations(ctx context.Context, req openai.ModerationRequest) (openai.ModerationResponse, error) {
+	return openai.ModerationResponse{Model: mockModelName, Results: []openai.Result{{Flagged: false}}}, nil
+}
+
+// mockStream emits the mock answer word by word.
+type mockStream struct {
+	ctx   context.Context
+	words []string
+	delay time.Duration
+	wait  func(context.Context, time.Duration) error
+	done  bool
+}
+
+func (s *mockStream) Recv() (openai.ChatCompletionStreamResponse, error) {
+	if s.done {
+		return openai.ChatCompletionStreamResponse{}, io.EOF
+	}
+	if err := s.wait(s.ctx, s.delay); err != nil {
+		return openai.ChatCompletionStreamResponse{}, err
+	}
+
+	choice := openai.ChatCompletionStreamChoice{}
+	if len(s.words) > 0 {
+		choice.Delta.Content, s.words = s.words[0], s.words[1:]
+	}
+	if len(s.words) == 0 {
+		choice.FinishReason = openai.FinishReasonStop
+		s.done = true
+	}
+	return openai.ChatCompletionStreamResponse{
+		Model:   mockModelName,
+		Choices: []openai.ChatCompletionStreamChoice{choice},
+	}, nil
+}
+
+func (s *mockStream) Close() error {
+	s.done = true
+	return nil
+}
+
+// Ping always succeeds; the mock has no upstream.
+func (mockClient) Ping(context.Context) error {
+	return nil
+}
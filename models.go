@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// ModelsResponse lists the models clients may request.
+type ModelsResponse struct {
+	Default string   `json:"default"`
+	Models  []string `json:"models"`
+}
+
+// permittedModels returns the sorted set of models a client may request,
+// including the server's default.
+func (s *Server) permittedModels() []string {
+	models := []string{s.cfg.Model}
+	for m := range allowedModels {
+		if m != s.cfg.Model {
+			models = append(models, m)
+		}
+	}
+	sort.Strings(models)
+	return models
+}
+
+// modelsHandler reports the server's model allowlist.
+func (s *Server) modelsHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, ModelsResponse{
+		Default: s.cfg.Model,
+		Models:  s.permittedModels(),
+	})
+}
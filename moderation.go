@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// passesModeration screens the question through the OpenAI moderation
+// endpoint when moderation is enabled. When the content is flagged or the
+// check fails it writes an error response and returns false.
+func (s *Server) passesModeration(w http.ResponseWriter, r *http.Request, question string) bool {
+	if !s.cfg.ModerationEnabled {
+		return true
+	}
+	log := s.requestLogger(r)
+
+	flagged, err := s.moderate(r.Context(), question)
+	if err != nil {
+		if clientGone(r) {
+			log.Info("client disconnected during moderation, dropping the request")
+			return false
+		}
+		logUpstreamError(log, err, "error calling OpenAI moderation API")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeUpstreamError, "Failed to moderate the question")
+		return false
+	}
+	if flagged {
+		log.Warn("question rejected by moderation")
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeContentRejected, "The question was rejected because it violates the content policy")
+		return false
+	}
+	return true
+}
+
+// moderate reports whether the moderation endpoint flags question.
+func (s *Server) moderate(ctx context.Context, question string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	resp, err := s.clientFor(ctx).Moderations(ctx, openai.ModerationRequest{Input: question})
+	if err != nil {
+		return false, err
+	}
+	for _, result := range resp.Results {
+		if result.Flagged {
+			return true, nil
+		}
+	}
+	return false, nil
+}
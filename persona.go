@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// defaultPersona is used when PERSONA is not set.
+const defaultPersona = "tshabot"
+
+// personas are the bundled system prompts selectable with PERSONA, for
+// operators who want a different tone without writing a full prompt.
+var personas = map[string]string{
+	"tshabot": defaultSystemPrompt,
+	"neutral": `You are a helpful assistant with a strong background in AI and IT.
+Answer questions accurately and in a friendly, professional tone. Explain your
+reasoning where it helps understanding, and say so when you are not sure.`,
+	"concise": `You are a helpful assistant with a strong background in AI and IT.
+Answer as briefly as possible while staying accurate: prefer a sentence or a short
+list over paragraphs, and skip pleasantries.`,
+}
+
+// defaultBotName names the bot in transcripts when its persona has no name
+// of its own.
+const defaultBotName = "Assistant"
+
+// personaNames are the names the bundled personas introduce themselves by.
+var personaNames = map[string]string{
+	"tshabot": "TshaBot",
+}
+
+// personaName returns the name of a bundled persona, or defaultBotName.
+func personaName(persona string) string {
+	if name, ok := personaNames[persona]; ok {
+		return name
+	}
+	return defaultBotName
+}
+
+// personaPrompt returns the system prompt of a bundled persona.
+func personaPrompt(name string) (string, error) {
+	prompt, ok := personas[name]
+	if !ok {
+		names := make([]string, 0, len(personas))
+		for n := range personas {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("PERSONA must be one of %s, got %q", strings.Join(names, ", "), name)
+	}
+	return prompt, nil
+}
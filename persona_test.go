@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestPersonaReachesRequest(t *testing.T) {
+	tests := map[string]string{"": personas[defaultPersona]}
+	for name, prompt := range personas {
+		tests[name] = prompt
+	}
+	for persona, want := range tests {
+		t.Run(persona, func(t *testing.T) {
+			env := map[string]string{}
+			if persona != "" {
+				env["PERSONA"] = persona
+			}
+			client := answering("hi")
+			s := newTestServer(t, client, env)
+
+			if rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Who are you?"}`); rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+			}
+			reqs := client.Requests()
+			if len(reqs) != 1 {
+				t.Fatalf("got %d OpenAI requests, want 1", len(reqs))
+			}
+			first := reqs[0].Messages[0]
+			if first.Role != openai.ChatMessageRoleSystem || first.Content != want {
+				t.Errorf("first message = %s %q, want the persona's system prompt", first.Role, first.Content)
+			}
+		})
+	}
+}
+
+func TestPersonaOverriddenBySystemPrompt(t *testing.T) {
+	client := answering("hi")
+	s := newTestServer(t, client, map[string]string{"PERSONA": "concise", "SYSTEM_PROMPT": "You are a fish."})
+	postJSON(s.chatHandler, "/api/chat", `{"question":"Who are you?"}`)
+
+	if got := client.Requests()[0].Messages[0].Content; got != "You are a fish." {
+		t.Errorf("system prompt = %q, want SYSTEM_PROMPT", got)
+	}
+}
+
+func TestUnknownPersona(t *testing.T) {
+	t.Setenv("AUTH_ENABLED", "false")
+	t.Setenv("PERSONA", "pirate")
+
+	_, err := loadServerConfig()
+	if err == nil {
+		t.Fatal("loadServerConfig accepted an unknown persona")
+	}
+	for _, want := range []string{"PERSONA", `"pirate"`, "concise, neutral, tshabot"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ModelPrice is the USD price per million prompt and completion tokens.
+type ModelPrice struct {
+	InputPerMillion  float64 `json:"input_per_million"`
+	OutputPerMillion float64 `json:"output_per_million"`
+}
+
+// defaultModelPrices holds list prices for the allowed models. PRICE_TABLE_FILE
+// can override or extend them without a redeploy.
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":        {InputPerMillion: 2.50, OutputPerMillion: 10.00},
+	"gpt-4o-mini":   {InputPerMillion: 0.15, OutputPerMillion: 0.60},
+	"gpt-4-turbo":   {InputPerMillion: 10.00, OutputPerMillion: 30.00},
+	"gpt-3.5-turbo": {InputPerMillion: 0.50, OutputPerMillion: 1.50},
+	"o3-mini":       {InputPerMillion: 1.10, OutputPerMillion: 4.40},
+}
+
+// estimatedCost accumulates the estimated spend per model.
+var estimatedCost = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tschabot_openai_estimated_cost_usd_total",
+	Help: "Estimated OpenAI spend in USD, by model.",
+}, []string{"model"})
+
+// loadPriceTable returns the default prices merged with the JSON object in
+// path, keyed by model name.
+func loadPriceTable(path string) (map[string]ModelPrice, error) {
+	prices := make(map[string]ModelPrice, len(defaultModelPrices))
+	for model, price := range defaultModelPrices {
+		prices[model] = price
+	}
+	if path == "" {
+		return prices, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read PRICE_TABLE_FILE: %w", err)
+	}
+	var overrides map[string]ModelPrice
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("parse PRICE_TABLE_FILE: %w", err)
+	}
+	for model, price := range overrides {
+		if price.InputPerMillion < 0 || price.OutputPerMillion < 0 {
+			return nil, fmt.Errorf("PRICE_TABLE_FILE: prices for %s must not be negative", model)
+		}
+		prices[model] = price
+	}
+	return prices, nil
+}
+
+// modelPrice looks up the price of model. Dated snapshots such as
+// "gpt-4o-2024-08-06" fall back to the longest matching base model.
+func (s *Server) modelPrice(model string) (ModelPrice, bool) {
+	if price, ok := s.cfg.Prices[model]; ok {
+		return price, true
+	}
+	var (
+		best  ModelPrice
+		found string
+	)
+	for name, price := range s.cfg.Prices {
+		if strings.HasPrefix(model, name+"-") && len(name) > len(found) {
+			best, found = price, name
+		}
+	}
+	return best, found != ""
+}
+
+// recordCost estimates the USD cost of usage on model and adds it to the
+// spend metric. It returns 0 for models without a known price.
+func (s *Server) recordCost(model string, usage Usage) float64 {
+	price, ok := s.modelPrice(model)
+	if !ok {
+		return 0
+	}
+	cost := (float64(usage.PromptTokens)*price.InputPerMillion + float64(usage.CompletionTokens)*price.OutputPerMillion) / 1e6
+	estimatedCost.WithLabelValues(model).Add(cost)
+	return cost
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// ResponseProcessor transforms an answer before it is sent to the client.
+type ResponseProcessor interface {
+	Process(answer string) string
+}
+
+// disclaimerProcessor appends a fixed notice to every answer.
+type disclaimerProcessor struct {
+	text string
+}
+
+func (p disclaimerProcessor) Process(answer string) string {
+	return answer + "\n\n" + p.text
+}
+
+// clampProcessor cuts answers longer than maxChars characters.
+type clampProcessor struct {
+	maxChars int
+}
+
+func (p clampProcessor) Process(answer string) string {
+	if utf8.RuneCountInString(answer) <= p.maxChars {
+		return answer
+	}
+	return string([]rune(answer)[:p.maxChars]) + "…"
+}
+
+// loadResponseProcessors builds the chain named in RESPONSE_PROCESSORS, a
+// comma-separated list applied in order. "disclaimer" appends
+// ANSWER_DISCLAIMER, "clamp" cuts answers at ANSWER_MAX_CHARS characters.
+func loadResponseProcessors() ([]ResponseProcessor, error) {
+	v := os.Getenv("RESPONSE_PROCESSORS")
+	if v == "" {
+		return nil, nil
+	}
+
+	var processors []ResponseProcessor
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "disclaimer":
+			text := strings.TrimSpace(os.Getenv("ANSWER_DISCLAIMER"))
+			if text == "" {
+				return nil, fmt.Errorf("RESPONSE_PROCESSORS: disclaimer requires ANSWER_DISCLAIMER")
+			}
+			processors = append(processors, disclaimerProcessor{text: text})
+		case "clamp":
+			maxChars, err := getEnvInt("ANSWER_MAX_CHARS", 0)
+			if err != nil {
+				return nil, err
+			}
+			if maxChars <= 0 {
+				return nil, fmt.Errorf("RESPONSE_PROCESSORS: clamp requires a positive ANSWER_MAX_CHARS")
+			}
+			processors = append(processors, clampProcessor{maxChars: maxChars})
+		default:
+			return nil, fmt.Errorf("RESPONSE_PROCESSORS: unknown processor %q", name)
+		}
+	}
+	return processors, nil
+}
+
+// processAnswer runs answer through the processor chain in order. Answers
+// to JSON mode requests are returned unmodified, since any appended or cut
+// text would break the JSON object.
+func (s *Server) processAnswer(req openai.ChatCompletionRequest, answer string) string {
+	if jsonMode(req) {
+		return answer
+	}
+	for _, p := range s.processors {
+		answer = p.Process(answer)
+	}
+	return answer
+}
+
+// processResponse applies the processor chain to every answer in resp.
+func (s *Server) processResponse(req openai.ChatCompletionRequest, resp ChatResponse) ChatResponse {
+	if len(s.processors) == 0 || jsonMode(req) {
+		return resp
+	}
+	resp.Answer = s.processAnswer(req, resp.Answer)
+	if len(resp.Answers) > 0 {
+		answers := make([]string, len(resp.Answers))
+		for i, a := range resp.Answers {
+			answers[i] = s.processAnswer(req, a)
+		}
+		resp.Answers = answers
+	}
+	return resp
+}
+
+// jsonMode reports whether req asks the model for a JSON object.
+func jsonMode(req openai.ChatCompletionRequest) bool {
+	return req.ResponseFormat != nil && req.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject
+}
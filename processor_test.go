@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+func TestProcessorChainOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		processors []ResponseProcessor
+		want       string
+	}{
+		{
+			name:       "disclaimer then clamp",
+			processors: []ResponseProcessor{disclaimerProcessor{text: "Not advice."}, clampProcessor{maxChars: 10}},
+			want:       "0123456789…",
+		},
+		{
+			name:       "clamp then disclaimer",
+			processors: []ResponseProcessor{clampProcessor{maxChars: 10}, disclaimerProcessor{text: "Not advice."}},
+			want:       "0123456789…\n\nNot advice.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{processors: tt.processors}
+			if got := s.processAnswer(openai.ChatCompletionRequest{}, "0123456789abcdef"); got != tt.want {
+				t.Errorf("processAnswer = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessorsSkipJSONMode(t *testing.T) {
+	const object = `{"fish":false,"salmon":"chinook"}`
+	s := newTestServer(t, answering(object), map[string]string{
+		"RESPONSE_PROCESSORS": "disclaimer,clamp",
+		"ANSWER_DISCLAIMER":   "Not advice.",
+		"ANSWER_MAX_CHARS":    "10",
+	})
+
+	rec := postJSON(s.chatHandler, "/api/chat", `{"question":"describe yourself","response_format":"json_object"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var body ChatResponse
+	decodeBody(t, rec, &body)
+	if body.Answer != object {
+		t.Errorf("answer = %q, want the JSON object unmodified", body.Answer)
+	}
+	if !json.Valid([]byte(body.Answer)) {
+		t.Error("answer is no longer valid JSON")
+	}
+
+	rec = postJSON(s.chatHandler, "/api/chat", `{"question":"describe yourself"}`)
+	decodeBody(t, rec, &body)
+	if body.Answer == object {
+		t.Error("processors did not run for a plain text request")
+	}
+}
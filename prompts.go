@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultPromptsReloadInterval is how often PROMPTS_DIR is checked for edits.
+const defaultPromptsReloadInterval = 5 * time.Second
+
+// promptExtensions are the file types loaded from PROMPTS_DIR.
+var promptExtensions = map[string]bool{".txt": true, ".md": true}
+
+// promptLibrary holds the named system prompts loaded from PROMPTS_DIR.
+// Clients pick one with ChatRequest.PromptName.
+type promptLibrary struct {
+	dir string
+
+	mu      sync.RWMutex
+	prompts map[string]string
+	// stamp fingerprints the directory contents the prompts were loaded from.
+	stamp string
+}
+
+// newPromptLibrary loads dir once; an unreadable directory or a broken
+// prompt fails startup.
+func newPromptLibrary(dir string) (*promptLibrary, error) {
+	stamp, err := promptDirStamp(dir)
+	if err != nil {
+		return nil, err
+	}
+	prompts, err := loadPromptDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &promptLibrary{dir: dir, prompts: prompts, stamp: stamp}, nil
+}
+
+// Get returns the prompt called name.
+func (l *promptLibrary) Get(name string) (string, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	prompt, ok := l.prompts[name]
+	return prompt, ok
+}
+
+// Names returns the loaded prompt names in sorted order.
+func (l *promptLibrary) Names() []string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	names := make([]string, 0, len(l.prompts))
+	for name := range l.prompts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Watch polls the directory every interval and reloads it when a prompt file
+// is added, removed or modified. A reload that fails keeps the current set,
+// so a half-written edit never takes prompts away from clients.
+func (l *promptLibrary) Watch(ctx context.Context, interval time.Duration, logger *logrus.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stamp, err := promptDirStamp(l.dir)
+		if err != nil {
+			logger.WithError(err).Warn("failed to scan PROMPTS_DIR")
+			continue
+		}
+		l.mu.RLock()
+		unchanged := stamp == l.stamp
+		l.mu.RUnlock()
+		if unchanged {
+			continue
+		}
+
+		prompts, err := loadPromptDir(l.dir)
+		l.mu.Lock()
+		// Remember the stamp even on failure so the error is logged once
+		// per edit rather than on every tick.
+		l.stamp = stamp
+		if err == nil {
+			l.prompts = prompts
+		}
+		l.mu.Unlock()
+		if err != nil {
+			logger.WithError(err).Error("failed to reload PROMPTS_DIR, keeping the previous prompts")
+			continue
+		}
+		logger.WithField("prompts", len(prompts)).Info("Reloaded prompt library")
+	}
+}
+
+// promptFiles lists the prompt files in dir.
+func promptFiles(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read PROMPTS_DIR: %w", err)
+	}
+	files := entries[:0]
+	for _, e := range entries {
+		if e.Type().IsRegular() && promptExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
+
+// promptDirStamp summarizes the names, sizes and modification times of the
+// prompt files so changes can be detected without reading them.
+func promptDirStamp(dir string) (string, error) {
+	files, err := promptFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil {
+			return "", fmt.Errorf("stat %s: %w", f.Name(), err)
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", f.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// loadPromptDir reads every prompt file in dir into a map keyed by the file
+// name without its extension, so support.md is selected as "support".
+func loadPromptDir(dir string) (map[string]string, error) {
+	files, err := promptFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	prompts := make(map[string]string, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		if _, dup := prompts[name]; dup {
+			return nil, fmt.Errorf("PROMPTS_DIR has more than one prompt named %q", name)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read prompt %s: %w", f.Name(), err)
+		}
+		prompt := strings.TrimSpace(string(data))
+		if prompt == "" {
+			return nil, fmt.Errorf("prompt %s is empty", f.Name())
+		}
+		if err := checkPromptTemplate(prompt); err != nil {
+			return nil, fmt.Errorf("prompt %s: %w", f.Name(), err)
+		}
+		prompts[name] = prompt
+	}
+	return prompts, nil
+}
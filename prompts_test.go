@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// writePrompts creates files, keyed by name, in a fresh directory.
+func writePrompts(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestPromptLibraryLoading(t *testing.T) {
+	dir := writePrompts(t, map[string]string{
+		"support.md":  "  You answer support questions about fish.\n",
+		"sales.txt":   "You sell fish.",
+		"notes.json":  `{"ignored": true}`,
+		"README":      "not a prompt",
+		"draft.md.gz": "binary",
+	})
+	if err := os.Mkdir(filepath.Join(dir, "archive.md"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	lib, err := newPromptLibrary(dir)
+	if err != nil {
+		t.Fatalf("newPromptLibrary: %v", err)
+	}
+	if got := strings.Join(lib.Names(), ","); got != "sales,support" {
+		t.Errorf("Names() = %s, want sales,support", got)
+	}
+	if got, _ := lib.Get("support"); got != "You answer support questions about fish." {
+		t.Errorf("Get(support) = %q, want the trimmed file", got)
+	}
+	if _, ok := lib.Get("notes"); ok {
+		t.Error("loaded a .json file")
+	}
+}
+
+func TestPromptLibraryRejectsBrokenDirs(t *testing.T) {
+	tests := map[string]map[string]string{
+		"empty prompt":   {"support.md": "  \n"},
+		"duplicate name": {"support.md": "A", "support.txt": "B"},
+	}
+	for name, files := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newPromptLibrary(writePrompts(t, files)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+	if _, err := newPromptLibrary(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestChatPromptName(t *testing.T) {
+	dir := writePrompts(t, map[string]string{
+		"support.md": "You answer support questions about fish.",
+		"sales.txt":  "You sell fish.",
+	})
+	tests := []struct {
+		name       string
+		env        map[string]string
+		promptName string
+		wantStatus int
+		wantSystem string
+	}{
+		{"selected prompt", map[string]string{"PROMPTS_DIR": dir}, "sales", http.StatusOK, "You sell fish."},
+		{"unknown prompt", map[string]string{"PROMPTS_DIR": dir}, "marketing", http.StatusBadRequest, ""},
+		{"no library", nil, "sales", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := answering("Yes.")
+			s := newTestServer(t, client, tt.env)
+			rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?","prompt_name":"`+tt.promptName+`"}`)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if system := client.Requests()[0].Messages[0]; system.Content != tt.wantSystem {
+				t.Errorf("system prompt = %q, want %q", system.Content, tt.wantSystem)
+			}
+		})
+	}
+}
+
+func TestPromptLibraryWatch(t *testing.T) {
+	dir := writePrompts(t, map[string]string{"support.md": "Version one."})
+	lib, err := newPromptLibrary(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, _ := logtest.NewNullLogger()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go lib.Watch(ctx, 5*time.Millisecond, logger)
+
+	waitFor := func(what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	writePrompt := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePrompt("support.md", "Version two, edited.")
+	writePrompt("sales.txt", "You sell fish.")
+	waitFor("the reload", func() bool {
+		support, _ := lib.Get("support")
+		_, sales := lib.Get("sales")
+		return support == "Version two, edited." && sales
+	})
+
+	// A broken edit keeps the prompts that were loaded.
+	writePrompt("support.md", "")
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := lib.Get("support"); got != "Version two, edited." {
+		t.Errorf("after a broken edit Get(support) = %q, want the previous prompt", got)
+	}
+}
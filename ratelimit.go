@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiterIdleTTL is how long an idle client's limiter is kept before eviction.
+const limiterIdleTTL = 10 * time.Minute
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedRateLimiter hands out a token-bucket limiter per client key, such as an
+// IP address or an authenticated user.
+type keyedRateLimiter struct {
+	mu        sync.Mutex
+	limiters  map[string]*limiterEntry
+	rps       rate.Limit
+	burst     int
+	lastSweep time.Time
+}
+
+// newKeyedRateLimiter creates a limiter allowing rps requests per second with
+// the given burst for every key.
+func newKeyedRateLimiter(rps float64, burst int) *keyedRateLimiter {
+	return &keyedRateLimiter{
+		limiters:  make(map[string]*limiterEntry),
+		rps:       rate.Limit(rps),
+		burst:     burst,
+		lastSweep: time.Now(),
+	}
+}
+
+// get returns the limiter for key, creating it on first use. Idle limiters are
+// swept opportunistically so the map does not grow without bound.
+func (l *keyedRateLimiter) get(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > limiterIdleTTL {
+		for k, e := range l.limiters {
+			if now.Sub(e.lastSeen) > limiterIdleTTL {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	e, ok := l.limiters[key]
+	if !ok {
+		e = &limiterEntry{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.limiters[key] = e
+	}
+	e.lastSeen = now
+	return e.limiter
+}
+
+// clientIP returns the caller's address as resolved by realIPMiddleware,
+// falling back to the connection's peer address.
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// rateLimitKey picks the limiter and key for a request: authenticated callers
+// are limited by their JWT subject, everyone else by IP address.
+func (s *Server) rateLimitKey(r *http.Request) (*keyedRateLimiter, string) {
+	key := callerID(r)
+	if s.userLimiter != nil && strings.HasPrefix(key, "sub:") {
+		return s.userLimiter, key
+	}
+	return s.limiter, "ip:" + clientIP(r)
+}
+
+// rateLimitMiddleware rejects requests with 429 once the client's bucket is empty.
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limiter, key := s.rateLimitKey(r)
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reservation := limiter.get(key).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			s.requestLogger(r).Warnf("rate limit exceeded for %s", key)
+			w.Header().Set("Retry-After", retryAfterSeconds(delay))
+			s.errorResponse(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Too many requests")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitError reports that a caller or tenant has used up its requests.
+type rateLimitError struct {
+	msg string
+	// retryAfter is how long until the request could succeed, or 0 when it
+	// needs more tokens than the bucket ever holds.
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return e.msg
+}
+
+// retryAfterSeconds formats a wait for the Retry-After header.
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// reserveN takes n tokens from l if they are available right away. Otherwise
+// it takes none and describes the shortage with msg.
+func reserveN(l *rate.Limiter, n int, msg string) (*rate.Reservation, *rateLimitError) {
+	reservation := l.ReserveN(time.Now(), n)
+	if !reservation.OK() {
+		return nil, &rateLimitError{msg: fmt.Sprintf("%s: %d requests exceed the limit of %d at once", msg, n, l.Burst())}
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return nil, &rateLimitError{msg: msg, retryAfter: delay}
+	}
+	return reservation, nil
+}
+
+// takeTokens charges n requests to the caller's bucket and, when r belongs
+// to a tenant, to the tenant's quota. The middleware charges one token per
+// HTTP request; this covers work it cannot see, such as a batch fanning out
+// into several OpenAI calls or questions arriving over a WebSocket. Nothing
+// is taken unless both have enough tokens.
+func (s *Server) takeTokens(r *http.Request, n int) *rateLimitError {
+	var caller *rate.Reservation
+	if limiter, key := s.rateLimitKey(r); limiter != nil {
+		var err *rateLimitError
+		if caller, err = reserveN(limiter.get(key), n, "Too many requests"); err != nil {
+			s.requestLogger(r).Warnf("rate limit exceeded for %s", key)
+			return err
+		}
+	}
+	if t, ok := r.Context().Value(tenantKey).(*tenant); ok && t.limiter != nil {
+		if _, err := reserveN(t.limiter, n, "Tenant quota exceeded"); err != nil {
+			if caller != nil {
+				caller.Cancel()
+			}
+			tenantRequests.WithLabelValues(t.id, "rate_limited").Inc()
+			return err
+		}
+	}
+	return nil
+}
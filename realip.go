@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies is the set of networks whose X-Forwarded-For is believed.
+type trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, as found in TRUSTED_PROXIES.
+func parseTrustedProxies(v string) (trustedProxies, error) {
+	var proxies trustedProxies
+	for _, entry := range strings.Split(v, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES entries must be IP addresses or CIDR ranges, got %q", entry)
+		}
+		addr = addr.Unmap()
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// contains reports whether ip belongs to a trusted proxy.
+func (p trustedProxies) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resolveClientIP finds the address of the client that sent r. X-Forwarded-For
+// is only honoured when the connection comes from a trusted proxy, and then
+// the rightmost hop that is not itself a trusted proxy wins: everything to its
+// left was written by the client and can be forged.
+func resolveClientIP(r *http.Request, trusted trustedProxies) string {
+	ip := remoteHost(r)
+	if !trusted.contains(ip) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !trusted.contains(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// realIPMiddleware records the resolved client address on the request so
+// rate limiting, caller identity and the access log all agree on it.
+func realIPMiddleware(trusted trustedProxies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey, resolveClientIP(r, trusted))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
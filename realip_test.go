@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.7,,::1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+		"::1":         true,
+		"203.0.113.9": false,
+		"not-an-ip":   false,
+	} {
+		if got := proxies.contains(ip); got != want {
+			t.Errorf("contains(%q) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/8,proxy.internal"); err == nil {
+		t.Error("expected an error for a hostname entry")
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"no proxy", "203.0.113.9:5000", nil, "203.0.113.9"},
+		{"forged header from untrusted peer", "203.0.113.9:5000", []string{"1.2.3.4"}, "203.0.113.9"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.4"}, "198.51.100.4"},
+		{"forged leftmost hop behind proxy", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.4"}, "198.51.100.4"},
+		{"proxy chain", "10.0.0.2:5000", []string{"198.51.100.4, 10.0.0.3"}, "198.51.100.4"},
+		{"split headers", "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.4"}, "198.51.100.4"},
+		{"garbage hop", "10.0.0.2:5000", []string{"198.51.100.4, bogus"}, "10.0.0.2"},
+		{"only proxies", "10.0.0.2:5000", []string{"10.0.0.5"}, "10.0.0.5"},
+		{"trusted proxy without header", "10.0.0.2:5000", nil, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := resolveClientIP(r, trusted); got != tt.want {
+				t.Errorf("resolveClientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestForgedForwardedForSharesBucket(t *testing.T) {
+	s := newTestServer(t, answering("hi"), map[string]string{
+		"RATE_LIMIT_RPS":   "0.001",
+		"RATE_LIMIT_BURST": "1",
+	})
+	handler := realIPMiddleware(s.cfg.TrustedProxies, s.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})))
+
+	for i, want := range []int{http.StatusNoContent, http.StatusTooManyRequests} {
+		r := httptest.NewRequest(http.MethodGet, "/api/chat", nil)
+		r.RemoteAddr = "203.0.113.9:5000"
+		r.Header.Set("X-Forwarded-For", []string{"1.1.1.1", "2.2.2.2"}[i])
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+	}
+}
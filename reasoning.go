@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// reasoningEfforts are the values accepted for reasoning_effort.
+var reasoningEfforts = map[string]bool{"low": true, "medium": true, "high": true}
+
+// defaultReasoningEffort matches OpenAI's default; it is sent explicitly so
+// responses can report the effort that was used.
+const defaultReasoningEffort = "medium"
+
+// reasoningModelPrefixes identify the o-series models that take a reasoning
+// effort.
+var reasoningModelPrefixes = []string{"o1", "o3"}
+
+// supportsReasoning reports whether model accepts reasoning_effort.
+func supportsReasoning(model string) bool {
+	for _, prefix := range reasoningModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// adaptForReasoning prepares req for a reasoning model and is a no-op for
+// other models. These models take max_completion_tokens instead of
+// max_tokens and reject custom sampling parameters, so those are dropped.
+func adaptForReasoning(req *openai.ChatCompletionRequest, effort string) {
+	if !supportsReasoning(req.Model) {
+		return
+	}
+	if effort == "" {
+		effort = defaultReasoningEffort
+	}
+	req.ReasoningEffort = effort
+	if req.MaxTokens > 0 {
+		req.MaxCompletionTokens, req.MaxTokens = req.MaxTokens, 0
+	}
+	req.Temperature, req.TopP = 0, 0
+	req.PresencePenalty, req.FrequencyPenalty = 0, 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestChatReasoningEffort(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantEffort string
+	}{
+		{"supported model", `{"question":"Is a salmon a fish?","model":"o3-mini","reasoning_effort":"high"}`, http.StatusOK, "high"},
+		{"supported model default", `{"question":"Is a salmon a fish?","model":"o3-mini"}`, http.StatusOK, defaultReasoningEffort},
+		{"unsupported model", `{"question":"Is a salmon a fish?","model":"gpt-4o","reasoning_effort":"high"}`, http.StatusBadRequest, ""},
+		{"unsupported model without effort", `{"question":"Is a salmon a fish?","model":"gpt-4o"}`, http.StatusOK, ""},
+		{"unknown effort", `{"question":"Is a salmon a fish?","model":"o3-mini","reasoning_effort":"extreme"}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := answering("Yes.")
+			s := newTestServer(t, client, map[string]string{"OPENAI_DEFAULT_MAX_TOKENS": "500"})
+			rec := postJSON(s.chatHandler, "/api/chat", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if n := len(client.Requests()); n != 0 {
+					t.Errorf("rejected request reached OpenAI %d times", n)
+				}
+				return
+			}
+
+			var resp ChatResponse
+			decodeBody(t, rec, &resp)
+			if resp.ReasoningEffort != tt.wantEffort {
+				t.Errorf("response reasoning_effort = %q, want %q", resp.ReasoningEffort, tt.wantEffort)
+			}
+			sent := client.Requests()[0]
+			if sent.ReasoningEffort != tt.wantEffort {
+				t.Errorf("upstream reasoning_effort = %q, want %q", sent.ReasoningEffort, tt.wantEffort)
+			}
+			if tt.wantEffort != "" && (sent.MaxTokens != 0 || sent.MaxCompletionTokens != 500) {
+				t.Errorf("reasoning model got max_tokens %d, max_completion_tokens %d; want 0, 500", sent.MaxTokens, sent.MaxCompletionTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Patterns for personal data that must not reach the logs. Card numbers are
+// matched before phone numbers since both are digit runs.
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	cardPattern  = regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`)
+	phonePattern = regexp.MustCompile(`\+?\(?\d[\d\s()-]{7,}\d`)
+)
+
+// minPhoneDigits keeps short numbers such as counts and years readable.
+const minPhoneDigits = 9
+
+// unredactedLogFields hold identifiers generated or checked by the server;
+// their digit runs would otherwise be mistaken for phone numbers.
+var unredactedLogFields = map[string]bool{
+	"request_id":          true,
+	"feedback_request_id": true,
+	"session_id":          true,
+	"remote_ip":           true,
+	"path":                true,
+}
+
+// redactPII masks email addresses, card numbers and phone numbers in s.
+func redactPII(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[email]")
+	s = cardPattern.ReplaceAllString(s, "[card]")
+	return phonePattern.ReplaceAllStringFunc(s, func(m string) string {
+		digits := 0
+		for _, c := range m {
+			if c >= '0' && c <= '9' {
+				digits++
+			}
+		}
+		if digits < minPhoneDigits {
+			return m
+		}
+		return "[phone]"
+	})
+}
+
+// redactingFormatter masks personal data in the message and string fields of
+// every entry before handing it to the wrapped formatter. Only the logs are
+// affected; requests sent to OpenAI keep the original text.
+type redactingFormatter struct {
+	next logrus.Formatter
+}
+
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := entry.Dup()
+	redacted.Level = entry.Level
+	redacted.Message = redactPII(entry.Message)
+	for k, v := range redacted.Data {
+		if unredactedLogFields[k] {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			redacted.Data[k] = redactPII(v)
+		case error:
+			redacted.Data[k] = redactPII(v.Error())
+		}
+	}
+	return f.next.Format(redacted)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedactPII(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"mail me at jane.doe+fish@example.co.uk please", "mail me at [email] please"},
+		{"card 4111 1111 1111 1111 expires soon", "card [card] expires soon"},
+		{"card 4111-1111-1111-1111", "card [card]"},
+		{"call +49 (30) 1234-5678", "call [phone]"},
+		{"call 555-123-4567 today", "call [phone] today"},
+		{"salmon live 4-8 years, since 1999", "salmon live 4-8 years, since 1999"},
+		{"nothing personal here", "nothing personal here"},
+	}
+	for _, tt := range tests {
+		if got := redactPII(tt.in); got != tt.want {
+			t.Errorf("redactPII(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	const email = "jane.doe@example.com"
+	for _, redaction := range []bool{true, false} {
+		client := answering("Yes.")
+		s := newTestServer(t, client, nil)
+		var logs bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&logs)
+		logger.SetLevel(logrus.DebugLevel)
+		logger.SetFormatter(&logrus.JSONFormatter{})
+		if redaction {
+			logger.SetFormatter(redactingFormatter{next: logger.Formatter})
+		}
+		s.logger = logger
+
+		rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish? Reply to `+email+`."}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+		}
+
+		if !strings.Contains(logs.String(), "question") {
+			t.Fatalf("the question was not logged:\n%s", logs.String())
+		}
+		if got := strings.Contains(logs.String(), email); got == redaction {
+			t.Errorf("redaction %v: email in logs = %v\n%s", redaction, got, logs.String())
+		}
+		if redaction && !strings.Contains(logs.String(), "[email]") {
+			t.Errorf("redacted logs lack the [email] mask:\n%s", logs.String())
+		}
+		msgs := client.Requests()[0].Messages
+		if upstream := msgs[len(msgs)-1].Content; !strings.Contains(upstream, email) {
+			t.Errorf("redaction %v: upstream question = %q, want the email kept", redaction, upstream)
+		}
+	}
+}
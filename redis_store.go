@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// redisKeyPrefix namespaces session keys in a shared Redis.
+	redisKeyPrefix = "tschabot:session:"
+	// redisOwnerPrefix namespaces the keys recording who owns a session.
+	redisOwnerPrefix = "tschabot:session-owner:"
+	// redisTrimmedPrefix namespaces the counters of messages dropped from a
+	// session by Trim, which offset message indexes.
+	redisTrimmedPrefix = "tschabot:session-trimmed:"
+	// redisOpTimeout bounds every Redis round trip so an outage can't stall requests.
+	redisOpTimeout = 2 * time.Second
+)
+
+// redisStore is a ConversationStore backed by Redis lists. Every session is a
+// list of JSON-encoded messages that expires after ttl of inactivity. Redis
+// errors are logged and treated as an empty session so chat keeps working
+// statelessly while Redis is unavailable.
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+	logger *logrus.Logger
+}
+
+// newRedisStore connects to the Redis instance at url. The connection is not
+// required to be up; an unreachable server is only reported as a warning.
+func newRedisStore(url string, ttl time.Duration, logger *logrus.Logger) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &redisStore{
+		client: redis.NewClient(opts),
+		ttl:    ttl,
+		logger: logger,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := store.client.Ping(ctx).Err(); err != nil {
+		logger.WithError(err).Warn("Redis is unreachable, conversations will be stateless until it recovers")
+	}
+	return store, nil
+}
+
+func (s *redisStore) Append(sessionID string, msg Message) int {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to encode conversation message")
+		return -1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	key := redisKeyPrefix + sessionID
+	pipe := s.client.TxPipeline()
+	length := pipe.RPush(ctx, key, data)
+	pipe.Expire(ctx, key, s.ttl)
+	trimmed := pipe.Get(ctx, redisTrimmedPrefix+sessionID)
+	pipe.Expire(ctx, redisTrimmedPrefix+sessionID, s.ttl)
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		s.logger.WithError(err).Warn("failed to store conversation message in Redis")
+		return -1
+	}
+	offset, _ := trimmed.Int()
+	return offset + int(length.Val()) - 1
+}
+
+func (s *redisStore) Load(sessionID string) []Message {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	items, err := s.client.LRange(ctx, redisKeyPrefix+sessionID, 0, -1).Result()
+	if err != nil {
+		s.logger.WithError(err).Warn("failed to load conversation from Redis, continuing without history")
+		return nil
+	}
+
+	msgs := make([]Message, 0, len(items))
+	for _, item := range items {
+		var msg Message
+		if err := json.Unmarshal([]byte(item), &msg); err != nil {
+			s.logger.WithError(err).Warn("skipping malformed conversation message")
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func (s *redisStore) Rate(sessionID string, index int, rating string) (Message, Message, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	offset, err := s.client.Get(ctx, redisTrimmedPrefix+sessionID).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		s.logger.WithError(err).Warn("failed to load trimmed message count from Redis")
+		return Message{}, Message{}, false
+	}
+	i := index - offset
+	prev, answer, ok := rateMessage(s.Load(sessionID), i, rating)
+	if !ok {
+		return Message{}, Message{}, false
+	}
+
+	data, err := json.Marshal(answer)
+	if err != nil {
+		s.logger.WithError(err).Error("failed to encode conversation message")
+		return Message{}, Message{}, false
+	}
+	if err := s.client.LSet(ctx, redisKeyPrefix+sessionID, int64(i), data).Err(); err != nil {
+		s.logger.WithError(err).Warn("failed to store rating in Redis")
+		return Message{}, Message{}, false
+	}
+	return prev, answer, true
+}
+
+// redisTrimScript drops all but the newest ARGV[1] messages of the list in
+// KEYS[1] and adds the number dropped to the counter in KEYS[2], atomically
+// so concurrent appends cannot skew message indexes.
+var redisTrimScript = redis.NewScript(`
+local drop = redis.call('LLEN', KEYS[1]) - tonumber(ARGV[1])
+if drop <= 0 then
+	return 0
+end
+redis.call('LTRIM', KEYS[1], drop, -1)
+redis.call('INCRBY', KEYS[2], drop)
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return drop
+`)
+
+func (s *redisStore) Trim(sessionID string, keep int) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	keys := []string{redisKeyPrefix + sessionID, redisTrimmedPrefix + sessionID}
+	if err := redisTrimScript.Run(ctx, s.client, keys, keep, s.ttl.Milliseconds()).Err(); err != nil {
+		s.logger.WithError(err).Warn("failed to trim conversation in Redis")
+	}
+}
+
+// redisClaimScript makes ARGV[1] the owner in KEYS[2] of the session whose
+// messages are in KEYS[1], unless it already has one, and returns the owner.
+// Like memoryStore it claims only existing sessions and returns "" for
+// unknown ones, so a session cannot be reserved before its first message.
+var redisClaimScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return ''
+end
+if ARGV[1] ~= '' then
+	redis.call('SET', KEYS[2], ARGV[1], 'NX', 'PX', ARGV[2])
+end
+local owner = redis.call('GET', KEYS[2])
+if not owner then
+	return ''
+end
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return owner
+`)
+
+func (s *redisStore) Claim(sessionID, owner string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	keys := []string{redisKeyPrefix + sessionID, redisOwnerPrefix + sessionID}
+	current, err := redisClaimScript.Run(ctx, s.client, keys, owner, s.ttl.Milliseconds()).Text()
+	if err != nil {
+		s.logger.WithError(err).Warn("failed to claim session in Redis")
+		return ""
+	}
+	return current
+}
+
+func (s *redisStore) Delete(sessionID string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	pipe := s.client.TxPipeline()
+	removed := pipe.Del(ctx, redisKeyPrefix+sessionID)
+	pipe.Del(ctx, redisOwnerPrefix+sessionID, redisTrimmedPrefix+sessionID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		s.logger.WithError(err).Warn("failed to delete conversation from Redis")
+		return false
+	}
+	return removed.Val() > 0
+}
+
+// Ping checks that Redis is reachable.
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
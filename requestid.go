@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader carries the correlation ID in both directions.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client-supplied IDs so they can't bloat our logs.
+const maxRequestIDLength = 128
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	claimsKey
+	retryAfterKey
+	tenantKey
+	clientIPKey
+)
+
+// requestIDMiddleware assigns every request an ID, honoring a well-formed
+// incoming X-Request-ID, and echoes it on the response.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validID(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// validID reports whether a client-supplied identifier is safe to log and reuse.
+func validID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFromContext returns the request ID stored by requestIDMiddleware.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns a log entry tagged with the request's correlation ID.
+func (s *Server) requestLogger(r *http.Request) *logrus.Entry {
+	return s.contextLogger(r.Context())
+}
+
+// contextLogger is requestLogger for code that only has the request context.
+func (s *Server) contextLogger(ctx context.Context) *logrus.Entry {
+	return s.logger.WithField("request_id", requestIDFromContext(ctx))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+)
+
+// retryBaseDelay is the first backoff interval; it doubles on every attempt.
+const retryBaseDelay = 500 * time.Millisecond
+
+// retryAfterHint receives the Retry-After of a rate-limited response.
+// go-openai drops response headers from its errors, so the transport records
+// the value in a hint carried by the request context.
+type retryAfterHint struct {
+	delay atomic.Int64
+}
+
+// retryAfterTransport fills the request's retryAfterHint on 429 responses.
+type retryAfterTransport struct {
+	base http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+	if hint, ok := req.Context().Value(retryAfterKey).(*retryAfterHint); ok {
+		hint.delay.Store(int64(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())))
+	}
+	return resp, err
+}
+
+// parseRetryAfter reads a Retry-After value given either in seconds or as an
+// HTTP date. It returns 0 when the value is missing or malformed.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs * float64(time.Second))
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// upstreamStatus extracts the HTTP status code from an OpenAI client error, or
+// 0 when the error did not come from an HTTP response.
+func upstreamStatus(err error) int {
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var reqErr *openai.RequestError
+	if errors.As(err, &reqErr) {
+		return reqErr.HTTPStatusCode
+	}
+	return 0
+}
+
+// isRateLimited reports whether OpenAI rejected the call with 429.
+func isRateLimited(err error) bool {
+	return upstreamStatus(err) == http.StatusTooManyRequests
+}
+
+// isRetryable reports whether a failed call is worth repeating.
+func isRetryable(err error) bool {
+	status := upstreamStatus(err)
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// isContextLengthExceeded reports whether OpenAI rejected the prompt as too
+// long for the model. Our token estimate is a heuristic, so this can still
+// happen after fitsContextWindow passed.
+func isContextLengthExceeded(err error) bool {
+	var apiErr *openai.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	code, _ := apiErr.Code.(string)
+	return code == string(ErrCodeContextTooLong)
+}
+
+// contextTooLongMessage is returned when OpenAI reports the prompt as too long.
+const contextTooLongMessage = "The conversation is too long for the model; shorten the history or question and try again"
+
+// logUpstreamError logs a failed OpenAI call. Authentication failures are
+// called out separately because they usually mean the API key is invalid or
+// has been rotated.
+func logUpstreamError(log *logrus.Entry, err error, msg string) {
+	if upstreamStatus(err) == http.StatusUnauthorized {
+		log.WithError(err).Error("OpenAI rejected the API key: it may be invalid or rotated")
+		return
+	}
+	log.WithError(err).Error(msg)
+}
+
+// completeWithRetry calls OpenAI, retrying rate-limit and server errors with
+// exponential backoff while the retry budget lasts. A Retry-After sent with a
+// 429 replaces the backoff, capped at MaxRetryAfter. If the primary model is
+// still rate limited afterwards and a fallback model is configured, the call
+// is repeated once with the fallback; req.Model is switched so follow-up
+// calls stay on it.
+func (s *Server) completeWithRetry(ctx context.Context, req *openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	var (
+		resp openai.ChatCompletionResponse
+		err  error
+	)
+	log := s.contextLogger(ctx)
+	hint := &retryAfterHint{}
+	ctx = context.WithValue(ctx, retryAfterKey, hint)
+	for attempt := 0; ; attempt++ {
+		hint.delay.Store(0)
+		resp, err = s.callChatCompletion(ctx, *req)
+		if err == nil || !isRetryable(err) || attempt >= s.cfg.MaxRetries {
+			break
+		}
+		if s.retryBudget != nil && !s.retryBudget.Allow(time.Now()) {
+			break
+		}
+		openaiRetries.WithLabelValues(retryReason(err)).Inc()
+
+		delay := retryBaseDelay << attempt
+		if retryAfter := time.Duration(hint.delay.Load()); retryAfter > 0 && isRateLimited(err) {
+			delay = min(retryAfter, s.cfg.MaxRetryAfter)
+		}
+		log.WithError(err).Warnf("OpenAI call failed, retrying in %s (attempt %d/%d)", delay, attempt+1, s.cfg.MaxRetries)
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	if err != nil && isRateLimited(err) && s.cfg.FallbackModel != "" && req.Model != s.cfg.FallbackModel {
+		log.Warnf("model %s is rate limited, falling back to %s", req.Model, s.cfg.FallbackModel)
+		req.Model = s.cfg.FallbackModel
+		return s.callChatCompletion(ctx, *req)
+	}
+	return resp, err
+}
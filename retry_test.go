@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// serverError is an upstream failure that completeWithRetry retries.
+var serverError = &openai.APIError{HTTPStatusCode: http.StatusInternalServerError, Message: "boom"}
+
+// failingFirst returns a fakeClient whose first call fails with err and
+// whose later calls answer.
+func failingFirst(err error, answer string) *fakeClient {
+	calls := 0
+	return &fakeClient{complete: func(context.Context, openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		calls++
+		if calls == 1 {
+			return openai.ChatCompletionResponse{}, err
+		}
+		return completion(answer), nil
+	}}
+}
+
+func TestUpstreamLogsCarryRequestID(t *testing.T) {
+	s := newTestServer(t, failingFirst(serverError, "hi"), map[string]string{"OPENAI_MAX_RETRIES": "1"})
+	logger, hook := logtest.NewNullLogger()
+	s.logger = logger
+	ctx := context.WithValue(context.Background(), requestIDKey, "req-42")
+
+	req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+	if _, err := s.completeWithRetry(ctx, &req); err != nil {
+		t.Fatalf("completeWithRetry: %v", err)
+	}
+	s.callTool(ctx, openai.ToolCall{Function: openai.FunctionCall{Name: "no_such_tool"}})
+
+	entries := hook.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("got %d log entries, want the retry and the unknown tool", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.Data["request_id"] != "req-42" {
+			t.Errorf("%q logged without the request ID: %v", entry.Message, entry.Data)
+		}
+	}
+}
+
+func TestContextLengthExceeded(t *testing.T) {
+	tooLong := &openai.APIError{
+		Code:           "context_length_exceeded",
+		HTTPStatusCode: http.StatusBadRequest,
+		Message:        "This model's maximum context length is 128000 tokens.",
+	}
+	client := &fakeClient{
+		complete: func(context.Context, openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+			return openai.ChatCompletionResponse{}, tooLong
+		},
+		stream: func(context.Context, openai.ChatCompletionRequest) (ChatStream, error) {
+			return nil, tooLong
+		},
+	}
+	s := newTestServer(t, client, map[string]string{"OPENAI_MAX_RETRIES": "2"})
+
+	for path, handler := range map[string]http.HandlerFunc{
+		"/api/chat":        s.chatHandler,
+		"/api/chat/stream": s.chatStreamHandler,
+	} {
+		t.Run(path, func(t *testing.T) {
+			rec := postJSON(handler, path, `{"question":"Is a salmon a fish?"}`)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body.String())
+			}
+			var resp ErrorResponse
+			decodeBody(t, rec, &resp)
+			if resp.Error.Code != ErrCodeContextTooLong || resp.Error.Message != contextTooLongMessage {
+				t.Errorf("error = %+v, want %s: %q", resp.Error, ErrCodeContextTooLong, contextTooLongMessage)
+			}
+		})
+	}
+	if got := len(client.Requests()); got != 2 {
+		t.Errorf("OpenAI was called %d times, want one call per endpoint without retries", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"2", 2 * time.Second},
+		{"0.25", 250 * time.Millisecond},
+		{"-1", 0},
+		{now.Add(3 * time.Second).Format(http.TimeFormat), 3 * time.Second},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"soon", 0},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfterIsHonoured(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		wantDelay  string
+		wantErr    error
+	}{
+		{"hint", "0.02", "20ms", nil},
+		{"capped", "30", "50ms", nil},
+		{"no hint", "", "500ms", context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if calls.Add(1) == 1 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					io.WriteString(w, `{"error":{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}}`)
+					return
+				}
+				io.WriteString(w, `{"model":"gpt-4o","choices":[{"index":0,"message":{"role":"assistant","content":"Yes."},"finish_reason":"stop"}]}`)
+			}))
+			defer upstream.Close()
+
+			s := newTestServer(t, nil, map[string]string{
+				"OPENAI_BASE_URL":        upstream.URL + "/v1",
+				"OPENAI_MAX_RETRIES":     "1",
+				"OPENAI_MAX_RETRY_AFTER": "50ms",
+			})
+			s.SetClient(newOpenAIClient(openai.NewClientWithConfig(openAIConfig("sk-test", s.cfg))))
+			logger, hook := logtest.NewNullLogger()
+			s.logger = logger
+			// The plain backoff is cut short by the deadline; only the
+			// logged delay matters.
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+			if _, err := s.completeWithRetry(ctx, &req); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("completeWithRetry: %v, want %v", err, tt.wantErr)
+			}
+
+			entry := hook.LastEntry()
+			if entry == nil || !strings.Contains(entry.Message, "retrying in "+tt.wantDelay+" ") {
+				t.Errorf("retry log = %v, want a %s delay", entry, tt.wantDelay)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultRetryBudgetWindow is the period OPENAI_RETRY_BUDGET applies to.
+const defaultRetryBudgetWindow = time.Minute
+
+// Retry reasons used as the "reason" label of openaiRetries.
+const (
+	retryReasonRateLimit   = "rate_limit"
+	retryReasonServerError = "server_error"
+)
+
+var (
+	// openaiRetries counts retried OpenAI calls by what made them fail.
+	openaiRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tschabot_openai_retries_total",
+		Help: "OpenAI calls retried, by reason (rate_limit, server_error).",
+	}, []string{"reason"})
+
+	// retryBudgetExhausted counts windows in which the retry budget ran out.
+	retryBudgetExhausted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tschabot_openai_retry_budget_exhausted_total",
+		Help: "Windows in which the OpenAI retry budget was used up.",
+	})
+)
+
+// retryReason labels a retryable error for openaiRetries.
+func retryReason(err error) string {
+	if isRateLimited(err) {
+		return retryReasonRateLimit
+	}
+	return retryReasonServerError
+}
+
+// RetryBudgetHook is notified when the retry budget of a window runs out, so
+// operators can wire alerts. It is called at most once per window, on the
+// request path, and should return quickly.
+type RetryBudgetHook interface {
+	RetryBudgetExhausted(budget int, window time.Duration)
+}
+
+// logRetryBudgetHook is the default hook; it only logs.
+type logRetryBudgetHook struct {
+	logger *logrus.Logger
+}
+
+func (h logRetryBudgetHook) RetryBudgetExhausted(budget int, window time.Duration) {
+	h.logger.WithFields(logrus.Fields{
+		"budget": budget,
+		"window": window.String(),
+	}).Error("OpenAI retry budget exhausted, failing further calls without retrying")
+}
+
+// retryBudget caps the number of retries across all requests in a fixed
+// window, so a struggling upstream is not hammered by every caller at once.
+type retryBudget struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	used    int
+	tripped bool
+	hook    RetryBudgetHook
+}
+
+func newRetryBudget(limit int, window time.Duration, hook RetryBudgetHook) *retryBudget {
+	return &retryBudget{limit: limit, window: window, hook: hook}
+}
+
+// Allow takes one retry from the budget. It reports false once the window's
+// budget is spent and fires the hook the first time that happens.
+func (b *retryBudget) Allow(now time.Time) bool {
+	b.mu.Lock()
+	if now.Sub(b.start) >= b.window {
+		b.start, b.used, b.tripped = now, 0, false
+	}
+	if b.used < b.limit {
+		b.used++
+		b.mu.Unlock()
+		return true
+	}
+	fire := !b.tripped
+	b.tripped = true
+	hook := b.hook
+	b.mu.Unlock()
+
+	if fire {
+		retryBudgetExhausted.Inc()
+		if hook != nil {
+			hook.RetryBudgetExhausted(b.limit, b.window)
+		}
+	}
+	return false
+}
+
+// SetHook replaces the hook fired when the budget runs out.
+func (b *retryBudget) SetHook(hook RetryBudgetHook) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hook = hook
+}
+
+// SetRetryBudgetHook registers the hook notified when the OpenAI retry budget
+// is exhausted. It has no effect when OPENAI_RETRY_BUDGET is not set.
+func (s *Server) SetRetryBudgetHook(hook RetryBudgetHook) {
+	if s.retryBudget != nil {
+		s.retryBudget.SetHook(hook)
+	}
+}
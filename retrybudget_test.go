@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// upstreamRateLimited is a 429 from OpenAI.
+var upstreamRateLimited = &openai.APIError{HTTPStatusCode: http.StatusTooManyRequests, Message: "Rate limit reached"}
+
+// failingWith returns a fakeClient that fails with errs in order, then
+// answers. A 429 comes with a short Retry-After, as the transport would
+// record it, to keep the backoff out of the test's runtime.
+func failingWith(errs ...error) *fakeClient {
+	var mu sync.Mutex
+	calls := 0
+	return &fakeClient{complete: func(ctx context.Context, _ openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls > len(errs) {
+			return completion("Yes."), nil
+		}
+		err := errs[calls-1]
+		if hint, ok := ctx.Value(retryAfterKey).(*retryAfterHint); ok && isRateLimited(err) {
+			hint.delay.Store(int64(time.Millisecond))
+		}
+		return openai.ChatCompletionResponse{}, err
+	}}
+}
+
+// recordingHook counts RetryBudgetExhausted calls.
+type recordingHook struct {
+	mu    sync.Mutex
+	fired int
+}
+
+func (h *recordingHook) RetryBudgetExhausted(int, time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fired++
+}
+
+func (h *recordingHook) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fired
+}
+
+func TestRetryCountersIncrement(t *testing.T) {
+	rateLimited := openaiRetries.WithLabelValues(retryReasonRateLimit)
+	serverErrors := openaiRetries.WithLabelValues(retryReasonServerError)
+	beforeRateLimited, beforeServerErrors := testutil.ToFloat64(rateLimited), testutil.ToFloat64(serverErrors)
+
+	client := failingWith(serverError, upstreamRateLimited)
+	s := newTestServer(t, client, map[string]string{"OPENAI_MAX_RETRIES": "2"})
+	req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+	if _, err := s.completeWithRetry(context.Background(), &req); err != nil {
+		t.Fatalf("completeWithRetry: %v", err)
+	}
+
+	if got := testutil.ToFloat64(serverErrors) - beforeServerErrors; got != 1 {
+		t.Errorf("server_error retries grew by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(rateLimited) - beforeRateLimited; got != 1 {
+		t.Errorf("rate_limit retries grew by %v, want 1", got)
+	}
+	if got := len(client.Requests()); got != 3 {
+		t.Errorf("OpenAI was called %d times, want 3", got)
+	}
+}
+
+func TestRetryBudgetExhaustedHook(t *testing.T) {
+	before := testutil.ToFloat64(retryBudgetExhausted)
+	client := failingWith(upstreamRateLimited, upstreamRateLimited, upstreamRateLimited, upstreamRateLimited, upstreamRateLimited)
+	s := newTestServer(t, client, map[string]string{
+		"OPENAI_MAX_RETRIES":         "3",
+		"OPENAI_RETRY_BUDGET":        "1",
+		"OPENAI_RETRY_BUDGET_WINDOW": "1h",
+	})
+	hook := &recordingHook{}
+	s.SetRetryBudgetHook(hook)
+
+	// The first call spends the budget on one retry; the second gets none.
+	for i, wantCalls := range []int{2, 3} {
+		req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+		if _, err := s.completeWithRetry(context.Background(), &req); !isRateLimited(err) {
+			t.Fatalf("call %d: err = %v, want the 429", i+1, err)
+		}
+		if got := len(client.Requests()); got != wantCalls {
+			t.Errorf("after call %d OpenAI was called %d times, want %d", i+1, got, wantCalls)
+		}
+	}
+
+	if got := hook.count(); got != 1 {
+		t.Errorf("hook fired %d times, want once per window", got)
+	}
+	if got := testutil.ToFloat64(retryBudgetExhausted) - before; got != 1 {
+		t.Errorf("exhausted counter grew by %v, want 1", got)
+	}
+}
+
+func TestRetryBudgetWindow(t *testing.T) {
+	hook := &recordingHook{}
+	b := newRetryBudget(2, time.Minute, hook)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, want := range []bool{true, true, false, false} {
+		if got := b.Allow(start.Add(time.Duration(i) * time.Second)); got != want {
+			t.Errorf("retry %d allowed = %v, want %v", i+1, got, want)
+		}
+	}
+	if !b.Allow(start.Add(time.Minute)) {
+		t.Error("a new window did not refill the budget")
+	}
+	if got := hook.count(); got != 1 {
+		t.Errorf("hook fired %d times, want 1", got)
+	}
+}
+
+func TestCircuitBreakerStateGauge(t *testing.T) {
+	s := newTestServer(t, failingWith(serverError), map[string]string{"CIRCUIT_BREAKER_FAILURES": "1"})
+	req := openai.ChatCompletionRequest{Model: "gpt-4o"}
+	s.completeWithRetry(context.Background(), &req)
+
+	if got := testutil.ToFloat64(circuitBreakerState); got != 2 {
+		t.Errorf("breaker gauge = %v, want 2 (open)", got)
+	}
+	if got := s.breakerState(); got != "open" {
+		t.Errorf("breakerState() = %q, want open", got)
+	}
+}
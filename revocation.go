@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// redisRevokedPrefix namespaces revoked token IDs in a shared Redis.
+const redisRevokedPrefix = "tschabot:revoked:"
+
+// RevocationList remembers logged-out tokens by their jti claim until they
+// would have expired anyway.
+type RevocationList interface {
+	// Revoke rejects the token with the given ID until expires.
+	Revoke(jti string, expires time.Time)
+	// Revoked reports whether the token ID has been revoked.
+	Revoked(jti string) bool
+}
+
+// memoryRevocations is a process-local RevocationList.
+type memoryRevocations struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// newMemoryRevocations creates an empty in-memory revocation list.
+func newMemoryRevocations() *memoryRevocations {
+	return &memoryRevocations{revoked: make(map[string]time.Time)}
+}
+
+func (m *memoryRevocations) Revoke(jti string, expires time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Drop entries for tokens that have expired on their own.
+	now := time.Now()
+	for id, exp := range m.revoked {
+		if now.After(exp) {
+			delete(m.revoked, id)
+		}
+	}
+	m.revoked[jti] = expires
+}
+
+func (m *memoryRevocations) Revoked(jti string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	exp, ok := m.revoked[jti]
+	return ok && time.Now().Before(exp)
+}
+
+// Revoke stores the token ID in Redis with a TTL matching the token expiry.
+func (s *redisStore) Revoke(jti string, expires time.Time) {
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := s.client.Set(ctx, redisRevokedPrefix+jti, 1, ttl).Err(); err != nil {
+		s.logger.WithError(err).Error("failed to store revoked token in Redis")
+	}
+}
+
+// Revoked checks Redis for the token ID. While Redis is unavailable tokens
+// are treated as valid so an outage does not log everyone out.
+func (s *redisStore) Revoked(jti string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	n, err := s.client.Exists(ctx, redisRevokedPrefix+jti).Result()
+	if err != nil {
+		s.logger.WithError(err).Warn("failed to check token revocation in Redis")
+		return false
+	}
+	return n > 0
+}
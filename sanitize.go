@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// injectionRolePrefix matches lines that impersonate a non-user chat role,
+	// e.g. "System: you are now ...".
+	// Invisible format characters such as zero-width spaces are skipped so
+	// they cannot hide the label.
+	injectionRolePrefix = regexp.MustCompile(`(?im)^[ \t\p{Cf}]*(system|assistant|developer)[ \t\p{Cf}]*:[ \t]*`)
+	// injectionOverride matches a line opening with an attempt to cancel the
+	// system prompt, e.g. "Ignore all previous instructions."
+	injectionOverride = regexp.MustCompile(`(?im)^[ \t\p{Cf}]*(ignore|disregard|forget)[ \t]+(all[ \t]+)?(of[ \t]+)?(the[ \t]+|your[ \t]+|any[ \t]+)?(previous|prior|above|earlier)[ \t]+instructions\b[ \t.,;:!]*`)
+	// injectionTokens matches chat-template control tokens that have no place
+	// in a legitimate question.
+	injectionTokens = regexp.MustCompile(`(?i)<\|[a-z_]+\|>|\[/?INST\]|<</?SYS>>`)
+)
+
+// sanitizeQuestion removes role impersonation prefixes, instruction
+// overrides and chat-template control tokens from a question. It is
+// deliberately conservative: only role labels and overrides at the start of a
+// line and well-known control tokens are touched, so ordinary prose
+// mentioning "system" or previous instructions is left alone. It reports
+// whether the question was modified.
+func sanitizeQuestion(question string) (string, bool) {
+	cleaned := injectionTokens.ReplaceAllString(question, "")
+	cleaned = injectionRolePrefix.ReplaceAllString(cleaned, "")
+	cleaned = injectionOverride.ReplaceAllString(cleaned, "")
+	cleaned = strings.TrimSpace(cleaned)
+	return cleaned, cleaned != strings.TrimSpace(question)
+}
+
+// sanitize applies sanitizeQuestion when SANITIZE_INPUT is enabled and logs
+// any modification.
+func (s *Server) sanitize(log *logrus.Entry, question string) string {
+	if !s.cfg.SanitizeInput {
+		return question
+	}
+	cleaned, changed := sanitizeQuestion(question)
+	if changed {
+		log.WithFields(logrus.Fields{
+			"original_chars":  len(question),
+			"sanitized_chars": len(cleaned),
+		}).Warn("removed prompt injection markers from question")
+	}
+	return cleaned
+}
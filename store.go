@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Policies applied when a session reaches MAX_TURNS_PER_SESSION.
+const (
+	turnPolicyReject = "reject"
+	turnPolicyReset  = "reset"
+)
+
+// ConversationStore keeps the turns of a chat session so clients only need to
+// send the new question.
+type ConversationStore interface {
+	// Append adds a message to the end of the session and returns its index,
+	// or -1 if it could not be stored. Indexes count every message ever
+	// appended, so they stay stable when Trim forgets older ones.
+	Append(sessionID string, msg Message) int
+	// Load returns the session's messages in order, or nil if it is unknown.
+	Load(sessionID string) []Message
+	// Rate sets the rating of the assistant message at index and returns it
+	// with the message before it, which is zero if that one was trimmed. It
+	// returns false if there is no such message or it was trimmed.
+	Rate(sessionID string, index int, rating string) (prev, answer Message, ok bool)
+	// Trim keeps only the newest keep messages of the session.
+	Trim(sessionID string, keep int)
+	// Claim makes owner the owner of an existing session unless it already
+	// has one, and returns the owner in effect. An empty owner claims nothing.
+	Claim(sessionID, owner string) string
+	// Delete removes the session and reports whether it existed.
+	Delete(sessionID string) bool
+}
+
+// memoryStore is a process-local ConversationStore. Sessions idle for longer
+// than ttl are evicted by Cleanup.
+type memoryStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*memorySession
+	// now is the clock, a field so it can be faked.
+	now func() time.Time
+}
+
+type memorySession struct {
+	messages []Message
+	// trimmed is the number of messages dropped by Trim, the index of
+	// messages[0].
+	trimmed    int
+	owner      string
+	lastAccess time.Time
+}
+
+// newMemoryStore creates an empty in-memory conversation store whose sessions
+// expire after ttl of inactivity.
+func newMemoryStore(ttl time.Duration) *memoryStore {
+	return &memoryStore{
+		ttl:      ttl,
+		sessions: make(map[string]*memorySession),
+		now:      time.Now,
+	}
+}
+
+func (m *memoryStore) Append(sessionID string, msg Message) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok {
+		sess = &memorySession{}
+		m.sessions[sessionID] = sess
+	}
+	sess.messages = append(sess.messages, msg)
+	sess.lastAccess = m.now()
+	return sess.trimmed + len(sess.messages) - 1
+}
+
+func (m *memoryStore) Load(sessionID string) []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+	sess.lastAccess = m.now()
+	return append([]Message(nil), sess.messages...)
+}
+
+func (m *memoryStore) Rate(sessionID string, index int, rating string) (Message, Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok {
+		return Message{}, Message{}, false
+	}
+	return rateMessage(sess.messages, index-sess.trimmed, rating)
+}
+
+// rateMessage rates the assistant message at i of msgs in place and returns
+// it with its predecessor.
+func rateMessage(msgs []Message, i int, rating string) (Message, Message, bool) {
+	if i < 0 || i >= len(msgs) || msgs[i].Role != "assistant" {
+		return Message{}, Message{}, false
+	}
+	msgs[i].Rating = rating
+	var prev Message
+	if i > 0 {
+		prev = msgs[i-1]
+	}
+	return prev, msgs[i], true
+}
+
+func (m *memoryStore) Trim(sessionID string, keep int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok || len(sess.messages) <= keep {
+		return
+	}
+	sess.trimmed += len(sess.messages) - keep
+	sess.messages = append([]Message(nil), sess.messages[len(sess.messages)-keep:]...)
+}
+
+func (m *memoryStore) Claim(sessionID, owner string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sess, ok := m.sessions[sessionID]
+	if !ok {
+		return ""
+	}
+	if sess.owner == "" {
+		sess.owner = owner
+	}
+	return sess.owner
+}
+
+func (m *memoryStore) Delete(sessionID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.sessions[sessionID]
+	delete(m.sessions, sessionID)
+	return ok
+}
+
+// Cleanup evicts sessions idle for longer than the TTL and returns how many
+// were removed.
+func (m *memoryStore) Cleanup() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := m.now().Add(-m.ttl)
+	evicted := 0
+	for id, sess := range m.sessions {
+		if sess.lastAccess.Before(cutoff) {
+			delete(m.sessions, id)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// RunCleaner calls Cleanup every interval until ctx is cancelled.
+func (m *memoryStore) RunCleaner(ctx context.Context, interval time.Duration, onEvict func(n int)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := m.Cleanup(); n > 0 && onEvict != nil {
+				onEvict(n)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadSessionHistory fills the request history with the stored turns of its
+// session, keeping only the most recent ones that fit the history limit. It
+// enforces session ownership and MAX_TURNS_PER_SESSION and returns the turn
+// number of the new question, or false after writing a 404 for another
+// caller's session or a 409 when the session is full.
+func (s *Server) loadSessionHistory(w http.ResponseWriter, r *http.Request, req *ChatRequest) (int, bool) {
+	if req.SessionID == "" {
+		return 0, true
+	}
+	if !s.sessionAccessible(r, req.SessionID) {
+		s.requestLogger(r).Warn("refused access to a session owned by another caller")
+		s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "Session not found")
+		return 0, false
+	}
+	history := s.store.Load(req.SessionID)
+	turns := countTurns(history)
+
+	if limit := s.cfg.MaxTurnsPerSession; limit > 0 && turns >= limit {
+		if s.cfg.SessionTurnPolicy == turnPolicyReject {
+			s.errorResponse(w, http.StatusConflict, ErrCodeSessionFull,
+				fmt.Sprintf("The session has reached its limit of %d turns; start a new session", limit))
+			return 0, false
+		}
+		// Forget just enough turns for the new question to be the last one
+		// allowed. Indexes of the remaining messages do not change; feedback
+		// on a forgotten answer gets 404.
+		history = dropOldestTurns(history, turns-limit+1)
+		s.store.Trim(req.SessionID, len(history))
+		turns = countTurns(history)
+	}
+
+	if len(history) > maxHistoryMessages {
+		history = history[len(history)-maxHistoryMessages:]
+	}
+	req.History = history
+	return turns + 1, true
+}
+
+// countTurns returns the number of questions in history.
+func countTurns(history []Message) int {
+	n := 0
+	for _, msg := range history {
+		if msg.Role == "user" {
+			n++
+		}
+	}
+	return n
+}
+
+// dropOldestTurns removes the first n questions and their answers.
+func dropOldestTurns(history []Message, n int) []Message {
+	for i, msg := range history {
+		if msg.Role != "user" {
+			continue
+		}
+		if n == 0 {
+			return history[i:]
+		}
+		n--
+	}
+	return nil
+}
+
+// recordExchange stores the question and its answer in the session of r and
+// returns the index of the answer, or -1 when nothing was stored.
+func (s *Server) recordExchange(r *http.Request, sessionID, question, answer string) int {
+	// Ownership was checked when the history was loaded; checking again
+	// closes the window in which another caller may have created the session.
+	if sessionID == "" || !s.sessionAccessible(r, sessionID) {
+		return -1
+	}
+	s.store.Append(sessionID, Message{Role: "user", Content: question})
+	index := s.store.Append(sessionID, Message{Role: "assistant", Content: answer})
+	s.store.Claim(sessionID, s.sessionOwner(r))
+	return index
+}
+
+// sessionAccessible reports whether the caller of r may use sessionID. With
+// auth enabled an existing session must belong to the caller; one without an
+// owner is claimed for it. Unknown sessions are accessible so they can be
+// created.
+func (s *Server) sessionAccessible(r *http.Request, sessionID string) bool {
+	owner := s.sessionOwner(r)
+	if owner == "" {
+		return true
+	}
+	current := s.store.Claim(sessionID, owner)
+	return current == "" || current == owner
+}
+
+// sessionOwner identifies the caller owning the sessions it creates. Without
+// auth there is no reliable identity, so sessions are not owned.
+func (s *Server) sessionOwner(r *http.Request) string {
+	if !s.cfg.AuthEnabled {
+		return ""
+	}
+	return callerID(r)
+}
+
+// deleteSessionHandler forgets a stored conversation so the client can start
+// over. Only the session's owner may delete it.
+func (s *Server) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+
+	if handlePreflight(w, r, "DELETE, OPTIONS") {
+		return
+	}
+
+	sessionID, _, ok := s.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	if !s.store.Delete(sessionID) {
+		s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "Session not found")
+		return
+	}
+
+	log.WithField("session_id", sessionID).Info("session deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedSession loads the session named in the URL. With auth enabled it must
+// belong to the caller; anyone else gets 404 so session IDs cannot be
+// probed. On failure it writes the error response and returns false.
+func (s *Server) ownedSession(w http.ResponseWriter, r *http.Request) (string, []Message, bool) {
+	sessionID := mux.Vars(r)["id"]
+	if !validID(sessionID) {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "The session ID is malformed")
+		return "", nil, false
+	}
+
+	msgs := s.store.Load(sessionID)
+	if len(msgs) == 0 {
+		s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "Session not found")
+		return "", nil, false
+	}
+	if !s.sessionAccessible(r, sessionID) {
+		s.requestLogger(r).Warn("refused access to a session owned by another caller")
+		s.errorResponse(w, http.StatusNotFound, ErrCodeNotFound, "Session not found")
+		return "", nil, false
+	}
+	return sessionID, msgs, true
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// testJWTSecret satisfies the minimum JWT_SECRET length.
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+// asCaller returns r as if authMiddleware had accepted a token for sub.
+func asCaller(r *http.Request, sub string) *http.Request {
+	claims := jwt.MapClaims{"sub": sub}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey, claims))
+}
+
+// sessionRequest builds a request for a /api/chat/session/{id} route.
+func sessionRequest(method, id, sub string) *http.Request {
+	r := httptest.NewRequest(method, "/api/chat/session/"+id, nil)
+	r = mux.SetURLVars(r, map[string]string{"id": id})
+	if sub != "" {
+		r = asCaller(r, sub)
+	}
+	return r
+}
+
+func TestDeleteSessionHandler(t *testing.T) {
+	s := newTestServer(t, answering("hi"), nil)
+	s.store.Append("sess-1", Message{Role: "user", Content: "hello"})
+
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus int
+	}{
+		{"existing session", "sess-1", http.StatusNoContent},
+		{"already deleted", "sess-1", http.StatusNotFound},
+		{"unknown session", "sess-2", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.deleteSessionHandler(rec, sessionRequest(http.MethodDelete, tt.id, ""))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSessionOwnership(t *testing.T) {
+	s := newTestServer(t, answering("hi"), map[string]string{
+		"AUTH_ENABLED": "true",
+		"JWT_SECRET":   testJWTSecret,
+	})
+
+	post := func(handler http.HandlerFunc, path, body, sub string) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		handler(rec, asCaller(r, sub))
+		return rec.Code
+	}
+
+	if code := post(s.chatHandler, "/api/chat", `{"question":"hello","session_id":"alice-1"}`, "alice"); code != http.StatusOK {
+		t.Fatalf("owner chat status = %d, want 200", code)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		body    string
+	}{
+		{"chat", s.chatHandler, "/api/chat", `{"question":"what did alice ask?","session_id":"alice-1"}`},
+		{"stream", s.chatStreamHandler, "/api/chat/stream", `{"question":"what did alice ask?","session_id":"alice-1"}`},
+		{"feedback", s.feedbackHandler, "/api/chat/feedback", `{"session_id":"alice-1","message_index":1,"rating":"down"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := post(tt.handler, tt.path, tt.body, "mallory"); code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", code)
+			}
+		})
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		s.deleteSessionHandler(rec, sessionRequest(http.MethodDelete, "alice-1", "mallory"))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", rec.Code)
+		}
+	})
+
+	if msgs := s.store.Load("alice-1"); len(msgs) != 2 || msgs[1].Rating != "" {
+		t.Errorf("session was modified by another caller: %+v", msgs)
+	}
+	if code := post(s.chatHandler, "/api/chat", `{"question":"again","session_id":"alice-1"}`, "alice"); code != http.StatusOK {
+		t.Errorf("owner follow-up status = %d, want 200", code)
+	}
+}
+
+func TestSessionTurnPolicies(t *testing.T) {
+	ask := func(s *Server, question string) *httptest.ResponseRecorder {
+		return postJSON(s.chatHandler, "/api/chat", `{"question":"`+question+`","session_id":"sess-1"}`)
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		s := newTestServer(t, answering("hi"), map[string]string{"MAX_TURNS_PER_SESSION": "2"})
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusConflict} {
+			if rec := ask(s, "hello"); rec.Code != want {
+				t.Fatalf("turn %d: status = %d, want %d", i+1, rec.Code, want)
+			}
+		}
+		if msgs := s.store.Load("sess-1"); len(msgs) != 4 {
+			t.Errorf("session holds %d messages, want 4", len(msgs))
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		s := newTestServer(t, answering("hi"), map[string]string{
+			"MAX_TURNS_PER_SESSION": "2",
+			"SESSION_TURN_POLICY":   "reset",
+		})
+		var indexes []int
+		for _, question := range []string{"one", "two", "three"} {
+			rec := ask(s, question)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+			}
+			var body ChatResponse
+			decodeBody(t, rec, &body)
+			indexes = append(indexes, *body.MessageIndex)
+		}
+		if want := []int{1, 3, 5}; indexes[0] != want[0] || indexes[1] != want[1] || indexes[2] != want[2] {
+			t.Errorf("message indexes = %v, want %v", indexes, want)
+		}
+		msgs := s.store.Load("sess-1")
+		if len(msgs) != 4 || msgs[0].Content != "two" {
+			t.Fatalf("session after reset = %+v, want turns two and three", msgs)
+		}
+
+		rate := func(index int) int {
+			body := fmt.Sprintf(`{"session_id":"sess-1","message_index":%d,"rating":"up"}`, index)
+			return postJSON(s.feedbackHandler, "/api/chat/feedback", body).Code
+		}
+		if code := rate(indexes[0]); code != http.StatusNotFound {
+			t.Errorf("feedback on a forgotten answer: status = %d, want 404", code)
+		}
+		if code := rate(indexes[1]); code != http.StatusNoContent {
+			t.Errorf("feedback on a kept answer: status = %d, want 204", code)
+		}
+		if msgs := s.store.Load("sess-1"); msgs[1].Rating != "up" || msgs[3].Rating != "" {
+			t.Errorf("the wrong answer was rated: %+v", msgs)
+		}
+	})
+}
+
+func TestMemoryStoreStableIndexes(t *testing.T) {
+	m := newMemoryStore(time.Hour)
+	for i := 0; i < 4; i++ {
+		m.Append("s", Message{Role: "user", Content: fmt.Sprint("q", i)})
+		m.Append("s", Message{Role: "assistant", Content: fmt.Sprint("a", i)})
+	}
+	m.Trim("s", 4)
+	if got := m.Append("s", Message{Role: "user", Content: "q4"}); got != 8 {
+		t.Errorf("index after trim = %d, want 8", got)
+	}
+
+	if _, _, ok := m.Rate("s", 1, "up"); ok {
+		t.Error("rated a trimmed answer")
+	}
+	question, answer, ok := m.Rate("s", 5, "down")
+	if !ok || answer.Content != "a2" || question.Content != "q2" {
+		t.Errorf("Rate(5) = %+v, %+v, %v; want q2, a2", question, answer, ok)
+	}
+	if _, _, ok := m.Rate("s", 4, "down"); ok {
+		t.Error("rated a question")
+	}
+}
+
+func TestMemoryStoreCleanup(t *testing.T) {
+	clock := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := newMemoryStore(30 * time.Minute)
+	m.now = func() time.Time { return clock }
+
+	m.Append("stale", Message{Role: "user", Content: "hi"})
+	m.Append("active", Message{Role: "user", Content: "hi"})
+
+	clock = clock.Add(20 * time.Minute)
+	m.Load("active")
+	if n := m.Cleanup(); n != 0 {
+		t.Fatalf("evicted %d sessions before the TTL", n)
+	}
+
+	clock = clock.Add(20 * time.Minute)
+	if n := m.Cleanup(); n != 1 {
+		t.Fatalf("evicted %d sessions, want the stale one", n)
+	}
+	if m.Load("stale") != nil {
+		t.Error("the stale session survived")
+	}
+	if m.Load("active") == nil {
+		t.Error("the recently used session was evicted")
+	}
+}
+
+func TestRunCleanerStops(t *testing.T) {
+	m := newMemoryStore(time.Minute)
+	m.Append("s", Message{Role: "user", Content: "hi"})
+	m.now = func() time.Time { return time.Now().Add(time.Hour) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	evicted := make(chan int, 1)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		m.RunCleaner(ctx, time.Millisecond, func(n int) { evicted <- n })
+	}()
+
+	select {
+	case n := <-evicted:
+		if n != 1 {
+			t.Errorf("cleaner evicted %d sessions, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the cleaner never evicted the idle session")
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("the cleaner kept running after shutdown")
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// StreamChunk is the payload of every incremental SSE event.
+type StreamChunk struct {
+	Delta string `json:"delta"`
+}
+
+// StreamDone is the payload of the terminal "done" event. It tells the client
+// why generation stopped and, when requested, how many tokens were used.
+type StreamDone struct {
+	FinishReason      string  `json:"finish_reason,omitempty"`
+	Usage             *Usage  `json:"usage,omitempty"`
+	SystemFingerprint string  `json:"system_fingerprint,omitempty"`
+	EstimatedCostUSD  float64 `json:"estimated_cost_usd,omitempty"`
+	MessageIndex      *int    `json:"message_index,omitempty"`
+	Turn              int     `json:"turn,omitempty"`
+	ExperimentVariant string  `json:"experiment_variant,omitempty"`
+	ReasoningEffort   string  `json:"reasoning_effort,omitempty"`
+}
+
+// writeSSE writes a single Server-Sent Event. An empty event name produces a
+// default "message" event.
+func writeSSE(w io.Writer, event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if event != "" {
+		if _, err := fmt.Fprintf(w, "event: %s\n", event); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
+}
+
+// finishReasonOffTopic ends a stream that carries the topic policy refusal.
+const finishReasonOffTopic = "off_topic"
+
+// startSSE sends the headers that open an event stream.
+func startSSE(w http.ResponseWriter, flusher http.Flusher) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+}
+
+// chatStreamHandler processes POST requests and streams the chat completion
+// back to the client as text/event-stream. A stream ends with either a "done"
+// event or, when OpenAI fails midway, an "error" event.
+func (s *Server) chatStreamHandler(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLogger(r)
+
+	if handlePreflight(w, r, "POST, OPTIONS") {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeInternalError, "Streaming is not supported")
+		return
+	}
+
+	if !s.requireClient(w, r) {
+		return
+	}
+
+	reqPayload, ok := s.decodeChatRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if !s.passesModeration(w, r, reqPayload.Question) {
+		return
+	}
+
+	if reqPayload.N != nil && *reqPayload.N > 1 {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Streaming supports a single answer only (n must be 1)")
+		return
+	}
+	if reqPayload.MaxAnswerChars != nil {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Streamed answers do not support max_answer_chars or continuation_token")
+		return
+	}
+	if reqPayload.Format == formatText {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, "Streaming supports the markdown format only")
+		return
+	}
+
+	if allowed, ok := s.checkTopic(w, r, reqPayload.Question); !ok {
+		return
+	} else if !allowed {
+		// The refusal is streamed like an answer so clients need no special case.
+		startSSE(w, flusher)
+		if err := writeSSE(w, "", StreamChunk{Delta: s.cfg.TopicPolicy.Refusal}); err == nil {
+			writeSSE(w, "done", StreamDone{FinishReason: finishReasonOffTopic})
+		}
+		flusher.Flush()
+		return
+	}
+
+	turn, ok := s.loadSessionHistory(w, r, &reqPayload)
+	if !ok {
+		return
+	}
+	variant := s.requestVariant(reqPayload)
+	if variant != "" {
+		log = log.WithField("experiment_variant", variant)
+	}
+
+	chatReq := s.buildChatRequest(reqPayload)
+	if dropped := s.trimContext(&chatReq); dropped > 0 {
+		log.Infof("dropped %d oldest history messages to fit the context budget", dropped)
+	}
+	if !s.fitsContextWindow(w, chatReq) {
+		return
+	}
+	if s.cfg.StreamIncludeUsage {
+		chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	// The stream lives as long as the client connection; a disconnect cancels
+	// the upstream request so we stop paying for tokens nobody reads.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// The slot is held for the whole stream since the upstream connection is.
+	release, err := s.acquireUpstream(ctx)
+	if err != nil {
+		if errors.Is(err, errUpstreamBusy) {
+			log.Warn("too many concurrent OpenAI calls")
+			s.upstreamBusy(w)
+		}
+		return
+	}
+	defer release()
+
+	ctx, span := startUpstreamSpan(ctx, "openai.chat_completion_stream", chatReq.Model)
+	var (
+		spanUsage *openai.Usage
+		spanErr   error
+	)
+	defer func() { endUpstreamSpan(span, spanUsage, spanErr) }()
+
+	var stream ChatStream
+	err = s.guardUpstream(func() error {
+		var err error
+		stream, err = s.clientFor(ctx).CreateChatCompletionStream(ctx, chatReq)
+		return err
+	})
+	if err != nil {
+		spanErr = err
+		if isBreakerOpen(err) {
+			s.upstreamUnavailable(w)
+			return
+		}
+		if isContextLengthExceeded(err) {
+			log.WithError(err).Warn("OpenAI rejected the prompt as too long")
+			s.errorResponse(w, http.StatusBadRequest, ErrCodeContextTooLong, contextTooLongMessage)
+			return
+		}
+		logUpstreamError(log, err, "error opening OpenAI stream")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeUpstreamError, "Failed to fetch response from OpenAI")
+		return
+	}
+	defer stream.Close()
+
+	startSSE(w, flusher)
+
+	var (
+		answer strings.Builder
+		done   StreamDone
+	)
+	// cancelEarly stops the upstream stream once the client can no longer
+	// receive it.
+	cancelEarly := func(reason string) {
+		cancel()
+		stream.Close()
+		log.WithField("streamed_chars", answer.Len()).Infof("stream cancelled early: %s", reason)
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			cancelEarly("client disconnected")
+			return
+		default:
+		}
+
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			spanErr = err
+			if r.Context().Err() != nil {
+				cancelEarly("client disconnected")
+				return
+			}
+			// The 200 status is already sent, so the failure is reported as a
+			// distinct event that clients can tell apart from "done".
+			log.WithError(err).WithField("streamed_chars", answer.Len()).Error("error reading OpenAI stream")
+			payload := ErrorResponse{
+				Error:     ErrorDetail{Code: ErrCodeUpstreamError, Message: "The answer was interrupted"},
+				RequestID: w.Header().Get(requestIDHeader),
+			}
+			if err := writeSSE(w, "error", payload); err != nil {
+				log.WithError(err).Warn("failed to write stream error event")
+				return
+			}
+			flusher.Flush()
+			return
+		}
+
+		// With usage enabled the last chunk carries only the token counts.
+		if chunk.Usage != nil {
+			spanUsage = chunk.Usage
+			done.Usage = &Usage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+				TotalTokens:      chunk.Usage.TotalTokens,
+			}
+		}
+		if chunk.SystemFingerprint != "" {
+			done.SystemFingerprint = chunk.SystemFingerprint
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			done.FinishReason = string(reason)
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		answer.WriteString(chunk.Choices[0].Delta.Content)
+		if err := writeSSE(w, "", StreamChunk{Delta: chunk.Choices[0].Delta.Content}); err != nil {
+			cancelEarly(fmt.Sprintf("failed to write stream chunk: %v", err))
+			return
+		}
+		flusher.Flush()
+	}
+
+	if index := s.recordExchange(r, reqPayload.SessionID, reqPayload.Question, answer.String()); index >= 0 {
+		done.MessageIndex = &index
+	}
+	done.Turn = turn
+	done.ExperimentVariant = variant
+	done.ReasoningEffort = chatReq.ReasoningEffort
+	s.recordVariant(variant)
+	if done.Usage != nil {
+		done.EstimatedCostUSD = s.recordCost(chatReq.Model, *done.Usage)
+	}
+
+	if err := writeSSE(w, "done", done); err != nil {
+		log.WithError(err).Warn("failed to write stream terminator")
+		return
+	}
+	flusher.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestStreamCancelledOnDisconnect(t *testing.T) {
+	waiting := make(chan struct{})
+	upstream := &fakeStream{chunks: []string{"Not a "}, hang: true, waiting: waiting}
+	client := &fakeClient{stream: func(ctx context.Context, _ openai.ChatCompletionRequest) (ChatStream, error) {
+		upstream.ctx = ctx
+		return upstream, nil
+	}}
+	s := newTestServer(t, client, nil)
+	logger, hook := logtest.NewNullLogger()
+	s.logger = logger
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/api/chat/stream", strings.NewReader(`{"question":"Is a salmon a fish?"}`)).WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		s.chatStreamHandler(rec, r)
+	}()
+
+	// Disconnect once the first chunk is out and the handler waits for more.
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("the stream never reached its first chunk")
+	}
+	disconnect()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("the handler kept reading after the client disconnected")
+	}
+
+	if upstream.ctx.Err() == nil {
+		t.Error("the upstream context was not cancelled")
+	}
+	if !upstream.closed {
+		t.Error("the upstream stream was not closed")
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, `"delta":"Not a "`) {
+		t.Errorf("the first chunk was not streamed: %q", body)
+	}
+	if strings.Contains(body, "event: done") {
+		t.Errorf("a cancelled stream sent the done event: %q", body)
+	}
+	if entry := hook.LastEntry(); entry == nil || !strings.Contains(entry.Message, "stream cancelled early") {
+		t.Errorf("last log entry = %v, want the early cancellation", entry)
+	}
+}
+
+// sseEvents splits an SSE body into its events, keyed "" for unnamed ones.
+func sseEvents(body string) []struct{ name, data string } {
+	var events []struct{ name, data string }
+	for _, block := range strings.Split(strings.TrimSpace(body), "\n\n") {
+		var ev struct{ name, data string }
+		for _, line := range strings.Split(block, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				ev.name = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				ev.data = v
+			}
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func TestStreamFailsMidway(t *testing.T) {
+	client := answering("Not a fish.")
+	client.stream = func(ctx context.Context, _ openai.ChatCompletionRequest) (ChatStream, error) {
+		return &fakeStream{ctx: ctx, chunks: []string{"Not a "}, err: serverError}, nil
+	}
+	s := newTestServer(t, client, map[string]string{"CACHE_ENABLED": "true"})
+
+	const body = `{"question":"Is a salmon a fish?","session_id":"sess-1"}`
+	rec := postJSON(s.chatStreamHandler, "/api/chat/stream", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (the stream had started)", rec.Code)
+	}
+	events := sseEvents(rec.Body.String())
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want the chunk and the error: %q", len(events), rec.Body.String())
+	}
+	if events[0].name != "" || events[0].data != `{"delta":"Not a "}` {
+		t.Errorf("first event = %+v, want the first chunk", events[0])
+	}
+	if events[1].name != "error" {
+		t.Fatalf("last event = %q, want error", events[1].name)
+	}
+	var errEvent ErrorResponse
+	if err := json.Unmarshal([]byte(events[1].data), &errEvent); err != nil {
+		t.Fatalf("error event is not JSON: %v", err)
+	}
+	if errEvent.Error.Code != ErrCodeUpstreamError || errEvent.Error.Message != "The answer was interrupted" {
+		t.Errorf("error event = %+v", errEvent.Error)
+	}
+
+	if history := s.store.Load("sess-1"); len(history) != 0 {
+		t.Errorf("the interrupted exchange was stored: %+v", history)
+	}
+	// Nothing was cached either: the same question goes to OpenAI again.
+	if rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?"}`); rec.Code != http.StatusOK {
+		t.Fatalf("follow-up status = %d, want 200", rec.Code)
+	}
+	if got := len(client.Requests()); got != 2 {
+		t.Errorf("OpenAI was called %d times, want the stream and the follow-up", got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PromptData holds the variables a system prompt template may use. Only
+// these fields are available, so a typo fails the startup check instead of
+// leaking into prompts.
+type PromptData struct {
+	// Date is today's date in UTC, formatted as 2006-01-02.
+	Date string
+	// UserName is the "name" claim of the caller's token, or empty.
+	UserName string
+}
+
+// checkPromptTemplate parses prompt as a text/template and renders it once
+// with empty data to catch references to unknown variables.
+func checkPromptTemplate(prompt string) error {
+	tmpl, err := template.New("system").Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(new(strings.Builder), PromptData{})
+}
+
+// renderPrompt fills in the template variables of prompt. Prompts without
+// actions are returned as is. Prompts are checked before they are accepted,
+// so a rendering failure falls back to the raw text.
+func renderPrompt(prompt string, data PromptData) string {
+	if !strings.Contains(prompt, "{{") {
+		return prompt
+	}
+	tmpl, err := template.New("system").Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return prompt
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return prompt
+	}
+	return b.String()
+}
+
+// promptData collects the template variables for the request.
+func promptData(r *http.Request) PromptData {
+	data := PromptData{Date: time.Now().UTC().Format(time.DateOnly)}
+	if claims, ok := claimsFromContext(r); ok {
+		data.UserName, _ = claims["name"].(string)
+	}
+	return data
+}
+
+// validatePromptTemplates checks every configured system prompt.
+func validatePromptTemplates(cfg ServerConfig) error {
+	if err := checkPromptTemplate(cfg.SystemPrompt); err != nil {
+		return fmt.Errorf("system prompt from %s: %w", cfg.SystemPromptSource, err)
+	}
+	if cfg.Experiment != nil {
+		if err := checkPromptTemplate(cfg.Experiment.PromptB); err != nil {
+			return fmt.Errorf("PROMPT_EXPERIMENT_B_FILE: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRenderPrompt(t *testing.T) {
+	data := PromptData{Date: "2024-05-01", UserName: "Ada"}
+	tests := []struct {
+		name   string
+		prompt string
+		data   PromptData
+		want   string
+	}{
+		{"no actions", "You are a fish expert.", data, "You are a fish expert."},
+		{"substitution", "Today is {{.Date}}. Greet {{.UserName}}.", data, "Today is 2024-05-01. Greet Ada."},
+		{"conditional", "Hi{{if .UserName}} {{.UserName}}{{end}}!", PromptData{}, "Hi!"},
+		{"missing value", "Greet {{.UserName}}.", PromptData{}, "Greet ."},
+		{"unknown variable", "Greet {{.Nickname}}.", data, "Greet {{.Nickname}}."},
+		{"syntax error", "Greet {{.UserName}.", data, "Greet {{.UserName}."},
+		{"escaped braces", `Write {{"{{"}}name{{"}}"}} literally.`, data, "Write {{name}} literally."},
+		{"value is not re-evaluated", "Greet {{.UserName}}.", PromptData{UserName: "{{.Date}}"}, "Greet {{.Date}}."},
+		{"value is not HTML-escaped", "Greet {{.UserName}}.", PromptData{UserName: `<Ada & "Bob">`}, `Greet <Ada & "Bob">.`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderPrompt(tt.prompt, tt.data); got != tt.want {
+				t.Errorf("renderPrompt(%q) = %q, want %q", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckPromptTemplate(t *testing.T) {
+	tests := map[string]bool{
+		"You are a fish expert.":             true,
+		"Today is {{.Date}}, {{.UserName}}.": true,
+		"Greet {{.Nickname}}.":               false,
+		"Greet {{.UserName}.":                false,
+		"{{if .UserName}}unterminated":       false,
+	}
+	for prompt, valid := range tests {
+		if err := checkPromptTemplate(prompt); (err == nil) != valid {
+			t.Errorf("checkPromptTemplate(%q) = %v, want valid=%v", prompt, err, valid)
+		}
+	}
+}
+
+func TestPromptData(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", nil)
+	if data := promptData(r); data.UserName != "" || data.Date != time.Now().UTC().Format(time.DateOnly) {
+		t.Errorf("anonymous promptData = %+v", data)
+	}
+
+	r = asCaller(r, "user-1")
+	claims, _ := claimsFromContext(r)
+	claims["name"] = "Ada"
+	if data := promptData(r); data.UserName != "Ada" {
+		t.Errorf("UserName = %q, want the name claim", data.UserName)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	openai "github.com/sashabaranov/go-openai"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// tenantHeader selects the tenant when the JWT carries no tenant claim.
+	tenantHeader = "X-Tenant-ID"
+	// defaultTenantID is served with the server's own OpenAI client.
+	defaultTenantID = "default"
+)
+
+// tenantRequests counts API requests per tenant and outcome.
+var tenantRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tschabot_tenant_requests_total",
+	Help: "API requests by tenant and outcome (accepted, rate_limited, unknown).",
+}, []string{"tenant", "outcome"})
+
+// Tenant is a customer served with its own OpenAI key and request quota.
+type Tenant struct {
+	ID             string  `json:"id"`
+	APIKey         string  `json:"api_key"`
+	RateLimitRPS   float64 `json:"rate_limit_rps"`
+	RateLimitBurst int     `json:"rate_limit_burst"`
+}
+
+// tenant is a registered Tenant with its client and quota. A nil client
+// means the server's default client.
+type tenant struct {
+	id      string
+	client  ChatClient
+	limiter *rate.Limiter
+}
+
+// loadTenants reads the JSON list of tenants in path. An empty path disables
+// multi-tenancy. API keys may be omitted in mock mode only.
+func loadTenants(path string, mock bool) ([]Tenant, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read TENANTS_FILE: %w", err)
+	}
+	var tenants []Tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, fmt.Errorf("parse TENANTS_FILE: %w", err)
+	}
+
+	seen := make(map[string]bool, len(tenants))
+	for i, t := range tenants {
+		switch {
+		case !validID(t.ID):
+			return nil, fmt.Errorf("TENANTS_FILE: tenant %d has an invalid id %q", i, t.ID)
+		case t.ID == defaultTenantID:
+			return nil, fmt.Errorf("TENANTS_FILE: tenant id %q is reserved", defaultTenantID)
+		case seen[t.ID]:
+			return nil, fmt.Errorf("TENANTS_FILE: duplicate tenant %q", t.ID)
+		case t.APIKey == "" && !mock:
+			return nil, fmt.Errorf("TENANTS_FILE: tenant %q has no api_key", t.ID)
+		case t.RateLimitRPS < 0 || t.RateLimitBurst < 0:
+			return nil, fmt.Errorf("TENANTS_FILE: rate limits of tenant %q must not be negative", t.ID)
+		}
+		seen[t.ID] = true
+	}
+	return tenants, nil
+}
+
+// newTenantRegistry creates a client and limiter for every configured tenant.
+func newTenantRegistry(cfg ServerConfig) map[string]*tenant {
+	if len(cfg.Tenants) == 0 {
+		return nil
+	}
+	registry := map[string]*tenant{defaultTenantID: {id: defaultTenantID}}
+	for _, t := range cfg.Tenants {
+		entry := &tenant{id: t.ID}
+		if cfg.MockMode {
+			entry.client = newMockClient(cfg.MockLatency)
+		} else {
+			entry.client = newOpenAIClient(openai.NewClientWithConfig(openAIConfig(t.APIKey, cfg)))
+		}
+		if t.RateLimitRPS > 0 {
+			burst := t.RateLimitBurst
+			if burst == 0 {
+				burst = int(math.Ceil(t.RateLimitRPS))
+			}
+			entry.limiter = rate.NewLimiter(rate.Limit(t.RateLimitRPS), burst)
+		}
+		registry[t.ID] = entry
+	}
+	return registry
+}
+
+// requestTenantID picks the tenant of a request. With auth enabled it is the
+// JWT "tenant" claim, or the default tenant for tokens without one; the
+// X-Tenant-ID header may only repeat that choice, so callers cannot switch
+// to another tenant's key and quota. Without auth the header selects the
+// tenant, falling back to the default tenant.
+func (s *Server) requestTenantID(r *http.Request) (string, error) {
+	header := r.Header.Get(tenantHeader)
+	if !s.cfg.AuthEnabled {
+		if header != "" {
+			return header, nil
+		}
+		return defaultTenantID, nil
+	}
+
+	id := defaultTenantID
+	if claims, ok := claimsFromContext(r); ok {
+		if claim, _ := claims["tenant"].(string); claim != "" {
+			id = claim
+		}
+	}
+	if header != "" && header != id {
+		return "", fmt.Errorf("%s does not match the tenant of the auth token", tenantHeader)
+	}
+	return id, nil
+}
+
+// tenantMiddleware resolves the request's tenant, enforces its quota and
+// stores it in the context for clientFor. It is a no-op without TENANTS_FILE.
+func (s *Server) tenantMiddleware(next http.Handler) http.Handler {
+	if len(s.tenants) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id, err := s.requestTenantID(r)
+		if err != nil {
+			s.errorResponse(w, http.StatusForbidden, ErrCodeUnknownTenant, err.Error())
+			return
+		}
+		t, ok := s.tenants[id]
+		if !ok {
+			tenantRequests.WithLabelValues("", "unknown").Inc()
+			s.requestLogger(r).Warnf("rejected request for unknown tenant %q", id)
+			s.errorResponse(w, http.StatusForbidden, ErrCodeUnknownTenant, "Unknown tenant")
+			return
+		}
+
+		if t.limiter != nil {
+			reservation := t.limiter.Reserve()
+			if delay := reservation.Delay(); delay > 0 {
+				reservation.Cancel()
+				tenantRequests.WithLabelValues(id, "rate_limited").Inc()
+				w.Header().Set("Retry-After", retryAfterSeconds(delay))
+				s.errorResponse(w, http.StatusTooManyRequests, ErrCodeRateLimited, "Tenant quota exceeded")
+				return
+			}
+		}
+
+		tenantRequests.WithLabelValues(id, "accepted").Inc()
+		ctx := context.WithValue(r.Context(), tenantKey, t)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// tenantID returns the ID of the tenant in ctx, or "" without multi-tenancy.
+func tenantID(ctx context.Context) string {
+	if t, ok := ctx.Value(tenantKey).(*tenant); ok {
+		return t.id
+	}
+	return ""
+}
+
+// clientFor returns the OpenAI client of the tenant in ctx, falling back to
+// the server's default client.
+func (s *Server) clientFor(ctx context.Context) ChatClient {
+	if t, ok := ctx.Value(tenantKey).(*tenant); ok && t.client != nil {
+		return t.client
+	}
+	return s.chatClient()
+}
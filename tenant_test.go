@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTenantServer serves acme and globex, each answering with its own fake
+// client, next to the default tenant.
+func newTenantServer(t *testing.T, env map[string]string) (*Server, map[string]*fakeClient) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	tenants := `[{"id":"acme","api_key":"sk-acme","rate_limit_rps":0.001,"rate_limit_burst":2},{"id":"globex","api_key":"sk-globex"}]`
+	if err := os.WriteFile(path, []byte(tenants), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if env == nil {
+		env = map[string]string{}
+	}
+	env["TENANTS_FILE"] = path
+
+	clients := map[string]*fakeClient{
+		defaultTenantID: answering("default answer"),
+		"acme":          answering("acme answer"),
+		"globex":        answering("globex answer"),
+	}
+	s := newTestServer(t, clients[defaultTenantID], env)
+	for id, c := range clients {
+		if id != defaultTenantID {
+			s.tenants[id].client = c
+		}
+	}
+	return s, clients
+}
+
+// askAs asks question through the tenant middleware as tenant.
+func askAs(s *Server, tenant, question string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"question":"`+question+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if tenant != "" {
+		r.Header.Set(tenantHeader, tenant)
+	}
+	rec := httptest.NewRecorder()
+	s.tenantMiddleware(http.HandlerFunc(s.chatHandler)).ServeHTTP(rec, r)
+	return rec
+}
+
+func TestTenantRouting(t *testing.T) {
+	s, clients := newTenantServer(t, nil)
+
+	tests := []struct {
+		tenant     string
+		wantStatus int
+		wantAnswer string
+	}{
+		{"", http.StatusOK, "default answer"},
+		{"acme", http.StatusOK, "acme answer"},
+		{"globex", http.StatusOK, "globex answer"},
+		{"initech", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			rec := askAs(s, tt.tenant, "who are you?")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantAnswer == "" {
+				return
+			}
+			var body ChatResponse
+			decodeBody(t, rec, &body)
+			if body.Answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", body.Answer, tt.wantAnswer)
+			}
+		})
+	}
+	for id, c := range clients {
+		if got := len(c.Requests()); got != 1 {
+			t.Errorf("tenant %s client got %d requests, want 1", id, got)
+		}
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	s, _ := newTenantServer(t, nil)
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := askAs(s, "acme", "who are you?")
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+	}
+	if rec := askAs(s, "globex", "who are you?"); rec.Code != http.StatusOK {
+		t.Errorf("acme's quota limited globex: status = %d", rec.Code)
+	}
+}
+
+func TestCacheIsPerTenant(t *testing.T) {
+	s, clients := newTenantServer(t, map[string]string{"CACHE_ENABLED": "true"})
+
+	for _, tenant := range []string{"acme", "globex", "acme"} {
+		rec := askAs(s, tenant, "what is a salmon?")
+		var body ChatResponse
+		decodeBody(t, rec, &body)
+		if want := tenant + " answer"; body.Answer != want {
+			t.Errorf("tenant %s got %q, want %q", tenant, body.Answer, want)
+		}
+	}
+	if got := len(clients["acme"].Requests()); got != 1 {
+		t.Errorf("acme's repeated question reached OpenAI %d times, want 1 (cached)", got)
+	}
+	if got := len(clients["globex"].Requests()); got != 1 {
+		t.Errorf("globex client got %d requests, want 1", got)
+	}
+}
+
+func TestTenantFromAuthToken(t *testing.T) {
+	s, _ := newTenantServer(t, map[string]string{
+		"AUTH_ENABLED": "true",
+		"JWT_SECRET":   testJWTSecret,
+	})
+	handler := s.authMiddleware(s.tenantMiddleware(http.HandlerFunc(s.chatHandler)))
+
+	tests := []struct {
+		name       string
+		claim      string
+		header     string
+		wantStatus int
+		wantAnswer string
+	}{
+		{"claim", "acme", "", http.StatusOK, "acme answer"},
+		{"header repeats the claim", "acme", "acme", http.StatusOK, "acme answer"},
+		{"header contradicts the claim", "acme", "globex", http.StatusForbidden, ""},
+		{"no claim", "", "", http.StatusOK, "default answer"},
+		{"header overrides a token without a claim", "", "globex", http.StatusForbidden, ""},
+		{"header names the default tenant", "", defaultTenantID, http.StatusOK, "default answer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.claim != "" {
+				claims["tenant"] = tt.claim
+			}
+			r := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(`{"question":"who are you?"}`))
+			r.Header.Set("Content-Type", "application/json")
+			r.AddCookie(&http.Cookie{Name: "auth_token", Value: signToken(t, jwt.SigningMethodHS256, claims)})
+			if tt.header != "" {
+				r.Header.Set(tenantHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantAnswer == "" {
+				var body ErrorResponse
+				decodeBody(t, rec, &body)
+				if body.Error.Code != ErrCodeUnknownTenant {
+					t.Errorf("code = %q, want %q", body.Error.Code, ErrCodeUnknownTenant)
+				}
+				return
+			}
+			var body ChatResponse
+			decodeBody(t, rec, &body)
+			if body.Answer != tt.wantAnswer {
+				t.Errorf("answer = %q, want %q", body.Answer, tt.wantAnswer)
+			}
+		})
+	}
+}
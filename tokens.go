@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// modelContextWindows maps models to their context window in tokens.
+var modelContextWindows = map[string]int{
+	"gpt-4o":        128000,
+	"gpt-4o-mini":   128000,
+	"gpt-4-turbo":   128000,
+	"gpt-3.5-turbo": 16385,
+	"o3-mini":       200000,
+}
+
+// defaultContextWindow is assumed for models missing from modelContextWindows.
+const defaultContextWindow = 8192
+
+// Token estimation constants. OpenAI's tokenizers average roughly four
+// characters per token for English text, and every message carries a small
+// fixed overhead for its role and separators.
+const (
+	charsPerToken    = 4
+	tokensPerMessage = 4
+	tokensPerReply   = 3
+)
+
+// contextWindow returns the context window of model.
+func contextWindow(model string) int {
+	if n, ok := modelContextWindows[model]; ok {
+		return n
+	}
+	return defaultContextWindow
+}
+
+// estimateTokens approximates the prompt size of messages without running a
+// real tokenizer. It errs on the high side for non-English text.
+func estimateTokens(messages []openai.ChatCompletionMessage) int {
+	total := tokensPerReply
+	for _, msg := range messages {
+		total += tokensPerMessage + (utf8.RuneCountInString(msg.Content)+charsPerToken-1)/charsPerToken
+		for _, part := range msg.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeImageURL {
+				total += imageTokens
+				continue
+			}
+			total += (utf8.RuneCountInString(part.Text) + charsPerToken - 1) / charsPerToken
+		}
+	}
+	return total
+}
+
+// fitsContextWindow rejects requests whose estimated prompt still exceeds the
+// prompt budget after trimming, writing a 400 response and returning false.
+func (s *Server) fitsContextWindow(w http.ResponseWriter, chatReq openai.ChatCompletionRequest) bool {
+	budget := s.promptBudget(chatReq)
+	needed := estimateTokens(chatReq.Messages)
+	if needed <= budget {
+		return true
+	}
+	s.errorResponse(w, http.StatusBadRequest, ErrCodeContextTooLong,
+		fmt.Sprintf("The conversation is too long for model %s (about %d prompt tokens, limit %d); shorten the question", chatReq.Model, needed, budget))
+	return false
+}
+
+// promptBudget is the number of prompt tokens chatReq may use: the model's
+// context window minus the requested completion, further capped by
+// CONTEXT_TOKEN_BUDGET when set.
+func (s *Server) promptBudget(chatReq openai.ChatCompletionRequest) int {
+	budget := contextWindow(chatReq.Model) - max(chatReq.MaxTokens, chatReq.MaxCompletionTokens)
+	if s.cfg.ContextTokenBudget > 0 && s.cfg.ContextTokenBudget < budget {
+		budget = s.cfg.ContextTokenBudget
+	}
+	return budget
+}
+
+// trimContext evicts the oldest history messages until the prompt fits the
+// budget. The system prompt and the newest message are always kept, and a
+// dangling assistant reply is dropped together with its question so the
+// history still starts with a user turn. It returns how many messages were
+// removed.
+func (s *Server) trimContext(chatReq *openai.ChatCompletionRequest) int {
+	messages := chatReq.Messages
+	if len(messages) <= 2 || messages[0].Role != openai.ChatMessageRoleSystem {
+		return 0
+	}
+
+	budget := s.promptBudget(*chatReq)
+	system, history := messages[0], messages[1:]
+	dropped := 0
+	for len(history) > 1 && estimateTokens(append([]openai.ChatCompletionMessage{system}, history...)) > budget {
+		history = history[1:]
+		dropped++
+		for len(history) > 1 && history[0].Role != openai.ChatMessageRoleUser {
+			history = history[1:]
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		chatReq.Messages = append([]openai.ChatCompletionMessage{system}, history...)
+	}
+	return dropped
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// msg builds a chat message whose content estimates to tokens tokens.
+func msg(role string, tokens int) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: role, Content: strings.Repeat("x", tokens*charsPerToken)}
+}
+
+func TestTrimContext(t *testing.T) {
+	// Each turn costs 14 tokens, the system prompt 104; with the reply
+	// overhead the whole conversation is 177 tokens.
+	conversation := func() []openai.ChatCompletionMessage {
+		return []openai.ChatCompletionMessage{
+			msg(openai.ChatMessageRoleSystem, 100),
+			msg(openai.ChatMessageRoleUser, 10),
+			msg(openai.ChatMessageRoleAssistant, 10),
+			msg(openai.ChatMessageRoleUser, 10),
+			msg(openai.ChatMessageRoleAssistant, 10),
+			msg(openai.ChatMessageRoleUser, 10),
+		}
+	}
+
+	tests := []struct {
+		name        string
+		budget      int
+		wantDropped int
+		wantRoles   []string
+	}{
+		{"fits", 177, 0, []string{"system", "user", "assistant", "user", "assistant", "user"}},
+		{"drops the oldest turn", 150, 2, []string{"system", "user", "assistant", "user"}},
+		{"budget below the system prompt", 10, 4, []string{"system", "user"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, answering("hi"), nil)
+			s.cfg.ContextTokenBudget = tt.budget
+			chatReq := openai.ChatCompletionRequest{Model: "gpt-4o", Messages: conversation()}
+			system, newest := chatReq.Messages[0], chatReq.Messages[len(chatReq.Messages)-1]
+
+			if dropped := s.trimContext(&chatReq); dropped != tt.wantDropped {
+				t.Errorf("dropped %d messages, want %d", dropped, tt.wantDropped)
+			}
+			var roles []string
+			for _, m := range chatReq.Messages {
+				roles = append(roles, m.Role)
+			}
+			if strings.Join(roles, ",") != strings.Join(tt.wantRoles, ",") {
+				t.Errorf("roles = %v, want %v", roles, tt.wantRoles)
+			}
+			if first := chatReq.Messages[0]; first.Role != system.Role || first.Content != system.Content {
+				t.Error("the system prompt was dropped")
+			}
+			if last := chatReq.Messages[len(chatReq.Messages)-1]; last.Content != newest.Content {
+				t.Error("the newest message was dropped")
+			}
+		})
+	}
+}
+
+func TestTrimContextWithoutSystemPrompt(t *testing.T) {
+	s := newTestServer(t, answering("hi"), nil)
+	s.cfg.ContextTokenBudget = 10
+	chatReq := openai.ChatCompletionRequest{Model: "gpt-4o", Messages: []openai.ChatCompletionMessage{
+		msg(openai.ChatMessageRoleUser, 10),
+		msg(openai.ChatMessageRoleAssistant, 10),
+		msg(openai.ChatMessageRoleUser, 10),
+	}}
+	if dropped := s.trimContext(&chatReq); dropped != 0 || len(chatReq.Messages) != 3 {
+		t.Errorf("dropped %d messages without a system prompt, want none", dropped)
+	}
+}
+
+func TestChatTrimsHistory(t *testing.T) {
+	client := answering("hi")
+	s := newTestServer(t, client, nil)
+	base := s.buildChatRequest(ChatRequest{Question: "And now?"})
+	s.cfg.ContextTokenBudget = estimateTokens(base.Messages) + 50
+
+	long := strings.Repeat("blub ", 200)
+	history := `[{"role":"user","content":"` + long + `"},{"role":"assistant","content":"` + long + `"},` +
+		`{"role":"user","content":"Are you a fish?"},{"role":"assistant","content":"No."}]`
+	rec := postJSON(s.chatHandler, "/api/chat", `{"question":"And now?","history":`+history+`}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	msgs := client.Requests()[0].Messages
+	var contents []string
+	for _, m := range msgs {
+		contents = append(contents, m.Content)
+	}
+	want := []string{base.Messages[0].Content, "Are you a fish?", "No.", "And now?"}
+	if strings.Join(contents, "|") != strings.Join(want, "|") {
+		t.Errorf("messages sent upstream = %q, want %q", contents, want)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// maxToolRounds bounds how many tool-call round trips a single chat request may
+// trigger before we give up on a final answer.
+const maxToolRounds = 5
+
+// errToolRoundsExceeded is returned when the model keeps calling tools.
+var errToolRoundsExceeded = errors.New("model did not produce an answer within the tool call limit")
+
+// errEmptyAnswer is returned when OpenAI answers twice in a row with a choice
+// that carries neither content nor a tool call.
+var errEmptyAnswer = errors.New("OpenAI returned an empty answer")
+
+// ToolHandler executes a tool call. It receives the model-supplied arguments as
+// raw JSON and returns the result that is fed back to the model.
+type ToolHandler func(ctx context.Context, arguments string) (string, error)
+
+type registeredTool struct {
+	definition openai.FunctionDefinition
+	handler    ToolHandler
+}
+
+// RegisterTool makes a function available to the model. Registering a tool
+// with an existing name replaces it.
+func (s *Server) RegisterTool(definition openai.FunctionDefinition, handler ToolHandler) {
+	if s.tools == nil {
+		s.tools = make(map[string]registeredTool)
+	}
+	s.tools[definition.Name] = registeredTool{definition: definition, handler: handler}
+}
+
+// toolDefinitions returns the registered tools in a stable order.
+func (s *Server) toolDefinitions() []openai.Tool {
+	names := make([]string, 0, len(s.tools))
+	for name := range s.tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tools := make([]openai.Tool, 0, len(names))
+	for _, name := range names {
+		def := s.tools[name].definition
+		tools = append(tools, openai.Tool{Type: openai.ToolTypeFunction, Function: &def})
+	}
+	return tools
+}
+
+// createChatCompletion calls OpenAI and resolves any tool calls. An empty
+// answer is retried once; if the second attempt is empty too, errEmptyAnswer
+// is returned instead of handing the client a blank reply.
+func (s *Server) createChatCompletion(ctx context.Context, chatReq openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := s.resolveChatCompletion(ctx, chatReq)
+	if err != nil || !emptyAnswer(resp) {
+		return resp, err
+	}
+
+	log := s.contextLogger(ctx)
+	log.WithField("finish_reason", resp.Choices[0].FinishReason).Warn("OpenAI returned an empty answer, retrying once")
+	usage := resp.Usage
+
+	resp, err = s.resolveChatCompletion(ctx, chatReq)
+	if err != nil {
+		return resp, err
+	}
+	resp.Usage.PromptTokens += usage.PromptTokens
+	resp.Usage.CompletionTokens += usage.CompletionTokens
+	resp.Usage.TotalTokens += usage.TotalTokens
+	if emptyAnswer(resp) {
+		log.WithField("finish_reason", resp.Choices[0].FinishReason).Error("OpenAI returned an empty answer again")
+		return resp, errEmptyAnswer
+	}
+	return resp, nil
+}
+
+// emptyAnswer reports whether the first choice has no text and no tool call.
+func emptyAnswer(resp openai.ChatCompletionResponse) bool {
+	if len(resp.Choices) == 0 {
+		return false
+	}
+	msg := resp.Choices[0].Message
+	return strings.TrimSpace(msg.Content) == "" && len(msg.ToolCalls) == 0
+}
+
+// resolveChatCompletion calls OpenAI and resolves any tool calls by
+// dispatching them to the registered handlers, looping until the model
+// answers. Token usage is summed across all rounds.
+func (s *Server) resolveChatCompletion(ctx context.Context, chatReq openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if len(s.tools) == 0 {
+		return s.completeWithRetry(ctx, &chatReq)
+	}
+
+	chatReq.Tools = s.toolDefinitions()
+	var usage openai.Usage
+
+	for round := 0; round < maxToolRounds; round++ {
+		resp, err := s.completeWithRetry(ctx, &chatReq)
+		if err != nil {
+			return resp, err
+		}
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.TotalTokens += resp.Usage.TotalTokens
+
+		if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+			resp.Usage = usage
+			return resp, nil
+		}
+
+		msg := resp.Choices[0].Message
+		chatReq.Messages = append(chatReq.Messages, msg)
+		for _, call := range msg.ToolCalls {
+			chatReq.Messages = append(chatReq.Messages, openai.ChatCompletionMessage{
+				Role:       openai.ChatMessageRoleTool,
+				Content:    s.callTool(ctx, call),
+				ToolCallID: call.ID,
+			})
+		}
+	}
+
+	return openai.ChatCompletionResponse{}, errToolRoundsExceeded
+}
+
+// callTool runs a single tool call. Failures are reported back to the model as
+// the tool result so it can recover or explain the problem.
+func (s *Server) callTool(ctx context.Context, call openai.ToolCall) string {
+	tool, ok := s.tools[call.Function.Name]
+	if !ok {
+		s.contextLogger(ctx).Warnf("model requested unknown tool %q", call.Function.Name)
+		return fmt.Sprintf("error: unknown tool %q", call.Function.Name)
+	}
+
+	result, err := tool.handler(ctx, call.Function.Arguments)
+	if err != nil {
+		s.contextLogger(ctx).WithError(err).Warnf("tool %q failed", call.Function.Name)
+		return "error: " + err.Error()
+	}
+	return result
+}
+
+// currentTimeTool is a demo tool reporting the current time in a time zone.
+var currentTimeTool = openai.FunctionDefinition{
+	Name:        "get_current_time",
+	Description: "Get the current date and time in an IANA time zone such as Europe/Berlin.",
+	Parameters: json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"timezone": {"type": "string", "description": "IANA time zone name, defaults to UTC"}
+		}
+	}`),
+}
+
+// currentTimeHandler implements currentTimeTool.
+func currentTimeHandler(_ context.Context, arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			return "", fmt.Errorf("invalid arguments: %w", err)
+		}
+	}
+	if args.Timezone == "" {
+		args.Timezone = "UTC"
+	}
+
+	loc, err := time.LoadLocation(args.Timezone)
+	if err != nil {
+		return "", fmt.Errorf("unknown time zone %q", args.Timezone)
+	}
+	return time.Now().In(loc).Format(time.RFC1123), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+// answeringInTurn returns a fakeClient that answers its calls with answers
+// in order, repeating the last one.
+func answeringInTurn(answers ...string) *fakeClient {
+	calls := 0
+	return &fakeClient{complete: func(context.Context, openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+		resp := completion(answers[min(calls, len(answers)-1)])
+		calls++
+		if resp.Choices[0].Message.Content == "" {
+			resp.Choices[0].FinishReason = openai.FinishReasonLength
+		}
+		return resp, nil
+	}}
+}
+
+func TestEmptyAnswerIsRetried(t *testing.T) {
+	client := answeringInTurn("", "Yes.")
+	s := newTestServer(t, client, nil)
+	rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	var resp ChatResponse
+	decodeBody(t, rec, &resp)
+	if resp.Answer != "Yes." {
+		t.Errorf("answer = %q, want the retried answer", resp.Answer)
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 30 {
+		t.Errorf("usage = %+v, want both calls counted", resp.Usage)
+	}
+	if got := len(client.Requests()); got != 2 {
+		t.Errorf("OpenAI was called %d times, want 2", got)
+	}
+}
+
+func TestEmptyAnswerTwiceIsBadGateway(t *testing.T) {
+	client := answeringInTurn("")
+	s := newTestServer(t, client, nil)
+	logger, hook := logtest.NewNullLogger()
+	s.logger = logger
+
+	rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Is a salmon a fish?"}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502: %s", rec.Code, rec.Body.String())
+	}
+	var resp ErrorResponse
+	decodeBody(t, rec, &resp)
+	if resp.Error.Code != ErrCodeUpstreamError || resp.Error.Message != "OpenAI returned an empty answer, please retry" {
+		t.Errorf("error = %+v", resp.Error)
+	}
+	if got := len(client.Requests()); got != 2 {
+		t.Errorf("OpenAI was called %d times, want exactly one retry", got)
+	}
+
+	var logged int
+	for _, entry := range hook.AllEntries() {
+		if entry.Data["finish_reason"] == openai.FinishReasonLength {
+			logged++
+			if entry.Level > logrus.WarnLevel {
+				t.Errorf("%q logged at %s", entry.Message, entry.Level)
+			}
+		}
+	}
+	if logged != 2 {
+		t.Errorf("finish reason logged %d times, want once per empty answer", logged)
+	}
+}
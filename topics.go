@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// Topic policy modes: "allow" answers only questions on a listed topic,
+// "deny" refuses questions on a listed topic.
+const (
+	topicModeAllow = "allow"
+	topicModeDeny  = "deny"
+)
+
+// Topic classifiers.
+const (
+	topicClassifierKeywords = "keywords"
+	topicClassifierModel    = "model"
+)
+
+// defaultTopicClassifierModel is a cheap model that is good enough to pick a
+// topic from a short list.
+const defaultTopicClassifierModel = "gpt-4o-mini"
+
+// offTopicQuestions counts questions refused by the topic policy.
+var offTopicQuestions = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "tschabot_off_topic_questions_total",
+	Help: "Questions refused by the topic policy.",
+})
+
+// TopicPolicy restricts which topics the bot talks about, e.g. for a kids-safe
+// deployment.
+type TopicPolicy struct {
+	// Mode is "allow" or "deny".
+	Mode string
+	// Topics are the listed topics, lowercased.
+	Topics []string
+	// Keywords maps each topic to the words that mark a question as being
+	// about it; only used by the keyword classifier.
+	Keywords map[string][]string
+	// Model, when set, classifies questions with a chat model instead of
+	// keywords.
+	Model string
+	// Refusal is the canned answer to a refused question.
+	Refusal string
+}
+
+// loadTopicPolicy reads the policy from TOPIC_POLICY, TOPICS,
+// TOPIC_CLASSIFIER, TOPIC_KEYWORDS_FILE, TOPIC_CLASSIFIER_MODEL and
+// TOPIC_REFUSAL. It returns nil when TOPIC_POLICY is unset.
+func loadTopicPolicy() (*TopicPolicy, error) {
+	mode := os.Getenv("TOPIC_POLICY")
+	if mode == "" {
+		return nil, nil
+	}
+	if mode != topicModeAllow && mode != topicModeDeny {
+		return nil, fmt.Errorf("TOPIC_POLICY must be %q or %q", topicModeAllow, topicModeDeny)
+	}
+
+	policy := &TopicPolicy{Mode: mode}
+	for _, topic := range strings.Split(os.Getenv("TOPICS"), ",") {
+		if topic = strings.ToLower(strings.TrimSpace(topic)); topic != "" {
+			policy.Topics = append(policy.Topics, topic)
+		}
+	}
+	if len(policy.Topics) == 0 {
+		return nil, fmt.Errorf("TOPIC_POLICY requires TOPICS")
+	}
+
+	switch classifier := getEnv("TOPIC_CLASSIFIER", topicClassifierKeywords); classifier {
+	case topicClassifierKeywords:
+		keywords, err := loadTopicKeywords(os.Getenv("TOPIC_KEYWORDS_FILE"), policy.Topics)
+		if err != nil {
+			return nil, err
+		}
+		policy.Keywords = keywords
+	case topicClassifierModel:
+		policy.Model = getEnv("TOPIC_CLASSIFIER_MODEL", defaultTopicClassifierModel)
+	default:
+		return nil, fmt.Errorf("TOPIC_CLASSIFIER must be %q or %q", topicClassifierKeywords, topicClassifierModel)
+	}
+
+	policy.Refusal = os.Getenv("TOPIC_REFUSAL")
+	if policy.Refusal == "" {
+		if mode == topicModeAllow {
+			policy.Refusal = fmt.Sprintf("Sorry, I can only help with questions about %s. Could you ask me something about that instead?", strings.Join(policy.Topics, ", "))
+		} else {
+			policy.Refusal = "Sorry, that's not something I can talk about. Let's chat about something else!"
+		}
+	}
+	return policy, nil
+}
+
+// loadTopicKeywords reads a JSON object mapping every topic to its keywords.
+func loadTopicKeywords(path string, topics []string) (map[string][]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("TOPIC_CLASSIFIER %q requires TOPIC_KEYWORDS_FILE", topicClassifierKeywords)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read TOPIC_KEYWORDS_FILE: %w", err)
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse TOPIC_KEYWORDS_FILE: %w", err)
+	}
+
+	keywords := make(map[string][]string, len(topics))
+	for topic, words := range raw {
+		for _, w := range words {
+			if w = normalizeWords(w); w != "" {
+				keywords[strings.ToLower(topic)] = append(keywords[strings.ToLower(topic)], w)
+			}
+		}
+	}
+	for _, topic := range topics {
+		if len(keywords[topic]) == 0 {
+			return nil, fmt.Errorf("TOPIC_KEYWORDS_FILE has no keywords for topic %q", topic)
+		}
+	}
+	return keywords, nil
+}
+
+// normalizeWords lowercases s and reduces it to words separated by single
+// spaces, so keywords match regardless of punctuation.
+func normalizeWords(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// classifyByKeywords returns the first topic with a keyword in question, or
+// "" when none matches. Keywords match whole words, plurals included, so
+// "cat" matches "cats" but not "category".
+func (p *TopicPolicy) classifyByKeywords(question string) string {
+	text := " " + normalizeWords(question) + " "
+	for _, topic := range p.Topics {
+		for _, keyword := range p.Keywords[topic] {
+			for _, form := range []string{keyword, keyword + "s", keyword + "es"} {
+				if strings.Contains(text, " "+form+" ") {
+					return topic
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// classifyByModel asks the classifier model which listed topic the question
+// is about. It returns "" when the model picks none of them.
+func (s *Server) classifyByModel(ctx context.Context, question string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	policy := s.cfg.TopicPolicy
+	req := openai.ChatCompletionRequest{
+		Model:     policy.Model,
+		MaxTokens: 10,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: fmt.Sprintf(
+				"Classify the user's question into exactly one of these topics: %s. "+
+					"If none of them fits, reply with \"other\". Reply with the topic only.",
+				strings.Join(policy.Topics, ", "))},
+			{Role: openai.ChatMessageRoleUser, Content: question},
+		},
+	}
+	adaptForReasoning(&req, "low")
+	resp, err := s.callChatCompletion(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Choices) == 0 {
+		return "", fmt.Errorf("topic classifier returned no choices")
+	}
+	answer := normalizeWords(resp.Choices[0].Message.Content)
+	for _, topic := range policy.Topics {
+		if answer == normalizeWords(topic) {
+			return topic, nil
+		}
+	}
+	return "", nil
+}
+
+// onTopic reports whether the topic policy permits question. Without a
+// policy every question is on topic.
+func (s *Server) onTopic(ctx context.Context, question string) (bool, error) {
+	policy := s.cfg.TopicPolicy
+	if policy == nil {
+		return true, nil
+	}
+
+	var topic string
+	if policy.Model != "" {
+		var err error
+		if topic, err = s.classifyByModel(ctx, question); err != nil {
+			return false, err
+		}
+	} else {
+		topic = policy.classifyByKeywords(question)
+	}
+
+	allowed := topic != ""
+	if policy.Mode == topicModeDeny {
+		allowed = topic == ""
+	}
+	if !allowed {
+		offTopicQuestions.Inc()
+	}
+	return allowed, nil
+}
+
+// checkTopic applies the topic policy to a request's question. It returns
+// false for ok when classification failed and an error response was written;
+// otherwise allowed tells whether to answer or reply with the refusal.
+func (s *Server) checkTopic(w http.ResponseWriter, r *http.Request, question string) (allowed, ok bool) {
+	allowed, err := s.onTopic(r.Context(), question)
+	if err != nil {
+		if clientGone(r) {
+			return false, false
+		}
+		logUpstreamError(s.requestLogger(r), err, "error classifying the question topic")
+		s.errorResponse(w, http.StatusInternalServerError, ErrCodeUpstreamError, "Failed to check the question topic")
+		return false, false
+	}
+	if !allowed {
+		s.requestLogger(r).Info("question refused by the topic policy")
+	}
+	return allowed, true
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// writeTopicKeywords writes a TOPIC_KEYWORDS_FILE and returns its path.
+func writeTopicKeywords(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "keywords.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestChatTopicPolicy(t *testing.T) {
+	keywords := writeTopicKeywords(t, `{"animals": ["cat", "dog"], "space": ["planet", "Star"]}`)
+	policy := func(mode string) map[string]string {
+		return map[string]string{
+			"TOPIC_POLICY":        mode,
+			"TOPICS":              "Animals, space",
+			"TOPIC_KEYWORDS_FILE": keywords,
+			"TOPIC_REFUSAL":       "Let's talk about something else.",
+		}
+	}
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		question string
+		refused  bool
+	}{
+		{"policy off", nil, "Who won the match yesterday?", false},
+		{"allowed topic", policy(topicModeAllow), "Why do cats purr?", false},
+		{"allowed topic in other words", policy(topicModeAllow), "How far away is the nearest star?", false},
+		{"topic not allowed", policy(topicModeAllow), "Who won the match yesterday?", true},
+		{"keyword inside another word", policy(topicModeAllow), "Which category is this in?", true},
+		{"denied topic", policy(topicModeDeny), "Is my dog hungry?", true},
+		{"topic not denied", policy(topicModeDeny), "Who won the match yesterday?", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := answering("An answer.")
+			s := newTestServer(t, client, tt.env)
+
+			rec := postJSON(s.chatHandler, "/api/chat", `{"question":"`+tt.question+`"}`)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+			}
+			var body struct {
+				ChatResponse
+				Error *ErrorDetail `json:"error"`
+			}
+			decodeBody(t, rec, &body)
+			if body.Error != nil {
+				t.Errorf("error = %+v, want none", body.Error)
+			}
+
+			calls := len(client.Requests())
+			if tt.refused {
+				if !body.OffTopic || body.Answer != "Let's talk about something else." {
+					t.Errorf("got %+v, want the refusal marked off_topic", body.ChatResponse)
+				}
+				if calls != 0 {
+					t.Errorf("made %d OpenAI calls for a refused question, want 0", calls)
+				}
+				return
+			}
+			if body.OffTopic || body.Answer != "An answer." {
+				t.Errorf("got %+v, want the model's answer", body.ChatResponse)
+			}
+			if calls != 1 {
+				t.Errorf("made %d OpenAI calls, want 1", calls)
+			}
+		})
+	}
+}
+
+func TestChatTopicModelClassifier(t *testing.T) {
+	env := map[string]string{
+		"TOPIC_POLICY":     topicModeAllow,
+		"TOPICS":           "animals",
+		"TOPIC_CLASSIFIER": topicClassifierModel,
+	}
+
+	tests := []struct {
+		name     string
+		topic    string
+		err      error
+		status   int
+		code     ErrorCode
+		offTopic bool
+	}{
+		{"on topic", "Animals.", nil, http.StatusOK, "", false},
+		{"off topic", "other", nil, http.StatusOK, "", true},
+		{"classifier fails", "", serverError, http.StatusInternalServerError, ErrCodeUpstreamError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeClient{complete: func(_ context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+				if req.Model != defaultTopicClassifierModel {
+					return completion("An answer."), nil
+				}
+				if tt.err != nil {
+					return openai.ChatCompletionResponse{}, tt.err
+				}
+				return completion(tt.topic), nil
+			}}
+			s := newTestServer(t, client, env)
+
+			rec := postJSON(s.chatHandler, "/api/chat", `{"question":"Why do cats purr?"}`)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.code != "" {
+				var body ErrorResponse
+				decodeBody(t, rec, &body)
+				if body.Error.Code != tt.code {
+					t.Errorf("code = %q, want %q", body.Error.Code, tt.code)
+				}
+			} else {
+				var body ChatResponse
+				decodeBody(t, rec, &body)
+				if body.OffTopic != tt.offTopic {
+					t.Errorf("off_topic = %v, want %v", body.OffTopic, tt.offTopic)
+				}
+			}
+
+			// Only the classifier may run unless the question was answered.
+			wantCalls := 1
+			if tt.code == "" && !tt.offTopic {
+				wantCalls = 2
+			}
+			if calls := len(client.Requests()); calls != wantCalls {
+				t.Errorf("made %d OpenAI calls, want %d", calls, wantCalls)
+			}
+		})
+	}
+}
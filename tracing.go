@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// serviceName identifies this service in traces unless OTEL_SERVICE_NAME
+// overrides it.
+const serviceName = "tschawytscha-ai-back"
+
+// tracer creates the spans around OpenAI calls.
+var tracer = otel.Tracer("github.com/apten-fors/tschawytscha-ai-back")
+
+// tracingConfigured reports whether an OTLP trace endpoint is set through the
+// standard OTEL_* variables.
+func tracingConfigured() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// setupTracing installs an OTLP/HTTP tracer provider configured by the
+// OTEL_* environment variables. Without an endpoint the global provider stays
+// a no-op. The returned function flushes pending spans on shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	// Trace context is propagated even when this service does not export, so
+	// traces stay connected across it.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !tracingConfigured() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName), semconv.ServiceVersion(version)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// traceRouteMiddleware names the server span after the matched route
+// template, which keeps span names low-cardinality.
+func traceRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tmpl)
+				span.SetAttributes(semconv.HTTPRoute(tmpl))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startUpstreamSpan starts a client span for an OpenAI call.
+func startUpstreamSpan(ctx context.Context, name, model string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("openai.model", model)))
+}
+
+// endUpstreamSpan records the outcome of an OpenAI call and ends the span.
+// usage may be nil when the call failed or reported none.
+func endUpstreamSpan(span trace.Span, usage *openai.Usage, err error) {
+	if usage != nil {
+		span.SetAttributes(
+			attribute.Int("openai.usage.prompt_tokens", usage.PromptTokens),
+			attribute.Int("openai.usage.completion_tokens", usage.CompletionTokens),
+			attribute.Int("openai.usage.total_tokens", usage.TotalTokens),
+		)
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
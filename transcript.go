@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Transcript export formats.
+const (
+	exportJSON     = "json"
+	exportText     = "txt"
+	exportMarkdown = "md"
+)
+
+// exportSessionHandler returns the stored conversation as a downloadable
+// transcript: the raw message list as JSON, or a readable txt or md file.
+// Only the session's owner may export it.
+func (s *Server) exportSessionHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportJSON
+	}
+	if format != exportJSON && format != exportText && format != exportMarkdown {
+		s.errorResponse(w, http.StatusBadRequest, ErrCodeInvalidRequest, fmt.Sprintf("Format must be %q, %q or %q", exportJSON, exportText, exportMarkdown))
+		return
+	}
+
+	sessionID, msgs, ok := s.ownedSession(w, r)
+	if !ok {
+		return
+	}
+	s.requestLogger(r).WithFields(logrus.Fields{
+		"session_id": sessionID,
+		"format":     format,
+	}).Info("exporting session transcript")
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "session-" + sessionID + "." + format,
+	}))
+	switch format {
+	case exportText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, textTranscript(s.cfg.BotName, msgs))
+	case exportMarkdown:
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		fmt.Fprint(w, markdownTranscript(s.cfg.BotName, sessionID, msgs))
+	default:
+		s.writeJSON(w, http.StatusOK, msgs)
+	}
+}
+
+// speaker names the author of a message in readable transcripts; answers
+// are attributed to botName.
+func speaker(botName, role string) string {
+	if role == "assistant" {
+		return botName
+	}
+	return "User"
+}
+
+// textTranscript renders msgs as plain text, one block per message, with
+// markdown removed from the answers.
+func textTranscript(botName string, msgs []Message) string {
+	var b strings.Builder
+	for i, msg := range msgs {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		content := msg.Content
+		if msg.Role == "assistant" {
+			content = stripMarkdown(content)
+		}
+		fmt.Fprintf(&b, "%s:\n%s\n", speaker(botName, msg.Role), content)
+	}
+	return b.String()
+}
+
+// markdownTranscript renders msgs as a markdown document. Answers are already
+// markdown and are kept as they are.
+func markdownTranscript(botName, sessionID string, msgs []Message) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Conversation %s\n", sessionID)
+	for _, msg := range msgs {
+		fmt.Fprintf(&b, "\n## %s\n\n%s\n", speaker(botName, msg.Role), msg.Content)
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportSessionHandler(t *testing.T) {
+	tests := []struct {
+		name            string
+		env             map[string]string
+		format          string
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "json by default",
+			wantStatus:      http.StatusOK,
+			wantContentType: "application/json",
+			wantBody:        `[{"role":"user","content":"Are you a fish?"},{"role":"assistant","content":"**No**, I am not."}]`,
+		},
+		{
+			name:            "text",
+			format:          exportText,
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "User:\nAre you a fish?\n\nTshaBot:\nNo, I am not.\n",
+		},
+		{
+			name:            "markdown",
+			format:          exportMarkdown,
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/markdown; charset=utf-8",
+			wantBody:        "# Conversation sess-1\n\n## User\n\nAre you a fish?\n\n## TshaBot\n\n**No**, I am not.\n",
+		},
+		{
+			name:            "persona name",
+			env:             map[string]string{"PERSONA": "neutral"},
+			format:          exportText,
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/plain; charset=utf-8",
+			wantBody:        "User:\nAre you a fish?\n\nAssistant:\nNo, I am not.\n",
+		},
+		{
+			name:            "configured name",
+			env:             map[string]string{"BOT_NAME": "Chinook"},
+			format:          exportMarkdown,
+			wantStatus:      http.StatusOK,
+			wantContentType: "text/markdown; charset=utf-8",
+			wantBody:        "# Conversation sess-1\n\n## User\n\nAre you a fish?\n\n## Chinook\n\n**No**, I am not.\n",
+		},
+		{
+			name:       "unknown format",
+			format:     "pdf",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, answering("hi"), tt.env)
+			s.store.Append("sess-1", Message{Role: "user", Content: "Are you a fish?"})
+			s.store.Append("sess-1", Message{Role: "assistant", Content: "**No**, I am not."})
+
+			r := sessionRequest(http.MethodGet, "sess-1", "")
+			if tt.format != "" {
+				r.URL.RawQuery = "format=" + tt.format
+			}
+			rec := httptest.NewRecorder()
+			s.exportSessionHandler(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantContentType)
+			}
+			if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, "session-sess-1.") {
+				t.Errorf("Content-Disposition = %q", cd)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != strings.TrimSpace(tt.wantBody) {
+				t.Errorf("body = %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "net/http"
+
+// Build metadata, overridden at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.builtAt=$(date -u +%FT%TZ)"
+var (
+	version = "dev"
+	commit  = "unknown"
+	builtAt = "unknown"
+)
+
+// VersionResponse describes the running build.
+type VersionResponse struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit"`
+	BuiltAt string `json:"built_at"`
+}
+
+// versionHandler reports which build is serving requests.
+func (s *Server) versionHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, VersionResponse{
+		Version: version,
+		Commit:  commit,
+		BuiltAt: builtAt,
+	})
+}
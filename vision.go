@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// imageTokens approximates the prompt cost of one image at auto detail.
+const imageTokens = 765
+
+// visionModelPrefixes lists the model families that accept image input.
+var visionModelPrefixes = []string{"gpt-4o", "gpt-4-turbo", "gpt-4.1"}
+
+// allowedImageTypes are the inline image formats OpenAI accepts.
+var allowedImageTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// supportsVision reports whether model accepts image input.
+func supportsVision(model string) bool {
+	for _, prefix := range visionModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageURL validates the image attached to req and returns the URL to send
+// to OpenAI: image_url as given, or the inline image as a data URL. It returns
+// "" when the request has no image. The status is the one to answer with on
+// error.
+func (s *Server) imageURL(req ChatRequest) (string, int, error) {
+	if req.ImageURL == "" && req.Image == "" {
+		return "", 0, nil
+	}
+	if req.ImageURL != "" && req.Image != "" {
+		return "", http.StatusBadRequest, errors.New("image and image_url are mutually exclusive")
+	}
+	if len(req.Messages) > 0 {
+		return "", http.StatusBadRequest, errors.New("images cannot be combined with messages")
+	}
+
+	model := s.cfg.Model
+	if req.Model != "" {
+		model = req.Model
+	}
+	if !supportsVision(model) {
+		return "", http.StatusBadRequest, fmt.Errorf("model %q does not accept images", model)
+	}
+
+	// Remote images are fetched and size-checked by OpenAI itself.
+	if req.ImageURL != "" {
+		u, err := url.Parse(req.ImageURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return "", http.StatusBadRequest, errors.New("image_url must be an https URL")
+		}
+		return req.ImageURL, 0, nil
+	}
+
+	// Accept both bare base64 and a data URL; the type is sniffed either way.
+	encoded := req.Image
+	if _, data, ok := strings.Cut(encoded, ";base64,"); ok && strings.HasPrefix(encoded, "data:") {
+		encoded = data
+	}
+	if int64(base64.StdEncoding.DecodedLen(len(encoded))) > s.cfg.MaxImageBytes+2 {
+		return "", http.StatusRequestEntityTooLarge, fmt.Errorf("image must not exceed %d bytes", s.cfg.MaxImageBytes)
+	}
+	image, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", http.StatusBadRequest, errors.New("image must be base64 encoded")
+	}
+	if int64(len(image)) > s.cfg.MaxImageBytes {
+		return "", http.StatusRequestEntityTooLarge, fmt.Errorf("image must not exceed %d bytes", s.cfg.MaxImageBytes)
+	}
+	mediaType := http.DetectContentType(image)
+	if !allowedImageTypes[mediaType] {
+		return "", http.StatusBadRequest, fmt.Errorf("unsupported image type %s; use PNG, JPEG, GIF or WebP", mediaType)
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(image), 0, nil
+}
+
+// userMessage builds the message carrying the question, with the image as a
+// second content part when one is attached.
+func userMessage(req ChatRequest) openai.ChatCompletionMessage {
+	if req.ImageURL == "" {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleUser, Content: req.Question}
+	}
+	return openai.ChatCompletionMessage{
+		Role: openai.ChatMessageRoleUser,
+		MultiContent: []openai.ChatMessagePart{
+			{Type: openai.ChatMessagePartTypeText, Text: req.Question},
+			{Type: openai.ChatMessagePartTypeImageURL, ImageURL: &openai.ChatMessageImageURL{
+				URL:    req.ImageURL,
+				Detail: openai.ImageURLDetailAuto,
+			}},
+		},
+	}
+}
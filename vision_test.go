@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// pngHeader is enough of a PNG for content sniffing.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func TestChatVision(t *testing.T) {
+	png := base64.StdEncoding.EncodeToString(pngHeader)
+	tests := []struct {
+		name       string
+		payload    map[string]string
+		wantStatus int
+		wantCode   ErrorCode
+		wantURL    string
+	}{
+		{"image url", map[string]string{"image_url": "https://example.com/salmon.png"}, http.StatusOK, "", "https://example.com/salmon.png"},
+		{"inline image", map[string]string{"image": png}, http.StatusOK, "", "data:image/png;base64," + png},
+		{"inline data url", map[string]string{"image": "data:image/jpeg;base64," + png}, http.StatusOK, "", "data:image/png;base64," + png},
+		{"plain http url", map[string]string{"image_url": "http://example.com/salmon.png"}, http.StatusBadRequest, ErrCodeInvalidRequest, ""},
+		{"both images", map[string]string{"image_url": "https://example.com/salmon.png", "image": png}, http.StatusBadRequest, ErrCodeInvalidRequest, ""},
+		{"model without vision", map[string]string{"image": png, "model": "gpt-3.5-turbo"}, http.StatusBadRequest, ErrCodeInvalidRequest, ""},
+		{"not base64", map[string]string{"image": "not base64!"}, http.StatusBadRequest, ErrCodeInvalidRequest, ""},
+		{"not an image", map[string]string{"image": base64.StdEncoding.EncodeToString([]byte("just some text"))}, http.StatusBadRequest, ErrCodeInvalidRequest, ""},
+		{"too large", map[string]string{"image": base64.StdEncoding.EncodeToString(append(pngHeader, make([]byte, 2048)...))}, http.StatusRequestEntityTooLarge, ErrCodePayloadTooLarge, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := answering("A salmon.")
+			s := newTestServer(t, client, map[string]string{"MAX_IMAGE_BYTES": "1024"})
+			payload := map[string]string{"question": "What fish is this?"}
+			for k, v := range tt.payload {
+				payload[k] = v
+			}
+			var body bytes.Buffer
+			json.NewEncoder(&body).Encode(payload)
+
+			rec := postJSON(s.chatHandler, "/api/chat", body.String())
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			reqs := client.Requests()
+			if tt.wantCode != "" {
+				var resp ErrorResponse
+				decodeBody(t, rec, &resp)
+				if resp.Error.Code != tt.wantCode {
+					t.Errorf("code = %q, want %q", resp.Error.Code, tt.wantCode)
+				}
+				if len(reqs) != 0 {
+					t.Errorf("request reached OpenAI %d times", len(reqs))
+				}
+				return
+			}
+
+			msgs := reqs[0].Messages
+			user := msgs[len(msgs)-1]
+			if user.Role != openai.ChatMessageRoleUser || user.Content != "" || len(user.MultiContent) != 2 {
+				t.Fatalf("user message = %+v, want a text and an image part", user)
+			}
+			text, image := user.MultiContent[0], user.MultiContent[1]
+			if text.Type != openai.ChatMessagePartTypeText || text.Text != "What fish is this?" {
+				t.Errorf("first part = %+v, want the question", text)
+			}
+			if image.Type != openai.ChatMessagePartTypeImageURL || image.ImageURL == nil || image.ImageURL.URL != tt.wantURL {
+				t.Errorf("second part = %+v, want the image %s", image, tt.wantURL)
+			}
+		})
+	}
+}
+
+func TestUserMessageWithoutImage(t *testing.T) {
+	msg := userMessage(ChatRequest{Question: "Is a salmon a fish?"})
+	if msg.Content != "Is a salmon a fish?" || msg.MultiContent != nil {
+		t.Errorf("userMessage = %+v, want plain text content", msg)
+	}
+}
+
+func TestSupportsVision(t *testing.T) {
+	for model, want := range map[string]bool{
+		"gpt-4o":        true,
+		"gpt-4o-mini":   true,
+		"gpt-4-turbo":   true,
+		"gpt-4.1-nano":  true,
+		"gpt-3.5-turbo": false,
+		"o3-mini":       false,
+	} {
+		if got := supportsVision(model); got != want {
+			t.Errorf("supportsVision(%q) = %v, want %v", model, got, want)
+		}
+	}
+}
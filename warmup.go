@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// warmup sends a one-token completion so DNS, TLS and connection pooling are
+// set up, and the API key verified, before the first real request arrives.
+func (s *Server) warmup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.RequestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	req := openai.ChatCompletionRequest{
+		Model:     s.cfg.Model,
+		MaxTokens: 1,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleUser, Content: "ping"},
+		},
+	}
+	adaptForReasoning(&req, "low")
+	_, err := s.callChatCompletion(ctx, req)
+	if err != nil {
+		return err
+	}
+	s.logger.Infof("OpenAI warmup succeeded in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	openai "github.com/sashabaranov/go-openai"
+	"github.com/sirupsen/logrus"
+)
+
+// WebSocket keepalive settings. The server pings well within pongWait so an
+// idle but healthy connection is never timed out.
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// WebSocket event types sent to the client.
+const (
+	wsEventDelta = "delta"
+	wsEventDone  = "done"
+	wsEventError = "error"
+)
+
+// WSRequest is a question sent by the client over the socket.
+type WSRequest struct {
+	Question string `json:"question"`
+}
+
+// WSEvent is a message sent to the client. Answers arrive as a series of
+// "delta" events followed by a "done" event; failures produce an "error" event
+// and leave the connection open.
+type WSEvent struct {
+	Type  string       `json:"type"`
+	Delta string       `json:"delta,omitempty"`
+	Done  *StreamDone  `json:"done,omitempty"`
+	Error *ErrorDetail `json:"error,omitempty"`
+}
+
+// newWSUpgrader accepts upgrades from the CORS allowlist and from clients that
+// send no Origin at all (non-browser clients).
+func newWSUpgrader(allowedOrigins []string) *websocket.Upgrader {
+	originAllowed := originMatcher(allowedOrigins)
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || originAllowed(origin)
+		},
+	}
+}
+
+// wsChatHandler serves a persistent chat over a WebSocket. Each connection
+// keeps its own conversation history, which is discarded on disconnect.
+func (s *Server) wsChatHandler(upgrader *websocket.Upgrader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := s.requestLogger(r)
+
+		if !s.requireClient(w, r) {
+			return
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already replied with an HTTP error.
+			log.WithError(err).Warn("websocket upgrade failed")
+			return
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		conn.SetReadLimit(s.cfg.MaxBodyBytes)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+
+		// Reading happens in its own goroutine so pongs and disconnects are
+		// noticed while an answer is being streamed.
+		incoming := make(chan []byte)
+		go func() {
+			defer cancel()
+			for {
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+						log.WithError(err).Warn("websocket read failed")
+					}
+					return
+				}
+				select {
+				case incoming <- data:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		go func() {
+			ticker := time.NewTicker(wsPingPeriod)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+						cancel()
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		log.Info("websocket connected")
+		endUser := s.endUserID(r, "")
+		var history []Message
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info("websocket disconnected")
+				return
+			case data := <-incoming:
+				// The middleware only charged the upgrade; every question
+				// costs an OpenAI call, so each one is charged as a request.
+				if err := s.takeTokens(r, 1); err != nil {
+					msg := err.msg
+					if err.retryAfter > 0 {
+						msg = fmt.Sprintf("%s, retry in %s seconds", msg, retryAfterSeconds(err.retryAfter))
+					}
+					s.wsError(conn, ErrCodeRateLimited, msg)
+					continue
+				}
+				question, answer, ok := s.wsAnswer(ctx, conn, log, data, history, endUser)
+				if !ok {
+					continue
+				}
+				history = append(history,
+					Message{Role: openai.ChatMessageRoleUser, Content: question},
+					Message{Role: openai.ChatMessageRoleAssistant, Content: answer})
+				if len(history) > maxHistoryMessages {
+					history = history[len(history)-maxHistoryMessages:]
+				}
+			}
+		}
+	}
+}
+
+// wsAnswer answers one question, streaming the reply over conn. It returns the
+// question and the full answer, or false when the exchange failed and an
+// error event was sent instead.
+func (s *Server) wsAnswer(ctx context.Context, conn *websocket.Conn, log *logrus.Entry, data []byte, history []Message, endUser string) (string, string, bool) {
+	var req WSRequest
+	if msg, ok := s.decodePayload(log, data, &req); !ok {
+		s.wsError(conn, ErrCodeInvalidPayload, msg)
+		return "", "", false
+	}
+	if status, msg := s.validateQuestion(req.Question); msg != "" {
+		s.wsError(conn, questionErrorCode(status), msg)
+		return "", "", false
+	}
+
+	if req.Question = s.sanitize(log, req.Question); req.Question == "" {
+		s.wsError(conn, ErrCodeInvalidRequest, "The question is empty after removing prompt injection markers")
+		return "", "", false
+	}
+
+	if s.cfg.ModerationEnabled {
+		flagged, err := s.moderate(ctx, req.Question)
+		if err != nil {
+			logUpstreamError(log, err, "error calling OpenAI moderation API")
+			s.wsError(conn, ErrCodeUpstreamError, "Failed to moderate the question")
+			return "", "", false
+		}
+		if flagged {
+			log.Warn("question rejected by moderation")
+			s.wsError(conn, ErrCodeContentRejected, "The question was rejected because it violates the content policy")
+			return "", "", false
+		}
+	}
+
+	allowed, err := s.onTopic(ctx, req.Question)
+	if err != nil {
+		logUpstreamError(log, err, "error classifying the question topic")
+		s.wsError(conn, ErrCodeUpstreamError, "Failed to check the question topic")
+		return "", "", false
+	}
+	if !allowed {
+		if err := wsWrite(conn, WSEvent{Type: wsEventDelta, Delta: s.cfg.TopicPolicy.Refusal}); err == nil {
+			wsWrite(conn, WSEvent{Type: wsEventDone, Done: &StreamDone{FinishReason: finishReasonOffTopic}})
+		}
+		return "", "", false
+	}
+
+	chatReq := s.buildChatRequest(ChatRequest{Question: req.Question, History: history, endUser: endUser})
+	if dropped := s.trimContext(&chatReq); dropped > 0 {
+		log.Infof("dropped %d oldest history messages to fit the context budget", dropped)
+	}
+	if estimateTokens(chatReq.Messages) > s.promptBudget(chatReq) {
+		s.wsError(conn, ErrCodeContextTooLong, "The question is too long for the model's context window")
+		return "", "", false
+	}
+	if s.cfg.StreamIncludeUsage {
+		chatReq.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
+	release, err := s.acquireUpstream(ctx)
+	if err != nil {
+		if errors.Is(err, errUpstreamBusy) {
+			s.wsError(conn, ErrCodeServiceUnavailable, "The service is busy, please retry shortly")
+		}
+		return "", "", false
+	}
+	defer release()
+
+	ctx, span := startUpstreamSpan(ctx, "openai.chat_completion_stream", chatReq.Model)
+	var (
+		spanUsage *openai.Usage
+		spanErr   error
+	)
+	defer func() { endUpstreamSpan(span, spanUsage, spanErr) }()
+
+	var stream ChatStream
+	err = s.guardUpstream(func() error {
+		var err error
+		stream, err = s.clientFor(ctx).CreateChatCompletionStream(ctx, chatReq)
+		return err
+	})
+	if err != nil {
+		spanErr = err
+		if isBreakerOpen(err) {
+			s.wsError(conn, ErrCodeServiceUnavailable, "OpenAI is temporarily unavailable, please retry later")
+			return "", "", false
+		}
+		if isContextLengthExceeded(err) {
+			s.wsError(conn, ErrCodeContextTooLong, contextTooLongMessage)
+			return "", "", false
+		}
+		logUpstreamError(log, err, "error opening OpenAI stream")
+		s.wsError(conn, ErrCodeUpstreamError, "Failed to fetch response from OpenAI")
+		return "", "", false
+	}
+	defer stream.Close()
+
+	var (
+		answer strings.Builder
+		done   StreamDone
+	)
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				log.WithField("streamed_chars", answer.Len()).Info("stream cancelled early: client disconnected")
+				return "", "", false
+			}
+			log.WithError(err).Error("error reading OpenAI stream")
+			spanErr = err
+			s.wsError(conn, ErrCodeUpstreamError, "The answer was interrupted")
+			return "", "", false
+		}
+
+		if chunk.Usage != nil {
+			spanUsage = chunk.Usage
+			done.Usage = &Usage{
+				PromptTokens:     chunk.Usage.PromptTokens,
+				CompletionTokens: chunk.Usage.CompletionTokens,
+				TotalTokens:      chunk.Usage.TotalTokens,
+			}
+		}
+		if chunk.SystemFingerprint != "" {
+			done.SystemFingerprint = chunk.SystemFingerprint
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			done.FinishReason = string(reason)
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		answer.WriteString(chunk.Choices[0].Delta.Content)
+		if err := wsWrite(conn, WSEvent{Type: wsEventDelta, Delta: chunk.Choices[0].Delta.Content}); err != nil {
+			log.WithError(err).Warn("failed to write websocket chunk")
+			return "", "", false
+		}
+	}
+
+	if done.Usage != nil {
+		done.EstimatedCostUSD = s.recordCost(chatReq.Model, *done.Usage)
+	}
+	if err := wsWrite(conn, WSEvent{Type: wsEventDone, Done: &done}); err != nil {
+		log.WithError(err).Warn("failed to write websocket terminator")
+	}
+	return req.Question, answer.String(), true
+}
+
+// wsWrite sends a single event to the client.
+func wsWrite(conn *websocket.Conn, event WSEvent) error {
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteJSON(event)
+}
+
+// wsError sends an error event; the connection stays open.
+func (s *Server) wsError(conn *websocket.Conn, code ErrorCode, msg string) {
+	if err := wsWrite(conn, WSEvent{Type: wsEventError, Error: &ErrorDetail{Code: code, Message: msg}}); err != nil {
+		s.logger.WithError(err).Warn("failed to write websocket error")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWS serves s's WebSocket chat behind the rate limiter and connects to it.
+func dialWS(t *testing.T, s *Server) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(s.rateLimitMiddleware(s.wsChatHandler(newWSUpgrader(nil))))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// askWS sends a raw message and collects events up to the first "done" or
+// "error".
+func askWS(t *testing.T, conn *websocket.Conn, msg string) []WSEvent {
+	t.Helper()
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var events []WSEvent
+	for {
+		var ev WSEvent
+		if err := conn.ReadJSON(&ev); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		events = append(events, ev)
+		if ev.Type == wsEventDone || ev.Type == wsEventError {
+			return events
+		}
+	}
+}
+
+func TestWSChatStreamsAnswer(t *testing.T) {
+	s := newTestServer(t, streaming("Not ", "a ", "fish."), nil)
+	conn := dialWS(t, s)
+
+	events := askWS(t, conn, `{"question":"Are you a fish?"}`)
+	var answer strings.Builder
+	for _, ev := range events {
+		answer.WriteString(ev.Delta)
+	}
+	if last := events[len(events)-1]; last.Type != wsEventDone {
+		t.Fatalf("last event = %+v, want done", last)
+	}
+	if answer.String() != "Not a fish." {
+		t.Errorf("answer = %q, want %q", answer.String(), "Not a fish.")
+	}
+}
+
+func TestWSChatValidatesMessages(t *testing.T) {
+	s := newTestServer(t, streaming("ok"), nil)
+	conn := dialWS(t, s)
+
+	tests := []struct {
+		name     string
+		msg      string
+		wantCode ErrorCode
+	}{
+		{"invalid JSON", `{"question":`, ErrCodeInvalidPayload},
+		{"invalid UTF-8", "{\"question\":\"caf\xe9\"}", ErrCodeInvalidPayload},
+		{"unknown field", `{"questoin":"hi"}`, ErrCodeInvalidPayload},
+		{"missing question", `{}`, ErrCodeInvalidRequest},
+		{"control character", `{"question":"hi\u0000there"}`, ErrCodeInvalidRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := askWS(t, conn, tt.msg)
+			last := events[len(events)-1]
+			if last.Type != wsEventError || last.Error.Code != tt.wantCode {
+				t.Errorf("event = %+v, want error %q", last, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestWSChatRateLimitsEachMessage(t *testing.T) {
+	// The upgrade and the first question use up the burst; the refill is too
+	// slow to matter during the test.
+	s := newTestServer(t, streaming("ok"), map[string]string{
+		"RATE_LIMIT_RPS":   "0.001",
+		"RATE_LIMIT_BURST": "2",
+	})
+	conn := dialWS(t, s)
+
+	if events := askWS(t, conn, `{"question":"first"}`); events[len(events)-1].Type != wsEventDone {
+		t.Fatalf("first question: %+v, want an answer", events)
+	}
+	events := askWS(t, conn, `{"question":"second"}`)
+	last := events[len(events)-1]
+	if last.Type != wsEventError || last.Error.Code != ErrCodeRateLimited {
+		t.Fatalf("second question: %+v, want a rate_limited error", last)
+	}
+	if len(s.chatClient().(*fakeClient).Requests()) != 1 {
+		t.Errorf("the rate-limited question reached OpenAI")
+	}
+}